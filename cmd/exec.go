@@ -0,0 +1,174 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/server"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// execReplacedEnv are environment variables that are set by weep exec or that would take
+// precedence over the container credential provider in AWS SDKs, so they are removed from
+// the child's environment
+var execReplacedEnv = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_SECURITY_TOKEN",
+	"AWS_PROFILE",
+	"AWS_DEFAULT_PROFILE",
+	"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+	"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+}
+
+// execForwardedSignals are passed on to the child process
+var execForwardedSignals = []os.Signal{
+	os.Interrupt,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [role_name] -- command [args...]",
+	Short: execShortHelp,
+	Long:  execLongHelp,
+	RunE:  runExec,
+}
+
+func runExec(cmd *cobra.Command, args []string) error {
+	dash := cmd.ArgsLenAtDash()
+	if dash < 0 || dash > 1 || len(args) == dash {
+		return fmt.Errorf("usage: %s", cmd.UseLine())
+	}
+
+	// If a role was provided, use it, otherwise prompt
+	role, err := InteractiveRolePrompt(args[:dash], region, nil)
+	if err != nil {
+		logging.LogError(err, "Error getting role")
+		return err
+	}
+	command := args[dash:]
+
+	endpoint, err := server.NewCredentialEndpoint(role, region, assumeRole)
+	if err != nil {
+		logging.LogError(err, "Error starting credential endpoint")
+		return err
+	}
+	defer endpoint.Close()
+
+	logging.Log.WithFields(logrus.Fields{
+		"role":    role,
+		"command": command[0],
+	}).Infoln("Running command")
+	child := exec.Command(command[0], command[1:]...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.Env = execEnv(os.Environ(), endpoint)
+
+	if err := child.Start(); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, execForwardedSignals...)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			// The child is in the terminal's foreground process group too, so it already has
+			// the signals typed at the terminal
+			if signalFromTerminal(sig) {
+				continue
+			}
+			if err := child.Process.Signal(sig); err != nil {
+				logging.Log.Debugf("could not forward %s to child: %v", sig, err)
+			}
+		}
+	}()
+
+	if code := exitCode(child.Wait()); code != 0 {
+		// The command has reported its own failure
+		cmd.SilenceErrors = true
+		return &ExitError{Code: code}
+	}
+	return nil
+}
+
+// ExitError is returned by a command that should make weep exit with Code, such as weep exec
+// passing on its child's exit code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// execEnv returns env without static credential variables, plus the variables that point
+// AWS SDKs to endpoint
+func execEnv(env []string, endpoint *server.CredentialEndpoint) []string {
+	result := make([]string, 0, len(env)+4)
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !util.StringInSlice(name, execReplacedEnv) {
+			result = append(result, kv)
+		}
+	}
+	return append(result,
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI="+endpoint.URL,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN="+endpoint.Token,
+		"AWS_REGION="+region,
+		"AWS_DEFAULT_REGION="+region,
+	)
+}
+
+// exitCode returns the exit code of a finished child process the way a shell would report it
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	logging.LogError(err, "Error running command")
+	return 1
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/netflix/weep/pkg/server"
+)
+
+func TestExecEnv(t *testing.T) {
+	region = "us-west-2"
+	endpoint := &server.CredentialEndpoint{URL: "http://127.0.0.1:40000/ecs/role", Token: "secret"}
+	env := execEnv([]string{
+		"HOME=/home/user",
+		"AWS_ACCESS_KEY_ID=AKIDEXAMPLE",
+		"AWS_PROFILE=prod",
+		"AWS_REGION=eu-west-1",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI=/v2/credentials",
+		"AWS_SDK_LOAD_CONFIG=1",
+	}, endpoint)
+
+	expected := []string{
+		"HOME=/home/user",
+		"AWS_SDK_LOAD_CONFIG=1",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI=http://127.0.0.1:40000/ecs/role",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN=secret",
+		"AWS_REGION=us-west-2",
+		"AWS_DEFAULT_REGION=us-west-2",
+	}
+	if len(env) != len(expected) {
+		t.Fatalf("got %v, expected %v", env, expected)
+	}
+	for i := range expected {
+		if env[i] != expected[i] {
+			t.Errorf("got %s at %d, expected %s", env[i], i, expected[i])
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	cases := []struct {
+		Description string
+		Command     []string
+		Expected    int
+	}{
+		{Description: "success", Command: []string{"true"}, Expected: 0},
+		{Description: "exit status", Command: []string{"sh", "-c", "exit 3"}, Expected: 3},
+		{Description: "killed by a signal", Command: []string{"sh", "-c", "kill -TERM $$"}, Expected: 143},
+		{Description: "command not found", Command: []string{"weep-test-command-that-does-not-exist"}, Expected: 1},
+	}
+	for _, tc := range cases {
+		got := exitCode(exec.Command(tc.Command[0], tc.Command[1:]...).Run())
+		if got != tc.Expected {
+			t.Errorf("%s: got exit code %d, expected %d", tc.Description, got, tc.Expected)
+		}
+	}
+}
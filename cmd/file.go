@@ -29,6 +29,7 @@ import (
 	"github.com/netflix/weep/pkg/aws"
 
 	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/httpAuth"
 	"github.com/netflix/weep/pkg/util"
 
 	"gopkg.in/ini.v1"
@@ -71,6 +72,9 @@ func runFile(cmd *cobra.Command, args []string) error {
 		logging.Log.WithFields(logrus.Fields{"role": role}).Infoln("Starting automatic file refresh")
 		fmt.Printf("starting automatic file refresh for %s", role)
 		go fileRefresher(role, profileName, destination, noIpRestrict, assumeRole)
+		stopMonitor := make(chan struct{})
+		defer close(stopMonitor)
+		go httpAuth.MonitorExpiration(stopMonitor)
 		<-shutdown
 	}
 	return nil
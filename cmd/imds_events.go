@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/netflix/weep/pkg/server"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	eventIn       time.Duration
+	eventAction   string
+	eventCode     string
+	eventDuration time.Duration
+)
+
+func init() {
+	imdsInjectCmd.Flags().DurationVar(&eventIn, "in", 2*time.Minute, "how long from now the event takes effect")
+	imdsInjectCmd.Flags().StringVar(&eventAction, "action", "terminate", "spot interruption action (terminate, stop, or hibernate)")
+	imdsInjectCmd.Flags().StringVar(&eventCode, "code", "system-reboot", "scheduled event code")
+	imdsInjectCmd.Flags().DurationVar(&eventDuration, "duration", 2*time.Hour, "length of the scheduled event's maintenance window")
+	imdsCmd.PersistentFlags().StringSliceVarP(&listenAddrs, "listen-address", "a", viper.GetStringSlice("server.address"), "IP address of the weep serve instance")
+	imdsCmd.PersistentFlags().IntVarP(&listenPort, "port", "p", viper.GetInt("server.port"), "port of the weep serve instance")
+	imdsCmd.AddCommand(imdsInjectCmd)
+	imdsCmd.AddCommand(imdsClearCmd)
+	rootCmd.AddCommand(imdsCmd)
+}
+
+var imdsCmd = &cobra.Command{
+	Use:   "imds",
+	Short: imdsShortHelp,
+	Long:  imdsLongHelp,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
+			return err
+		}
+		if err := viper.BindPFlag("server.address", cmd.Flags().Lookup("listen-address")); err != nil {
+			return err
+		}
+		return viper.BindPFlag("server.port", cmd.Flags().Lookup("port"))
+	},
+}
+
+var imdsInjectCmd = &cobra.Command{
+	Use:       "inject [spot-termination|scheduled-event|rebalance-recommendation]",
+	Short:     imdsInjectShortHelp,
+	Long:      imdsInjectLongHelp,
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: []string{server.SpotTerminationEvent, server.ScheduledEvent, server.RebalanceRecommendationEvent},
+	RunE:      runIMDSInject,
+}
+
+var imdsClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: imdsClearShortHelp,
+	Args:  cobra.NoArgs,
+	RunE:  runIMDSClear,
+}
+
+func runIMDSInject(cmd *cobra.Command, args []string) error {
+	body, err := json.Marshal(server.IMDSEventRequest{
+		Type:            args[0],
+		InSeconds:       int(eventIn.Seconds()),
+		Action:          eventAction,
+		Code:            eventCode,
+		DurationSeconds: int(eventDuration.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+	if err := sendIMDSEventRequest(http.MethodPost, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	cmd.Printf("injected %s event in %s\n", args[0], eventIn)
+	return nil
+}
+
+func runIMDSClear(cmd *cobra.Command, args []string) error {
+	if err := sendIMDSEventRequest(http.MethodDelete, nil); err != nil {
+		return err
+	}
+	cmd.Println("cleared IMDS events")
+	return nil
+}
+
+// sendIMDSEventRequest sends a request to the admin API of the weep serve instance
+// listening on the configured address and port
+func sendIMDSEventRequest(method string, body io.Reader) error {
+	req, err := http.NewRequest(method, serveURL("/weep/admin/imds/events"), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(server.AdminHeader, "1")
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach weep serve, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/netflix/weep/pkg/config"
+	"github.com/netflix/weep/pkg/httpAuth"
 	"github.com/netflix/weep/pkg/logging"
 
 	"github.com/netflix/weep/pkg/metadata"
@@ -53,6 +55,13 @@ func isInputFromPipe() bool {
 	return fileInfo.Mode()&os.ModeCharDevice == 0
 }
 
+// authenticationInfo describes the authentication methods in weep info output
+type authenticationInfo struct {
+	Configured []string `yaml:"configured"`
+	Active     string   `yaml:"active"`
+	Available  []string `yaml:"available"`
+}
+
 func PrintWeepInfo(w io.Writer) error {
 	var writer io.Writer
 	if infoRaw {
@@ -81,6 +90,13 @@ func PrintWeepInfo(w io.Writer) error {
 	_, _ = writer.Write([]byte("\nConfiguration\n"))
 	_, _ = writer.Write(marshalStruct(viper.AllSettings()))
 
+	_, _ = writer.Write([]byte("\nAuthentication\n"))
+	_, _ = writer.Write(marshalStruct(authenticationInfo{
+		Configured: config.AuthenticationMethods(),
+		Active:     httpAuth.ActiveMethod(),
+		Available:  httpAuth.Providers(),
+	}))
+
 	_, _ = writer.Write([]byte("\nHost Info\n"))
 	_, _ = writer.Write(marshalStruct(metadata.GetInstanceInfo()))
 
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth"
+	"github.com/netflix/weep/pkg/server"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	loginCmd.Flags().BoolVar(&loginServe, "serve", false, "ask the running weep serve instance to log in")
+	rootCmd.AddCommand(loginCmd)
+}
+
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: loginShortHelp,
+	Long:  loginLongHelp,
+	Args:  cobra.NoArgs,
+	RunE:  runLogin,
+}
+
+func runLogin(cmd *cobra.Command, args []string) error {
+	if loginServe {
+		if err := sendLoginRequest(); err != nil {
+			return err
+		}
+		cmd.Println("weep serve started a login, follow the prompts in your browser")
+		return nil
+	}
+	if err := httpAuth.Login(); err != nil {
+		return err
+	}
+	cmd.Println("logged in")
+	return nil
+}
+
+// sendLoginRequest asks the weep serve instance listening on the configured address and port
+// to log in
+func sendLoginRequest() error {
+	req, err := http.NewRequest(http.MethodPost, serveURL("/weep/admin/login"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(server.AdminHeader, "1")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach weep serve, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
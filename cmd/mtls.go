@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth/mtls"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	mtlsCmd.AddCommand(mtlsInfoCmd)
+	rootCmd.AddCommand(mtlsCmd)
+}
+
+var mtlsCmd = &cobra.Command{
+	Use:   "mtls",
+	Short: mtlsShortHelp,
+}
+
+var mtlsInfoCmd = &cobra.Command{
+	Use:          "info",
+	Short:        mtlsInfoShortHelp,
+	Long:         mtlsInfoLongHelp,
+	Args:         cobra.NoArgs,
+	RunE:         runMTLSInfo,
+	SilenceUsage: true,
+}
+
+func runMTLSInfo(cmd *cobra.Command, args []string) error {
+	infos, err := mtls.LoadCertificateInfo()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		printCertificateInfo(w, info)
+	}
+	return w.Flush()
+}
+
+// printCertificateInfo writes the details of a certificate to w
+func printCertificateInfo(w io.Writer, info *mtls.CertificateInfo) {
+	certFile := info.CertFile
+	if info.Preferred {
+		certFile += " (preferred)"
+	}
+	fmt.Fprintf(w, "Certificate:\t%s\n", certFile)
+	fmt.Fprintf(w, "Key:\t%s\n", info.KeyFile)
+	fmt.Fprintf(w, "Subject:\t%s\n", info.Subject)
+	if len(info.SANs) > 0 {
+		fmt.Fprintf(w, "SANs:\t%s\n", strings.Join(info.SANs, ", "))
+	}
+	fmt.Fprintf(w, "Issuer:\t%s\n", info.Issuer)
+	fmt.Fprintf(w, "Serial:\t%s\n", info.SerialNumber)
+	fmt.Fprintf(w, "SHA-256 Fingerprint:\t%s\n", info.FingerprintSHA256)
+	fmt.Fprintf(w, "Not Before:\t%s\n", info.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "Not After:\t%s\n", info.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "Validity:\t%s\n", certificateValidity(info))
+	if info.ReloadError != "" {
+		fmt.Fprintf(w, "Reload Error:\t%s\n", info.ReloadError)
+	}
+}
+
+// certificateValidity describes how long a certificate has been and will be valid
+func certificateValidity(info *mtls.CertificateInfo) string {
+	age := time.Duration(info.AgeSeconds) * time.Second
+	remaining := time.Duration(info.RemainingSeconds) * time.Second
+	switch {
+	case info.AgeSeconds < 0:
+		return fmt.Sprintf("not valid yet, valid in %s", formatDuration(-age))
+	case info.RemainingSeconds < 0:
+		return fmt.Sprintf("EXPIRED %s ago", formatDuration(-remaining))
+	}
+	return fmt.Sprintf("issued %s ago, expires in %s", formatDuration(age), formatDuration(remaining))
+}
+
+// formatDuration rounds d to the minute and drops the trailing zero seconds
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
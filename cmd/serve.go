@@ -17,6 +17,10 @@
 package cmd
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+
 	"github.com/netflix/weep/pkg/logging"
 	"github.com/netflix/weep/pkg/server"
 	"github.com/sirupsen/logrus"
@@ -26,11 +30,16 @@ import (
 )
 
 func init() {
-	serveCmd.PersistentFlags().StringVarP(&listenAddr, "listen-address", "a", viper.GetString("server.address"), "IP address for the ECS credential provider to listen on")
+	serveCmd.PersistentFlags().StringSliceVarP(&listenAddrs, "listen-address", "a", viper.GetStringSlice("server.address"), "IP addresses for the ECS credential provider to listen on")
+	serveCmd.PersistentFlags().StringVar(&bridgeInterface, "bridge-interface", viper.GetString("server.bridge_interface"), "network interface, like docker0, to also listen on so containers can reach weep")
+	serveCmd.Flags().BoolVar(&printEnv, "print-env", false, "print the environment variables to export for weep serve instead of starting it")
 	serveCmd.PersistentFlags().IntVarP(&listenPort, "port", "p", viper.GetInt("server.port"), "port for the ECS credential provider service to listen on")
 	if err := viper.BindPFlag("server.address", serveCmd.PersistentFlags().Lookup("listen-address")); err != nil {
 		logging.LogError(err, "Error parsing")
 	}
+	if err := viper.BindPFlag("server.bridge_interface", serveCmd.PersistentFlags().Lookup("bridge-interface")); err != nil {
+		logging.LogError(err, "Error parsing")
+	}
 	if err := viper.BindPFlag("server.port", serveCmd.PersistentFlags().Lookup("port")); err != nil {
 		logging.LogError(err, "Error parsing")
 	}
@@ -50,8 +59,39 @@ func runWeepServer(cmd *cobra.Command, args []string) error {
 	if len(args) > 0 {
 		role = args[0]
 	}
-	address := viper.GetString("server.address")
+	if printEnv {
+		return printServeEnv(role)
+	}
+	addresses := viper.GetStringSlice("server.address")
+	if name := viper.GetString("server.bridge_interface"); name != "" {
+		bridgeAddresses, err := server.InterfaceAddresses(name)
+		if err != nil {
+			logging.LogError(err, "Error getting bridge interface addresses")
+			return err
+		}
+		addresses = append(addresses, bridgeAddresses...)
+	}
 	port := viper.GetInt("server.port")
 	logging.Log.WithFields(logrus.Fields{"role": role}).Infoln("Running serve")
-	return server.Run(address, port, role, region, assumeRole, shutdown)
+	return server.Run(addresses, port, role, region, assumeRole, shutdown)
+}
+
+// printServeEnv prints export statements that point AWS SDKs and ECS-aware applications to weep serve
+func printServeEnv(role string) error {
+	fmt.Printf("export ECS_CONTAINER_METADATA_URI_V4=%s\n", serveURL(server.TaskMetadataPathPrefix+server.TaskMetadataContainerID()))
+	if role != "" {
+		fmt.Printf("export AWS_CONTAINER_CREDENTIALS_FULL_URI=%s\n", serveURL("/ecs/"+role))
+	}
+	return nil
+}
+
+// serveURL returns the URL for path on the local weep serve instance
+func serveURL(path string) string {
+	host := "127.0.0.1"
+	if addresses := viper.GetStringSlice("server.address"); len(addresses) > 0 {
+		if ip := net.ParseIP(addresses[0]); ip != nil && !ip.IsUnspecified() {
+			host = ip.String()
+		}
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, strconv.Itoa(viper.GetInt("server.port"))), path)
 }
@@ -48,7 +48,12 @@ weep setup | sudo sh
 weep setup > setup.sh
 cat setup.sh  # trust no one, always inspect
 chmod u+x setup.sh
-sudo ./setup.sh`
+sudo ./setup.sh
+
+The setup also routes the IPv6 endpoint (fd00:ec2::254) to ::1. To serve it, listen on both
+loopback addresses:
+
+weep serve --listen-address 127.0.0.1,::1`
 	embedPrefix           = "extras/macos"
 	pfRedirectionFilename = "/etc/pf.anchors/redirection"
 	pfConfFilename        = "/etc/pf.conf"
@@ -20,13 +20,18 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var setupShortHelp = "Print setup information"
 var setupLongHelp = ``
 
 func Setup(cmd *cobra.Command, commit bool) error {
+	port := viper.GetInt("server.port")
 	fmt.Print("Please run the following commands to setup routing for the meta-data service:\n\n")
-	fmt.Print("sudo iptables -t nat -A OUTPUT -p tcp --dport 80 -d 169.254.169.254 -j DNAT --to 127.0.0.1:9091")
+	fmt.Printf("sudo iptables -t nat -A OUTPUT -p tcp --dport 80 -d 169.254.169.254 -j DNAT --to 127.0.0.1:%d\n", port)
+	fmt.Print("\nTo also serve the IPv6 endpoint, run weep serve with --listen-address 127.0.0.1,::1 and run:\n\n")
+	fmt.Print("sudo ip -6 addr add fd00:ec2::254/128 dev lo\n")
+	fmt.Printf("sudo ip6tables -t nat -A OUTPUT -p tcp --dport 80 -d fd00:ec2::254 -j DNAT --to [::1]:%d\n", port)
 	return nil
 }
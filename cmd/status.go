@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/netflix/weep/pkg/config"
+	"github.com/netflix/weep/pkg/httpAuth/challenge"
+	"github.com/netflix/weep/pkg/httpAuth/mtls"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+var statusCmd = &cobra.Command{
+	Use:          "status",
+	Short:        statusShortHelp,
+	Long:         statusLongHelp,
+	Args:         cobra.NoArgs,
+	RunE:         runStatus,
+	SilenceUsage: true,
+}
+
+// serveHealth is the part of the weep serve healthcheck response shown by weep status
+type serveHealth struct {
+	Status   int    `json:"status"`
+	Message  string `json:"message"`
+	Degraded bool   `json:"degraded"`
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	methods := config.AuthenticationMethods()
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "Authentication:\t%s\n", strings.Join(methods, ", "))
+	for _, method := range methods {
+		switch method {
+		case "mtls":
+			if infos, err := mtls.LoadCertificateInfo(); err != nil {
+				fmt.Fprintf(w, "mTLS Certificate:\terror: %v\n", err)
+			} else {
+				for _, info := range infos {
+					fmt.Fprintf(w, "mTLS Certificate:\t%s\n", info.CertFile)
+					fmt.Fprintf(w, "Certificate Validity:\t%s\n", certificateValidity(info))
+				}
+			}
+		case "challenge":
+			if exp, err := challenge.Expiration(); err != nil {
+				fmt.Fprintf(w, "ConsoleMe JWT:\t%v\n", err)
+			} else if remaining := time.Until(exp); remaining < 0 {
+				fmt.Fprintf(w, "ConsoleMe JWT:\tEXPIRED %s ago, run `weep login`\n", formatDuration(-remaining))
+			} else {
+				fmt.Fprintf(w, "ConsoleMe JWT:\texpires in %s\n", formatDuration(remaining))
+			}
+		}
+	}
+	fmt.Fprintf(w, "weep serve:\t%s\n", serveStatus())
+	return w.Flush()
+}
+
+// serveStatus describes the health of the weep serve instance on the configured address and port
+func serveStatus() string {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(serveURL("/healthcheck"))
+	if err != nil {
+		return "not running"
+	}
+	defer resp.Body.Close()
+	var h serveHealth
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return fmt.Sprintf("unexpected response: %v", err)
+	}
+	switch {
+	case h.Status != http.StatusOK:
+		return "unhealthy: " + h.Message
+	case h.Degraded:
+		return "degraded: " + h.Message
+	}
+	return "healthy"
+}
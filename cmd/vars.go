@@ -22,6 +22,7 @@ var (
 	accountFilter              string
 	assumeRole                 []string
 	autoRefresh                bool
+	bridgeInterface            string
 	cfgFile                    string
 	destination                string
 	destinationConfig          string
@@ -32,15 +33,17 @@ var (
 	generate                   bool
 	infoDecode                 bool
 	infoRaw                    bool
-	listenAddr                 string
+	listenAddrs                []string
 	listenPort                 int
 	logFile                    string
 	logFormat                  string
 	logLevel                   string
+	loginServe                 bool
 	noIpRestrict               bool
 	noOpen                     bool
 	profileName                string
 	prettyPrint                bool
+	printEnv                   bool
 	region                     string
 	roleRefreshARN             string
 	shellInfo                  string
@@ -76,6 +79,18 @@ More information: https://hawkins.gitbook.io/consoleme/weep-cli/commands/credent
 var docsShortHelp = "Generate Markdown docs for CLI commands"
 var docsLongHelp = ``
 
+var execShortHelp = "Run a command with automatically refreshing credentials"
+var execLongHelp = `The exec command runs a command with credentials for a role, without writing them to a
+file or exporting them into your shell. Weep starts a credential endpoint on a random loopback port
+and points the command at it with AWS_CONTAINER_CREDENTIALS_FULL_URI and
+AWS_CONTAINER_AUTHORIZATION_TOKEN, so credentials are refreshed for as long as the command runs:
+
+weep exec SuperCoolRole -- aws s3 ls
+
+Static credentials and profile variables (AWS_ACCESS_KEY_ID, AWS_PROFILE, etc.) are removed from the
+command's environment so AWS SDKs use the endpoint. Weep exits with the command's exit code.
+`
+
 var exportShortHelp = "Retrieve credentials to be exported as environment variables"
 var exportLongHelp = `The export command retrieves credentials for a role and prints a shell command to export 
 the credentials to environment variables.
@@ -91,6 +106,27 @@ every hour to get new credentials.
 More information: https://hawkins.gitbook.io/consoleme/weep-cli/commands/credential-file
 `
 
+var imdsShortHelp = "Inject events into the metadata service emulated by weep serve"
+var imdsLongHelp = `The imds commands change the instance metadata service emulated by a running
+'weep serve', so you can test how your application handles spot interruptions, scheduled
+maintenance, and rebalance recommendations. Use --listen-address and --port if weep serve
+isn't listening on the configured address and port.
+`
+
+var imdsInjectShortHelp = "Inject a spot interruption or maintenance event into the metadata service"
+var imdsInjectLongHelp = `The inject command adds an event to the metadata service emulated by a running
+'weep serve', so you can test how your application handles spot interruptions,
+scheduled maintenance, and rebalance recommendations. Until an event is injected, the
+corresponding routes return 404, just like a real instance.
+
+weep imds inject spot-termination --in 2m
+weep imds inject scheduled-event --code instance-retirement --in 1h
+weep imds inject rebalance-recommendation
+weep imds clear
+`
+
+var imdsClearShortHelp = "Remove all injected metadata service events"
+
 var infoShortHelp = "Print info for support and troubleshooting"
 var infoLongHelp = `The info command prints a compressed and base64-encoded dump of Weep's configuration,
 available roles according to ConsoleMe, and basic system information. The raw output can be viewed by
@@ -115,6 +151,23 @@ roles.
 More information: https://hawkins.gitbook.io/consoleme/weep-cli/commands/list-eligible-roles
 `
 
+var loginShortHelp = "Authenticate to ConsoleMe again"
+var loginLongHelp = `The login command authenticates with the configured authentication method and stores
+the new credentials, even if the current ones haven't expired yet. Running weep serve and
+weep file --refresh processes pick up the new credentials without a restart.
+
+With --serve, the running weep serve instance is asked to log in instead, which is useful
+when it runs as a service with a different home directory.
+`
+
+var mtlsShortHelp = "Inspect the mTLS client certificate"
+var mtlsInfoShortHelp = "Print details about the mTLS client certificates"
+var mtlsInfoLongHelp = `The info command finds the mTLS client certificates and keys the same way weep does when it
+connects to ConsoleMe, and prints each certificate's subject, SANs, issuer, fingerprint, and
+validity period. When more than one certificate is configured, weep presents the one issued by
+a CA the server accepts, and the preferred certificate is the one that expires last.
+`
+
 var searchShortHelp = "Search for resources through ConsoleMe"
 var searchLongHelp = `The search command allows users to search for resources via ConsoleMe. Currently, only
 searching for accounts or roles is supported.
@@ -135,6 +188,23 @@ If you just want to use a single role, use the 'role' positional argument to spe
 will be served the same way credentials are served in an EC2 instance. There’s no need
 to set an environment variable for this.
 
+Containers on a bridge network can each get their own role: map their source IP or CIDR to a
+role with server.source_roles in the config file and use --bridge-interface to listen on the
+bridge. Mapped sources get their role over IMDS and from /ecs/ without naming it.
+
+The ECS task metadata v4 endpoint is served for applications that read
+ECS_CONTAINER_METADATA_URI_V4, using the account of the role being served. Run
+'weep serve --print-env' to print the variables to export.
+
+With server.signing_proxy.enabled set, weep also runs an HTTP forward proxy that signs
+requests with SigV4 for tools that can't sign AWS requests themselves, for example:
+
+curl -x http://127.0.0.1:9092 'http://sts.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15'
+
+Weep also emulates the EKS Pod Identity agent at /v1/credentials for workloads running in
+local Kubernetes clusters. Each service account token a pod presents in the Authorization
+header is mapped to a role with server.pod_identity.associations in the config file.
+
 More information: https://hawkins.gitbook.io/consoleme/weep-cli/commands/credential-provider
 `
 
@@ -144,6 +214,13 @@ The service command lets you install Weep as a service on a Linux, macOS, or Win
 system.
 `
 
+var statusShortHelp = "Print the state of weep's authentication to ConsoleMe"
+var statusLongHelp = `The status command prints the configured authentication method and how long its
+credentials remain valid: the mTLS certificate's age and remaining validity, or the expiry of
+the ConsoleMe JWT. It also reports the health of a weep serve instance running on the
+configured address and port.
+`
+
 var versionShortHelp = "Print version information"
 var versionLongHelp = ``
 
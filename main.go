@@ -18,6 +18,7 @@ package main
 
 import (
 	"embed"
+	"errors"
 	"os"
 
 	"github.com/netflix/weep/pkg/config"
@@ -39,6 +40,10 @@ func init() {
 func main() {
 	err := cmd.Execute()
 	if err != nil {
+		var exitErr *cmd.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		// err printing is handled by cobra
 		os.Exit(1)
 	}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/peer"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu       sync.RWMutex
+	auditLog *logrus.Logger
+)
+
+// Configure opens filename for appending and enables audit logging. Audit records are
+// written as one JSON object per line, separate from the regular weep log.
+func Configure(filename string) error {
+	if filename == "" {
+		return errors.New("audit log file not configured")
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return errors.Wrap(err, "could not create audit log directory")
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s for audit logging", filename)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	auditLog = &logrus.Logger{
+		Out:       file,
+		Formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339},
+		Level:     logrus.InfoLevel,
+	}
+	logging.Log.Infof("writing audit log to %s", filename)
+	return nil
+}
+
+// Enabled returns true if an audit log has been configured
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return auditLog != nil
+}
+
+// Record is a single entry in the audit log
+type Record struct {
+	Event       string
+	Source      string
+	Path        string
+	RemoteAddr  string
+	UserAgent   string
+	Role        string
+	RoleArn     string
+	AssumeChain []string
+	Expiration  time.Time
+	Process     *peer.Process
+	Reason      string
+}
+
+// Write adds a record to the audit log. It's a no-op when audit logging is disabled.
+func Write(record Record) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if auditLog == nil {
+		return
+	}
+
+	fields := logrus.Fields{
+		"source":      record.Source,
+		"path":        record.Path,
+		"remote_addr": record.RemoteAddr,
+		"user_agent":  record.UserAgent,
+	}
+	if record.Role != "" {
+		fields["role"] = record.Role
+		fields["role_arn"] = record.RoleArn
+		fields["assume_chain"] = record.AssumeChain
+	}
+	if !record.Expiration.IsZero() {
+		fields["expiration"] = record.Expiration.UTC().Format(time.RFC3339)
+	}
+	if record.Process != nil {
+		fields["pid"] = record.Process.PID
+		fields["uid"] = record.Process.UID
+		fields["executable"] = record.Process.Executable
+	}
+	if record.Reason != "" {
+		fields["reason"] = record.Reason
+	}
+	auditLog.WithFields(fields).Info(record.Event)
+}
+
+// CredentialsIssued records that credentials from rp were returned in response to r.
+// source identifies the endpoint that served them, e.g. imds or ecs.
+func CredentialsIssued(r *http.Request, source string, rp *creds.RefreshableProvider) {
+	if !Enabled() {
+		return
+	}
+	record := newRecord(r, source, "credentials_issued")
+	record.Role = rp.RoleName
+	record.RoleArn = rp.RoleArn
+	record.AssumeChain = rp.AssumeChain
+	record.Expiration = rp.Expiration.Time()
+	Write(record)
+}
+
+// RequestDenied records that r was refused credentials for roles, the requested role followed by
+// its assume chain, along with the reason. The role can be an ARN or a bare role name.
+func RequestDenied(r *http.Request, source string, roles []string, reason string) {
+	if !Enabled() {
+		return
+	}
+	record := newRecord(r, source, "request_denied")
+	if len(roles) > 0 {
+		record.Role = roles[0]
+		if strings.HasPrefix(roles[0], "arn:") {
+			record.RoleArn = roles[0]
+			record.Role = roles[0][strings.LastIndex(roles[0], "/")+1:]
+		}
+		record.AssumeChain = roles[1:]
+	}
+	record.Reason = reason
+	Write(record)
+}
+
+func newRecord(r *http.Request, source, event string) Record {
+	record := Record{
+		Event:      event,
+		Source:     source,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.Header.Get("User-Agent"),
+	}
+	if p, err := peer.FromRequest(r); err == nil {
+		record.Process = p
+	} else {
+		logging.Log.WithError(err).Debug("could not identify requesting process")
+	}
+	return record
+}
@@ -21,6 +21,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/netflix/weep/pkg/logging"
 
@@ -33,22 +34,57 @@ import (
 func init() {
 	// Set default configuration values here
 	viper.SetTypeByDefaultValue(true)
-	viper.SetDefault("authentication_method", "challenge")
+	viper.SetDefault("authentication_method", []string{"challenge"})
+	viper.SetDefault("audit.enabled", false)
+	viper.SetDefault("audit.log_file", getDefaultAuditLogFile())
 	viper.SetDefault("aws.region", "us-east-1")
+	viper.SetDefault("challenge_settings.auto_renew", false)
+	viper.SetDefault("challenge_settings.expiry_warning", 3600)
+	viper.SetDefault("challenge_settings.jwks_cache_ttl", 86400)
+	viper.SetDefault("challenge_settings.leeway", 60)
+	viper.SetDefault("challenge_settings.lock_timeout", 150)
+	viper.SetDefault("challenge_settings.poll_interval", 3)
+	viper.SetDefault("challenge_settings.poll_timeout", 120)
+	viper.SetDefault("challenge_settings.user_claim", "email")
+	viper.SetDefault("challenge_settings.verify_signature", false)
+	viper.SetDefault("credential_store.type", "encrypted")
+	viper.SetDefault("credential_store.key_source", "machine")
 	viper.SetDefault("feature_flags.consoleme_metadata", false)
+	viper.SetDefault("http_settings.http2", true)
+	viper.SetDefault("http_settings.idle_conn_timeout", 90)
+	viper.SetDefault("http_settings.max_idle_conns", 100)
 	viper.SetDefault("log_file", getDefaultLogFile())
+	viper.SetDefault("mtls_settings.expiry_warning", 21600)
 	viper.SetDefault("mtls_settings.old_cert_message", "mTLS certificate is too old, please refresh mtls certificate")
+	viper.SetDefault("mtls_settings.poll_interval", 60)
 	viper.SetDefault("server.enforce_imdsv2", false)
 	viper.SetDefault("server.http_timeout", 20)
 	viper.SetDefault("server.address", "127.0.0.1")
 	viper.SetDefault("server.port", 9091)
+	viper.SetDefault("server.signing_proxy.enabled", false)
+	viper.SetDefault("server.signing_proxy.address", "127.0.0.1")
+	viper.SetDefault("server.signing_proxy.port", 9092)
+	viper.SetDefault("server.signing_proxy.allowed_hosts", []string{"*.amazonaws.com"})
+	viper.SetDefault("server.signing_proxy.upstream_scheme", "https")
+	viper.SetDefault("server.signing_proxy.max_buffered_body", 10*1024*1024)
+	viper.SetDefault("server.task_metadata.cluster", "weep")
+	viper.SetDefault("server.task_metadata.family", "weep")
+	viper.SetDefault("server.task_metadata.revision", "1")
+	viper.SetDefault("server.task_metadata.container_name", "app")
+	viper.SetDefault("server.task_metadata.cpu", 256)
+	viper.SetDefault("server.task_metadata.memory", 512)
 	viper.SetDefault("service.command", "serve")
 	viper.SetDefault("service.run", []string{"service", "run"})
 	viper.SetDefault("service.args", []string{})
 	viper.SetDefault("service.flags", []string{})
+	viper.SetDefault("sigv4_settings.service", "execute-api")
 	viper.SetDefault("swag.enable", false)
 	viper.SetDefault("swag.use_mtls", false)
 	viper.SetDefault("swag.url", "")
+	viper.SetDefault("token_settings.env", "WEEP_CONSOLEME_TOKEN")
+	viper.SetDefault("token_settings.header", "Authorization")
+	viper.SetDefault("token_settings.refresh_interval", 300)
+	viper.SetDefault("token_settings.scheme", "Bearer")
 
 	// Set aliases for backward-compatibility
 	viper.RegisterAlias("server.ecs_credential_provider_port", "server.port")
@@ -68,6 +104,14 @@ func getDefaultLogFile() string {
 	}
 }
 
+func getDefaultAuditLogFile() string {
+	logFile := getDefaultLogFile()
+	if logFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(logFile), "weep-audit.log")
+}
+
 // initConfig reads in configs by precedence, with later configs overriding earlier:
 //   - embedded
 //   - /etc/weep/weep.yaml
@@ -159,8 +203,29 @@ func SetUser(user string) error {
 }
 
 func MtlsEnabled() bool {
-	authMethod := viper.GetString("authentication_method")
-	return authMethod == "mtls" && viper.GetBool("mtls_settings.enabled")
+	if !viper.GetBool("mtls_settings.enabled") {
+		return false
+	}
+	for _, method := range AuthenticationMethods() {
+		if method == "mtls" {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticationMethods returns the configured authentication methods in the order they should be
+// tried. authentication_method can be a single method, a comma-separated string, or a list.
+func AuthenticationMethods() []string {
+	var methods []string
+	for _, value := range viper.GetStringSlice("authentication_method") {
+		for _, method := range strings.Split(value, ",") {
+			if method = strings.TrimSpace(method); method != "" {
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
 }
 
 // BaseWebURL allows the ConsoleMe URL to be overridden for cases where the API
@@ -218,5 +283,5 @@ type WeepConfig struct {
 	ConsoleMeUrl         string            `mapstructure:"consoleme_url"`
 	MtlsSettings         MtlsSettings      `mapstructure:"mtls_settings"`
 	ChallengeSettings    ChallengeSettings `mapstructure:"challenge_settings"`
-	AuthenticationMethod string            `mapstructure:"authentication_method"`
+	AuthenticationMethod []string          `mapstructure:"authentication_method"`
 }
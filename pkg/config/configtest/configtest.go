@@ -0,0 +1,43 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package configtest changes weep's configuration for the length of a test.
+package configtest
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Set sets each configuration key in settings, and restores the values the keys had before when
+// the test finishes
+func Set(t *testing.T, settings map[string]interface{}) {
+	t.Helper()
+	previous := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if viper.IsSet(key) {
+			previous[key] = viper.Get(key)
+		}
+		viper.Set(key, value)
+	}
+	t.Cleanup(func() {
+		for key := range settings {
+			// A nil override falls back to the key's default
+			viper.Set(key, previous[key])
+		}
+	})
+}
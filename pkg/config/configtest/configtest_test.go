@@ -0,0 +1,39 @@
+package configtest
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSetRestoresPreviousValues(t *testing.T) {
+	viper.SetDefault("configtest.defaulted", "default")
+	viper.Set("configtest.overridden", "outer")
+	defer viper.Set("configtest.overridden", nil)
+
+	t.Run("inner", func(t *testing.T) {
+		Set(t, map[string]interface{}{
+			"configtest.defaulted":  "inner",
+			"configtest.overridden": "inner",
+			"configtest.unset":      "inner",
+		})
+		Set(t, map[string]interface{}{"configtest.overridden": "innermost"})
+		if got := viper.GetString("configtest.overridden"); got != "innermost" {
+			t.Errorf("got %q, expected the latest value", got)
+		}
+	})
+
+	cases := []struct {
+		Key      string
+		Expected string
+	}{
+		{Key: "configtest.defaulted", Expected: "default"},
+		{Key: "configtest.overridden", Expected: "outer"},
+		{Key: "configtest.unset", Expected: ""},
+	}
+	for _, tc := range cases {
+		if got := viper.GetString(tc.Key); got != tc.Expected {
+			t.Errorf("%s: got %q after the test, expected %q", tc.Key, got, tc.Expected)
+		}
+	}
+}
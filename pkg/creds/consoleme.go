@@ -22,24 +22,19 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
-	"runtime"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/netflix/weep/pkg/httpAuth"
-	"github.com/netflix/weep/pkg/httpAuth/custom"
 
 	"github.com/netflix/weep/pkg/util"
 
 	"github.com/netflix/weep/pkg/aws"
 	"github.com/netflix/weep/pkg/config"
 	werrors "github.com/netflix/weep/pkg/errors"
-	"github.com/netflix/weep/pkg/httpAuth/challenge"
-	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/httpAuth/transport"
 	"github.com/netflix/weep/pkg/metadata"
 
 	"github.com/spf13/viper"
@@ -85,7 +80,10 @@ func NewClient(hostname string, region string, httpc *http.Client) (*Client, err
 	}
 
 	if httpc == nil {
-		httpc = &http.Client{Transport: defaultTransport()}
+		var err error
+		if httpc, err = transport.NewClient(); err != nil {
+			return nil, err
+		}
 	}
 
 	c := &Client{
@@ -105,7 +103,7 @@ func (c *Client) buildRequest(method string, resource string, body io.Reader, ap
 	}
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Add("Content-Type", "application/json")
-	err = custom.RunPreflightFunctions(req)
+	err = httpAuth.RunPreflight(req)
 	if err != nil {
 		return nil, err
 	}
@@ -277,6 +275,10 @@ func parseWebError(rawErrorResponse []byte) error {
 }
 
 func parseError(statusCode int, rawErrorResponse []byte) error {
+	if err := httpAuth.ClassifyError(statusCode, rawErrorResponse); err != nil {
+		return err
+	}
+
 	var errorResponse ConsolemeCredentialErrorMessageType
 	if err := json.Unmarshal(rawErrorResponse, &errorResponse); err != nil {
 		return errors.Wrap(err, "failed to unmarshal JSON")
@@ -298,11 +300,7 @@ func parseError(statusCode int, rawErrorResponse []byte) error {
 	case "905":
 		return werrors.MutualTLSCertNeedsRefreshError
 	case "invalid_jwt":
-		logging.Log.Errorf("Authentication is invalid or has expired. Please restart weep to re-authenticate.")
-		err := challenge.DeleteLocalWeepCredentials()
-		if err != nil {
-			logging.Log.Errorf("failed to delete credentials: %v", err)
-		}
+		// The active method's ClassifyError clears its own credentials
 		return werrors.InvalidJWT
 	default:
 		return fmt.Errorf("unexpected HTTP status %d, want 200. Response: %s", statusCode, string(rawErrorResponse))
@@ -425,22 +423,6 @@ func getRoleCredentialsFunc(c HTTPClient, role string, ipRestrict bool) (*aws.Cr
 	return credentialsResponse.Credentials, nil
 }
 
-func defaultTransport() *http.Transport {
-	timeout := time.Duration(viper.GetInt("server.http_timeout")) * time.Second
-	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		MaxIdleConnsPerHost:   runtime.GOMAXPROCS(0) + 1,
-	}
-}
-
 type ClientMock struct {
 	DoFunc                 func(req *http.Request) (*http.Response, error)
 	GetRoleCredentialsFunc func(role string, ipRestrict bool) (*aws.Credentials, error)
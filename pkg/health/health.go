@@ -1,6 +1,10 @@
 package health
 
-import "sync"
+import (
+	"sort"
+	"strings"
+	"sync"
+)
 
 var WeepStatus status
 
@@ -8,6 +12,8 @@ type status struct {
 	sync.RWMutex
 	healthy bool
 	reason  string
+	// degraded holds the reason for each component that still works but needs attention soon
+	degraded map[string]string
 }
 
 func init() {
@@ -20,9 +26,49 @@ func init() {
 func (s *status) Get() (bool, string) {
 	s.RLock()
 	defer s.RUnlock()
+	if s.healthy && len(s.degraded) > 0 {
+		return true, s.degradedReason()
+	}
 	return s.healthy, s.reason
 }
 
+// Degraded returns whether any component is degraded and why
+func (s *status) Degraded() (bool, string) {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.degraded) > 0, s.degradedReason()
+}
+
+// SetDegraded marks component as degraded. Weep stays healthy, but the reason is reported until
+// ClearDegraded is called for the component.
+func (s *status) SetDegraded(component, reason string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.degraded == nil {
+		s.degraded = make(map[string]string)
+	}
+	s.degraded[component] = reason
+}
+
+func (s *status) ClearDegraded(component string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.degraded, component)
+}
+
+func (s *status) degradedReason() string {
+	components := make([]string, 0, len(s.degraded))
+	for component := range s.degraded {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	reasons := make([]string, 0, len(components))
+	for _, component := range components {
+		reasons = append(reasons, s.degraded[component])
+	}
+	return strings.Join(reasons, "; ")
+}
+
 func (s *status) SetUnhealthy(reason string) {
 	s.Lock()
 	defer s.Unlock()
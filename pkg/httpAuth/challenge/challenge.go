@@ -27,69 +27,99 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/netflix/weep/pkg/logging"
 
 	"github.com/netflix/weep/pkg/config"
+	werrors "github.com/netflix/weep/pkg/errors"
+	"github.com/netflix/weep/pkg/httpAuth/store"
+	"github.com/netflix/weep/pkg/httpAuth/transport"
 	"github.com/netflix/weep/pkg/util"
 
-	"github.com/mitchellh/go-homedir"
-
 	"github.com/manifoldco/promptui"
 
 	"github.com/spf13/viper"
 )
 
-func NewHTTPClient(consolemeUrl string) (*http.Client, error) {
-	existingChallengeBody, err := getChallenge()
-	if err != nil {
-		logging.Log.Debugf("unable to read existing challenge file: %v", err)
+// credentialsName is the name of the ConsoleMe challenge response in the credential store
+const credentialsName = "credentials"
 
+func NewHTTPClient(consolemeUrl string) (*http.Client, error) {
+	if !HasValidJwt(currentChallenge()) {
+		return nil, errors.New("Your authentication to ConsoleMe has expired. Please run `weep login`.")
 	}
-	if !HasValidJwt(existingChallengeBody) {
-		return nil, errors.New("Your authentication to ConsoleMe has expired. Please restart weep.")
-	}
-	var challenge ConsolemeChallengeResponse
 	jar, err := cookiejar.New(&cookiejar.Options{})
 	if err != nil {
 		return nil, err
 	}
-	credentialsPath, err := getCredentialsPath()
-	if err != nil {
-		return nil, err
-	}
-	challengeBody, err := ioutil.ReadFile(credentialsPath)
+	consoleMeUrlParsed, err := url.Parse(consolemeUrl)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(challengeBody, &challenge)
+	client, err := transport.NewClient()
 	if err != nil {
 		return nil, err
 	}
-	cookies := []*http.Cookie{{
-		Name:     challenge.CookieName,
-		Value:    challenge.EncodedJwt,
-		Secure:   challenge.WantSecure,
-		HttpOnly: challenge.WantHttpOnly,
-		SameSite: http.SameSite(challenge.SameSite),
-		Expires:  time.Unix(challenge.Expires, 0).Round(0),
-	},
+	client.Jar = &challengeJar{CookieJar: jar, consolemeUrl: consoleMeUrlParsed}
+
+	return client, nil
+}
+
+// challengeJar adds the current ConsoleMe JWT to requests to ConsoleMe, so clients created before
+// a new login use the new JWT
+type challengeJar struct {
+	http.CookieJar
+	consolemeUrl *url.URL
+}
+
+func (j *challengeJar) Cookies(u *url.URL) []*http.Cookie {
+	cookies := j.CookieJar.Cookies(u)
+	challenge := currentChallenge()
+	if challenge == nil || u.Host != j.consolemeUrl.Host || (challenge.WantSecure && u.Scheme != "https") {
+		return cookies
+	}
+	result := []*http.Cookie{{Name: challenge.CookieName, Value: challenge.EncodedJwt}}
+	for _, c := range cookies {
+		if c.Name != challenge.CookieName {
+			result = append(result, c)
+		}
 	}
-	consoleMeUrlParsed, err := url.Parse(consolemeUrl)
+	return result
+}
+
+var (
+	currentLock sync.Mutex
+	// current is the JWT in use, so it doesn't have to be read from the credential store for
+	// every request
+	current *ConsolemeChallengeResponse
+)
+
+// currentChallenge returns the JWT in use. When it's missing or no longer valid, the stored JWT is
+// read again, since another weep process may have logged in.
+func currentChallenge() *ConsolemeChallengeResponse {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	if current != nil && HasValidJwt(current) {
+		return current
+	}
+	challenge, err := getChallenge()
 	if err != nil {
-		return nil, err
-	}
-	jar.SetCookies(consoleMeUrlParsed, cookies)
-	client := &http.Client{
-		Jar: jar,
+		logging.Log.Debugf("unable to read existing challenge file: %v", err)
+		return current
 	}
+	current = challenge
+	return current
+}
 
-	return client, err
+func setCurrentChallenge(challenge *ConsolemeChallengeResponse) {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	current = challenge
 }
 
 func isWSL() bool {
@@ -104,8 +134,9 @@ func isWSL() bool {
 }
 
 func poll(pollingUrl string) (*ConsolemeChallengeResponse, error) {
-	timeout := time.After(2 * time.Minute)
-	tick := time.Tick(3 * time.Second)
+	pollTimeout := time.Duration(viper.GetInt("challenge_settings.poll_timeout")) * time.Second
+	timeout := time.After(pollTimeout)
+	tick := time.Tick(time.Duration(viper.GetInt("challenge_settings.poll_interval")) * time.Second)
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	req, err := http.NewRequest("GET", pollingUrl, nil)
@@ -113,12 +144,15 @@ func poll(pollingUrl string) (*ConsolemeChallengeResponse, error) {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client, err := transport.NewClient()
+	if err != nil {
+		return nil, err
+	}
 	// Keep trying until we're timed out or got a result or got an error
 	for {
 		select {
 		case <-timeout:
-			return nil, errors.New("*** Unable to validate Challenge Response after 2 minutes. Quitting. ***")
+			return nil, fmt.Errorf("*** Unable to validate Challenge Response after %s. Quitting. ***", pollTimeout)
 		case <-tick:
 			pollResponse, err := pollRequest(client, req)
 			if err != nil {
@@ -146,29 +180,13 @@ func pollRequest(c *http.Client, r *http.Request) (*ConsolemeChallengeResponse,
 	return &pollResponse, err
 }
 
-func getCredentialsPath() (string, error) {
-	home, err := homedir.Dir()
-	if err != nil {
-		return "", err
-	}
-	weepDir := path.Join(home, ".weep")
-	// Setup the directories where we will be writing credentials
-	if _, err := os.Stat(weepDir); os.IsNotExist(err) {
-		_ = os.Mkdir(weepDir, 0700)
-	} else {
-		_ = os.Chmod(weepDir, 0700)
-	}
-	credentialsPath := path.Join(weepDir, "credentials")
-	return credentialsPath, nil
-}
-
 func getChallenge() (*ConsolemeChallengeResponse, error) {
 	var challenge ConsolemeChallengeResponse
-	credentialPath, err := getCredentialsPath()
+	credentialStore, err := store.New()
 	if err != nil {
 		return nil, err
 	}
-	challengeBody, err := ioutil.ReadFile(credentialPath)
+	challengeBody, err := credentialStore.Get(credentialsName)
 	if err != nil {
 		return nil, err
 	}
@@ -196,21 +214,31 @@ func promptUser() (string, error) {
 	return result, nil
 }
 
+// HasValidJwt decodes the JWT in challenge and checks its claims, and its signature if
+// challenge_settings.verify_signature is set
 func HasValidJwt(challenge *ConsolemeChallengeResponse) bool {
 	if challenge == nil {
 		return false
 	}
-	now := time.Now()
-	expires := time.Unix(challenge.Expires, 0).Round(0)
-	if now.After(expires) {
+	if _, err := newJWTVerifier().verify(challenge.EncodedJwt, true); err != nil {
+		logging.Log.Debugf("stored ConsoleMe JWT is not valid: %v", err)
 		return false
 	}
 	return true
 }
 
+// jwtUser returns the username from the claims of a JWT that may have expired
+func jwtUser(challenge *ConsolemeChallengeResponse) string {
+	claims, err := newJWTVerifier().verify(challenge.EncodedJwt, false)
+	if err != nil {
+		logging.Log.Debugf("could not get username from stored ConsoleMe JWT: %v", err)
+		return ""
+	}
+	return claims.String(viper.GetString("challenge_settings.user_claim"))
+}
+
 func RefreshChallenge() error {
 	existingChallengeBody, err := getChallenge()
-	var userName = viper.GetString("challenge_settings.user")
 	if err != nil {
 		logging.Log.Debugf("unable to read existing challenge file: %v", err)
 
@@ -219,11 +247,47 @@ func RefreshChallenge() error {
 	if HasValidJwt(existingChallengeBody) {
 		return nil
 	}
+	// Only one process logs in at a time. The others wait, then use the JWT it stored.
+	unlock, err := lockChallenge()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if existingChallengeBody, err = getChallenge(); err == nil && HasValidJwt(existingChallengeBody) {
+		setCurrentChallenge(existingChallengeBody)
+		return nil
+	}
+	return login(existingChallengeBody)
+}
+
+// Login runs the challenge flow and stores the new JWT, even if the current one is still valid
+func Login() error {
+	unlock, err := lockChallenge()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	existingChallengeBody, err := getChallenge()
+	if err != nil {
+		logging.Log.Debugf("unable to read existing challenge file: %v", err)
+	}
+	return login(existingChallengeBody)
+}
+
+func lockChallenge() (func(), error) {
+	return store.Lock(credentialsName, time.Duration(viper.GetInt("challenge_settings.lock_timeout"))*time.Second)
+}
+
+// login runs the challenge flow, using the username from the configuration or from the claims of
+// the previous JWT when one is available
+func login(existingChallengeBody *ConsolemeChallengeResponse) error {
+	var err error
+	var userName = viper.GetString("challenge_settings.user")
 	// Step 1: Make unauthed request to ConsoleMe challenge endpoint and get a challenge challenge
 	// Check Config for username
 	if userName == "" && existingChallengeBody != nil {
 		// Find user from old jwt
-		userName = existingChallengeBody.User
+		userName = jwtUser(existingChallengeBody)
 	}
 	if userName == "" {
 		userName, err = promptUser()
@@ -245,7 +309,10 @@ func RefreshChallenge() error {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client, err := transport.NewClient()
+	if err != nil {
+		return err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -297,7 +364,7 @@ func RefreshChallenge() error {
 		logging.Log.Infoln("Please open the above URL in a browser and authenticate.")
 	}
 
-	// Step 3: Continue polling backend to see if request has been authenticated yet. Poll every 3 seconds for 2 minutes
+	// Step 3: Continue polling backend to see if request has been authenticated yet
 	pollResponse, err := poll(challenge.PollingUrl)
 	if err != nil {
 		return err
@@ -308,33 +375,38 @@ func RefreshChallenge() error {
 		return err
 	}
 
-	credentialsPath, err := getCredentialsPath()
+	credentialStore, err := store.New()
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(credentialsPath, jsonPollResponse, 0600)
-	if err != nil {
+	if err := credentialStore.Put(credentialsName, jsonPollResponse); err != nil {
 		return err
 	}
+	setCurrentChallenge(pollResponse)
 	return nil
 }
 
 func DeleteLocalWeepCredentials() error {
-	credentialsPath, err := getCredentialsPath()
+	setCurrentChallenge(nil)
+	credentialStore, err := store.New()
 	if err != nil {
 		return err
 	}
-	_, err = os.Stat(credentialsPath)
-	if err != nil {
-		// Return error unless it is because the file doesn't exist
-		if !os.IsNotExist(err) {
-			return err
-		}
-	} else {
-		err = os.Remove(credentialsPath)
-		if err != nil {
-			return err
-		}
+	return credentialStore.Delete(credentialsName)
+}
+
+// ClassifyError deletes the stored JWT when ConsoleMe reports that it's invalid, so the next
+// command logs in again, and returns nil for any other error response
+func ClassifyError(statusCode int, body []byte) error {
+	var response struct {
+		Code string `json:"code"`
 	}
-	return nil
+	if err := json.Unmarshal(body, &response); err != nil || response.Code != "invalid_jwt" {
+		return nil
+	}
+	logging.Log.Errorf("Authentication is invalid or has expired. Please run `weep login` to re-authenticate.")
+	if err := DeleteLocalWeepCredentials(); err != nil {
+		logging.Log.Errorf("failed to delete credentials: %v", err)
+	}
+	return werrors.InvalidJWT
 }
@@ -0,0 +1,34 @@
+package challenge
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	werrors "github.com/netflix/weep/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		Description string
+		StatusCode  int
+		Body        string
+		Expected    error
+		Deleted     bool
+	}{
+		{Description: "invalid_jwt", StatusCode: http.StatusForbidden, Body: `{"code": "invalid_jwt"}`, Expected: werrors.InvalidJWT, Deleted: true},
+		{Description: "other ConsoleMe error", StatusCode: http.StatusForbidden, Body: `{"code": "900"}`},
+		{Description: "not JSON", StatusCode: http.StatusInternalServerError, Body: "oops"},
+	}
+	signer := newTestSigner(t, "ES256", "key")
+	for _, tc := range cases {
+		setupTestChallengeStore(t)
+		storeTestChallenge(t, signer, time.Now().Add(time.Hour))
+		if err := ClassifyError(tc.StatusCode, []byte(tc.Body)); err != tc.Expected {
+			t.Errorf("%s: got %v, expected %v", tc.Description, err, tc.Expected)
+		}
+		if _, err := getChallenge(); (err != nil) != tc.Deleted {
+			t.Errorf("%s: got error %v reading the stored JWT, expected it deleted %v", tc.Description, err, tc.Deleted)
+		}
+	}
+}
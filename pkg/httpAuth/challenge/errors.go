@@ -0,0 +1,31 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package challenge
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const InvalidJWTError = Error("ConsoleMe JWT is malformed")
+const JWTAudienceError = Error("ConsoleMe JWT was issued for a different audience")
+const JWTExpiredError = Error("ConsoleMe JWT has expired")
+const JWTIssuerError = Error("ConsoleMe JWT was issued by an unexpected issuer")
+const JWTMissingExpiryError = Error("ConsoleMe JWT has no expiration claim")
+const JWTNotYetValidError = Error("ConsoleMe JWT is not valid yet")
+const JWTSignatureError = Error("ConsoleMe JWT signature is invalid")
+const JWTUnknownKeyError = Error("ConsoleMe JWT was signed with a key that isn't in the JWKS")
+const JWTUnsupportedAlgorithmError = Error("ConsoleMe JWT uses an unsupported signing algorithm")
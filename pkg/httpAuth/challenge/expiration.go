@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package challenge
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/netflix/weep/pkg/health"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+// healthComponent identifies the challenge JWT in weep's health status
+const healthComponent = "challenge"
+
+// expirationCheckInterval is how often MonitorExpiration checks the JWT. It's a variable so tests
+// can shorten it.
+var expirationCheckInterval = time.Minute
+
+// Expiration returns when the current JWT expires
+func Expiration() (time.Time, error) {
+	challenge := currentChallenge()
+	if challenge == nil {
+		return time.Time{}, fmt.Errorf("no ConsoleMe JWT is stored")
+	}
+	claims, err := newJWTVerifier().verify(challenge.EncodedJwt, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+	exp, ok := claims.Time("exp")
+	if !ok {
+		return time.Time{}, JWTMissingExpiryError
+	}
+	return exp, nil
+}
+
+// expirationMonitor tracks what has been reported about the JWT, so each warning is logged once
+type expirationMonitor struct {
+	warnBefore time.Duration
+	autoRenew  bool
+	state      string
+}
+
+// MonitorExpiration watches the JWT in long-running modes like weep serve. Ahead of expiry it
+// logs a warning and marks weep's health as degraded, and with challenge_settings.auto_renew it
+// starts a new login. A JWT stored by `weep login` or the admin API clears the warning. It runs
+// until stop is closed.
+func MonitorExpiration(stop <-chan struct{}) {
+	m := &expirationMonitor{
+		warnBefore: time.Duration(viper.GetInt("challenge_settings.expiry_warning")) * time.Second,
+		autoRenew:  viper.GetBool("challenge_settings.auto_renew"),
+	}
+	ticker := time.NewTicker(expirationCheckInterval)
+	defer ticker.Stop()
+	for {
+		m.check(time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *expirationMonitor) check(now time.Time) {
+	// Pick up a JWT stored by another process
+	if challenge, err := getChallenge(); err == nil && HasValidJwt(challenge) {
+		setCurrentChallenge(challenge)
+	}
+	exp, err := Expiration()
+	switch {
+	case err != nil:
+		m.report("missing", fmt.Sprintf("no valid ConsoleMe authentication (%v), run `weep login`", err))
+	case !now.Before(exp):
+		m.report("expired", "ConsoleMe authentication expired, run `weep login`")
+	case exp.Sub(now) < m.warnBefore:
+		reason := fmt.Sprintf("ConsoleMe authentication expires in %s, run `weep login`", exp.Sub(now).Round(time.Minute))
+		if m.report("expiring", reason) && m.autoRenew {
+			// Only once per expiry, so a login that isn't completed doesn't keep opening the browser
+			go renew()
+		}
+	default:
+		if m.state != "" && m.state != "valid" {
+			logging.Log.Infof("ConsoleMe authentication is valid until %s", exp.Format(time.RFC3339))
+		}
+		m.state = "valid"
+		health.WeepStatus.ClearDegraded(healthComponent)
+	}
+}
+
+// report marks health as degraded, logging reason and returning true the first time the JWT
+// enters state
+func (m *expirationMonitor) report(state, reason string) bool {
+	health.WeepStatus.SetDegraded(healthComponent, reason)
+	if m.state == state {
+		return false
+	}
+	logging.Log.Warn(reason)
+	m.state = state
+	return true
+}
+
+func renew() {
+	logging.Log.Info("renewing ConsoleMe authentication")
+	if err := Login(); err != nil {
+		logging.Log.Errorf("could not renew ConsoleMe authentication: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package challenge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/weep/pkg/health"
+	"github.com/netflix/weep/pkg/httpAuth/store"
+
+	"github.com/spf13/viper"
+)
+
+// storeTestChallenge stores a challenge response with a JWT that expires at exp
+func storeTestChallenge(t *testing.T, signer *testSigner, exp time.Time) {
+	b, err := json.Marshal(ConsolemeChallengeResponse{
+		Status:     "success",
+		CookieName: "consoleme_auth",
+		EncodedJwt: signer.sign(t, map[string]interface{}{"email": "user@example.com", "exp": exp.Unix()}),
+		Expires:    exp.Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(credentialsName, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setupTestChallengeStore(t *testing.T) {
+	setupTestJWT(t, "")
+	viper.Set("credential_store.type", "plaintext")
+	setCurrentChallenge(nil)
+	t.Cleanup(func() {
+		viper.Set("credential_store", nil)
+		setCurrentChallenge(nil)
+		health.WeepStatus.ClearDegraded(healthComponent)
+	})
+}
+
+func TestExpirationMonitor(t *testing.T) {
+	setupTestChallengeStore(t)
+	signer := newTestSigner(t, "ES256", "key")
+	now := time.Now()
+	m := &expirationMonitor{warnBefore: time.Hour}
+
+	m.check(now)
+	if degraded, reason := health.WeepStatus.Degraded(); !degraded || !strings.Contains(reason, "weep login") {
+		t.Errorf("got degraded %v (%s) without a JWT, expected degraded", degraded, reason)
+	}
+
+	storeTestChallenge(t, signer, now.Add(3*time.Hour))
+	m.check(now)
+	if degraded, reason := health.WeepStatus.Degraded(); degraded {
+		t.Errorf("got degraded (%s) with a JWT valid for 3 hours", reason)
+	}
+
+	m.check(now.Add(150 * time.Minute))
+	if degraded, reason := health.WeepStatus.Degraded(); !degraded || !strings.Contains(reason, "expires in 30m") {
+		t.Errorf("got degraded %v (%s) 30 minutes before expiry", degraded, reason)
+	}
+	if healthy, _ := health.WeepStatus.Get(); !healthy {
+		t.Errorf("expected weep to stay healthy while the JWT is expiring")
+	}
+
+	m.check(now.Add(4 * time.Hour))
+	if _, reason := health.WeepStatus.Degraded(); !strings.Contains(reason, "expired") {
+		t.Errorf("got %q after expiry", reason)
+	}
+
+	// A login by another process clears the warning
+	storeTestChallenge(t, signer, now.Add(8*time.Hour))
+	m.check(now.Add(4 * time.Hour))
+	if degraded, reason := health.WeepStatus.Degraded(); degraded {
+		t.Errorf("got degraded (%s) after a new JWT was stored", reason)
+	}
+}
+
+func TestHTTPClientUsesNewJWT(t *testing.T) {
+	setupTestChallengeStore(t)
+	signer := newTestSigner(t, "ES256", "key")
+	var cookies []string
+	consoleme := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("consoleme_auth"); err == nil {
+			cookies = append(cookies, c.Value)
+		}
+	}))
+	defer consoleme.Close()
+
+	storeTestChallenge(t, signer, time.Now().Add(time.Hour))
+	client, err := NewHTTPClient(consoleme.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(consoleme.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The JWT in use expires, and another process logs in
+	setCurrentChallenge(&ConsolemeChallengeResponse{
+		CookieName: "consoleme_auth",
+		EncodedJwt: signer.sign(t, map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}),
+	})
+	storeTestChallenge(t, signer, time.Now().Add(2*time.Hour))
+	resp, err = client.Get(consoleme.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(cookies) != 2 || cookies[0] == cookies[1] {
+		t.Errorf("got cookies %v, expected the client to send the new JWT", cookies)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package challenge
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth/store"
+	"github.com/netflix/weep/pkg/httpAuth/transport"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+// jwksCacheName is the file in the weep directory that caches ConsoleMe's JWKS
+const jwksCacheName = "jwks.json"
+
+// jsonWebKey is a public key from a JWKS, as described in RFC 7517
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// jwksCache is the on-disk form of a fetched JWKS
+type jwksCache struct {
+	URL       string       `json:"url"`
+	FetchedAt time.Time    `json:"fetched_at"`
+	Keys      []jsonWebKey `json:"keys"`
+}
+
+// jwksRefetchInterval is the least time between fetches made because a token names a key that
+// isn't in the cached set, so tokens with made-up key IDs can't make weep hammer the JWKS URL
+var jwksRefetchInterval = time.Minute
+
+// jwks verifies signatures with keys fetched from a JWKS URL. Keys are cached on disk for ttl, and
+// fetched again early when a token names a key that isn't in the cached set.
+type jwks struct {
+	sync.Mutex
+	url   string
+	ttl   time.Duration
+	cache *jwksCache
+	// lastFetch is when this process last tried to fetch the JWKS
+	lastFetch time.Time
+}
+
+// keySets holds one jwks per URL, shared by every verifier in the process
+var keySets = struct {
+	sync.Mutex
+	byURL map[string]*jwks
+}{byURL: make(map[string]*jwks)}
+
+// getJWKS returns the shared jwks for url, using ttl from now on
+func getJWKS(url string, ttl time.Duration) *jwks {
+	keySets.Lock()
+	j, ok := keySets.byURL[url]
+	if !ok {
+		j = &jwks{url: url}
+		keySets.byURL[url] = j
+	}
+	keySets.Unlock()
+	j.Lock()
+	j.ttl = ttl
+	j.Unlock()
+	return j
+}
+
+// jwksURL returns challenge_settings.jwks_url, defaulting to the well-known location on ConsoleMe
+func jwksURL() string {
+	if u := viper.GetString("challenge_settings.jwks_url"); u != "" {
+		return u
+	}
+	return strings.TrimRight(viper.GetString("consoleme_url"), "/") + "/.well-known/jwks.json"
+}
+
+func (j *jwks) verify(header jwtHeader, signingInput, signature []byte) error {
+	if !supportedAlgorithms[header.Algorithm] {
+		return JWTUnsupportedAlgorithmError
+	}
+	j.Lock()
+	defer j.Unlock()
+	fetched := false
+	if j.cache == nil || time.Since(j.cache.FetchedAt) > j.ttl {
+		j.cache = j.readCache()
+	}
+	if j.cache == nil {
+		if err := j.fetch(); err != nil {
+			return err
+		}
+		fetched = true
+	}
+	keys := j.matching(header)
+	if len(keys) == 0 && !fetched && time.Since(j.lastFetch) >= jwksRefetchInterval {
+		// ConsoleMe may have rotated its keys since they were cached
+		if err := j.fetch(); err != nil {
+			return err
+		}
+		keys = j.matching(header)
+	}
+	if len(keys) == 0 {
+		return JWTUnknownKeyError
+	}
+	for _, key := range keys {
+		if verifySignature(header.Algorithm, key, signingInput, signature) == nil {
+			return nil
+		}
+	}
+	return JWTSignatureError
+}
+
+// matching returns the usable public keys for header
+func (j *jwks) matching(header jwtHeader) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for _, k := range j.cache.Keys {
+		if header.KeyID != "" && k.KeyID != header.KeyID {
+			continue
+		}
+		if (k.Algorithm != "" && k.Algorithm != header.Algorithm) || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logging.Log.Debugf("skipping JWKS key %q: %v", k.KeyID, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// readCache returns the cached JWKS if it's for the configured URL and hasn't expired
+func (j *jwks) readCache() *jwksCache {
+	dir, err := store.Dir()
+	if err != nil {
+		return nil
+	}
+	b, err := store.NewFileStore(dir).Get(jwksCacheName)
+	if err != nil {
+		return nil
+	}
+	var cache jwksCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		logging.Log.Debugf("ignoring invalid JWKS cache: %v", err)
+		return nil
+	}
+	if cache.URL != j.url || time.Since(cache.FetchedAt) > j.ttl {
+		return nil
+	}
+	return &cache
+}
+
+// fetch downloads the JWKS and caches it
+func (j *jwks) fetch() error {
+	logging.Log.Debugf("fetching JWKS from %s", j.url)
+	j.lastFetch = time.Now()
+	client, err := transport.NewClient()
+	if err != nil {
+		return err
+	}
+	client.Timeout = time.Duration(viper.GetInt("server.http_timeout")) * time.Second
+	resp, err := client.Get(j.url)
+	if err != nil {
+		return fmt.Errorf("could not fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not fetch JWKS: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch JWKS: %s returned %d", j.url, resp.StatusCode)
+	}
+	cache := jwksCache{URL: j.url, FetchedAt: time.Now()}
+	if err := json.Unmarshal(body, &cache); err != nil {
+		return fmt.Errorf("could not parse JWKS: %w", err)
+	}
+	j.cache = &cache
+
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	dir, err := store.Dir()
+	if err != nil {
+		return err
+	}
+	if err := store.NewFileStore(dir).Put(jwksCacheName, b); err != nil {
+		logging.Log.Warnf("could not cache JWKS: %v", err)
+	}
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Curve)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
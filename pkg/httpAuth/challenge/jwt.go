@@ -0,0 +1,246 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package challenge
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// jwtHeader is the part of the JOSE header needed to pick a verification key
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtClaims holds the claims of a decoded JWT
+type jwtClaims map[string]interface{}
+
+// String returns a string claim, or an empty string if it's missing or not a string
+func (c jwtClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Time returns a NumericDate claim
+func (c jwtClaims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*float64(time.Second))), true
+}
+
+// Audience returns the aud claim, which may be a single string or a list
+func (c jwtClaims) Audience() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var audiences []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+		return audiences
+	}
+	return nil
+}
+
+// jwtVerifier checks ConsoleMe JWTs against challenge_settings
+type jwtVerifier struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+	// keys is nil when signatures aren't verified
+	keys *jwks
+	now  func() time.Time
+}
+
+func newJWTVerifier() *jwtVerifier {
+	v := &jwtVerifier{
+		issuer:   viper.GetString("challenge_settings.issuer"),
+		audience: viper.GetString("challenge_settings.audience"),
+		leeway:   time.Duration(viper.GetInt("challenge_settings.leeway")) * time.Second,
+		now:      time.Now,
+	}
+	if viper.GetBool("challenge_settings.verify_signature") {
+		v.keys = getJWKS(jwksURL(), time.Duration(viper.GetInt("challenge_settings.jwks_cache_ttl"))*time.Second)
+	}
+	return v
+}
+
+// verify decodes token, checks its signature if a JWKS is configured, and checks the iss and aud
+// claims. When checkTime is set, exp and nbf are checked as well, allowing for the configured
+// leeway; exp is required.
+func (v *jwtVerifier) verify(token string, checkTime bool) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidJWTError
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if v.keys != nil {
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, InvalidJWTError
+		}
+		if err := v.keys.verify(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+			return nil, err
+		}
+	}
+	if v.issuer != "" && claims.String("iss") != v.issuer {
+		return nil, JWTIssuerError
+	}
+	if v.audience != "" && !containsString(claims.Audience(), v.audience) {
+		return nil, JWTAudienceError
+	}
+	if !checkTime {
+		return claims, nil
+	}
+	now := v.now()
+	exp, ok := claims.Time("exp")
+	if !ok {
+		return nil, JWTMissingExpiryError
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return nil, JWTExpiredError
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return nil, JWTNotYetValidError
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return InvalidJWTError
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return InvalidJWTError
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedAlgorithms are the JWS algorithms that signatures can be verified with
+var supportedAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"EdDSA": true,
+}
+
+// ecdsaCurveBits is the size of the curve each ES algorithm must be used with
+var ecdsaCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// verifySignature checks signature over signingInput with key, for the algorithms that can be
+// verified with the standard library
+func verifySignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signingInput, signature) {
+			return JWTSignatureError
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return JWTUnsupportedAlgorithmError
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return JWTUnsupportedAlgorithmError
+	}
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		if pub, ok := key.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil {
+			return nil
+		}
+	case "PS":
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		if pub, ok := key.(*rsa.PublicKey); ok && rsa.VerifyPSS(pub, hash, digest, signature, opts) == nil {
+			return nil
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return JWTSignatureError
+		}
+		bits := pub.Curve.Params().BitSize
+		if bits != ecdsaCurveBits[alg] {
+			return JWTSignatureError
+		}
+		size := (bits + 7) / 8
+		if len(signature) != 2*size {
+			return JWTSignatureError
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(pub, digest, r, s) {
+			return nil
+		}
+	default:
+		return JWTUnsupportedAlgorithmError
+	}
+	return JWTSignatureError
+}
@@ -0,0 +1,274 @@
+package challenge
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+// testSigner signs JWTs with one key and publishes the matching JWK
+type testSigner struct {
+	alg  string
+	kid  string
+	key  crypto.Signer
+	jwk  jsonWebKey
+	hash crypto.Hash
+}
+
+func newTestSigner(t *testing.T, alg, kid string) *testSigner {
+	s := &testSigner{alg: alg, kid: kid, hash: crypto.SHA256}
+	enc := base64.RawURLEncoding.EncodeToString
+	switch alg {
+	case "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.key = key
+		s.jwk = jsonWebKey{KeyType: "RSA", N: enc(key.N.Bytes()), E: enc(big.NewInt(int64(key.E)).Bytes())}
+	case "ES256":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.key = key
+		s.jwk = jsonWebKey{KeyType: "EC", Curve: "P-256", X: enc(key.X.FillBytes(make([]byte, 32))), Y: enc(key.Y.FillBytes(make([]byte, 32)))}
+	case "EdDSA":
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.key = key
+		s.jwk = jsonWebKey{KeyType: "OKP", Curve: "Ed25519", X: enc(pub)}
+	}
+	s.jwk.KeyID = kid
+	s.jwk.Algorithm = alg
+	return s
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(input))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		var r, sig *big.Int
+		r, sig, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	default:
+		digest := sha256.Sum256([]byte(input))
+		signature, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJWKSServer publishes the JWKs of its signers and counts fetches
+type testJWKSServer struct {
+	sync.Mutex
+	signers []*testSigner
+	fetches int
+	server  *httptest.Server
+}
+
+func newTestJWKSServer(t *testing.T, signers ...*testSigner) *testJWKSServer {
+	j := &testJWKSServer{signers: signers}
+	j.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.Lock()
+		defer j.Unlock()
+		j.fetches++
+		var keys []jsonWebKey
+		for _, s := range j.signers {
+			keys = append(keys, s.jwk)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(j.server.Close)
+	return j
+}
+
+func setupTestJWT(t *testing.T, jwksURL string) {
+	t.Setenv("HOME", t.TempDir())
+	homedir.DisableCache = true
+	viper.Set("challenge_settings.verify_signature", jwksURL != "")
+	viper.Set("challenge_settings.jwks_url", jwksURL)
+	viper.Set("challenge_settings.jwks_cache_ttl", 3600)
+	viper.Set("challenge_settings.leeway", 60)
+	viper.Set("challenge_settings.user_claim", "email")
+	t.Cleanup(func() {
+		homedir.DisableCache = false
+		viper.Set("challenge_settings", nil)
+	})
+}
+
+func testVerifier() *jwtVerifier {
+	v := newJWTVerifier()
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	signer := newTestSigner(t, "ES256", "key-1")
+	jwksServer := newTestJWKSServer(t, signer)
+	setupTestJWT(t, jwksServer.server.URL)
+	viper.Set("challenge_settings.issuer", "https://consoleme.example.com")
+	viper.Set("challenge_settings.audience", "weep")
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"email": "user@example.com",
+			"iss":   "https://consoleme.example.com",
+			"aud":   []string{"consoleme", "weep"},
+			"nbf":   testNow.Add(-time.Hour).Unix(),
+			"exp":   testNow.Add(time.Hour).Unix(),
+		}
+	}
+	cases := []struct {
+		Description string
+		Modify      func(claims map[string]interface{})
+		Expected    error
+	}{
+		{Description: "valid", Modify: func(c map[string]interface{}) {}},
+		{Description: "expired", Modify: func(c map[string]interface{}) { c["exp"] = testNow.Add(-2 * time.Minute).Unix() }, Expected: JWTExpiredError},
+		{Description: "expired within leeway", Modify: func(c map[string]interface{}) { c["exp"] = testNow.Add(-30 * time.Second).Unix() }},
+		{Description: "missing exp", Modify: func(c map[string]interface{}) { delete(c, "exp") }, Expected: JWTMissingExpiryError},
+		{Description: "not yet valid", Modify: func(c map[string]interface{}) { c["nbf"] = testNow.Add(5 * time.Minute).Unix() }, Expected: JWTNotYetValidError},
+		{Description: "nbf within leeway", Modify: func(c map[string]interface{}) { c["nbf"] = testNow.Add(30 * time.Second).Unix() }},
+		{Description: "wrong issuer", Modify: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, Expected: JWTIssuerError},
+		{Description: "wrong audience", Modify: func(c map[string]interface{}) { c["aud"] = "consoleme" }, Expected: JWTAudienceError},
+		{Description: "single audience", Modify: func(c map[string]interface{}) { c["aud"] = "weep" }},
+	}
+	for _, tc := range cases {
+		claims := valid()
+		tc.Modify(claims)
+		if _, err := testVerifier().verify(signer.sign(t, claims), true); err != tc.Expected {
+			t.Errorf("%s: got %v, expected %v", tc.Description, err, tc.Expected)
+		}
+	}
+}
+
+func TestJWTVerifierSignatures(t *testing.T) {
+	rsaSigner := newTestSigner(t, "RS256", "rsa")
+	ecSigner := newTestSigner(t, "ES256", "ec")
+	edSigner := newTestSigner(t, "EdDSA", "ed")
+	jwksServer := newTestJWKSServer(t, rsaSigner, ecSigner, edSigner)
+	setupTestJWT(t, jwksServer.server.URL)
+	claims := map[string]interface{}{"email": "user@example.com", "exp": testNow.Add(time.Hour).Unix()}
+
+	for _, signer := range []*testSigner{rsaSigner, ecSigner, edSigner} {
+		token := signer.sign(t, claims)
+		if _, err := testVerifier().verify(token, true); err != nil {
+			t.Errorf("%s: got %v for a valid signature", signer.alg, err)
+		}
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(map[string]interface{}{"email": "admin@example.com", "exp": testNow.Add(time.Hour).Unix()})
+		tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+		if _, err := testVerifier().verify(tampered, true); err != JWTSignatureError {
+			t.Errorf("%s: got %v for a tampered token, expected %v", signer.alg, err, JWTSignatureError)
+		}
+	}
+	if jwksServer.fetches != 1 {
+		t.Errorf("got %d JWKS fetches, expected the cached JWKS to be reused", jwksServer.fetches)
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":2000000000}`))
+	if _, err := testVerifier().verify(header+"."+payload+".", true); err != JWTUnsupportedAlgorithmError {
+		t.Errorf("got %v for an unsigned token, expected %v", err, JWTUnsupportedAlgorithmError)
+	}
+}
+
+func TestJWTVerifierKeyRotation(t *testing.T) {
+	oldSigner := newTestSigner(t, "ES256", "old")
+	jwksServer := newTestJWKSServer(t, oldSigner)
+	setupTestJWT(t, jwksServer.server.URL)
+	claims := map[string]interface{}{"email": "user@example.com", "exp": testNow.Add(time.Hour).Unix()}
+
+	if _, err := testVerifier().verify(oldSigner.sign(t, claims), true); err != nil {
+		t.Fatal(err)
+	}
+	newSigner := newTestSigner(t, "ES256", "new")
+	jwksServer.Lock()
+	jwksServer.signers = []*testSigner{newSigner}
+	jwksServer.Unlock()
+
+	// Verifiers share the JWKS, which isn't fetched again for an unknown key until
+	// jwksRefetchInterval has passed since the last fetch
+	if testVerifier().keys != testVerifier().keys {
+		t.Errorf("expected verifiers to share the JWKS for a URL")
+	}
+	token := newSigner.sign(t, claims)
+	if _, err := testVerifier().verify(token, true); err != JWTUnknownKeyError {
+		t.Errorf("got %v for a new key right after a fetch, expected %v", err, JWTUnknownKeyError)
+	}
+	if jwksServer.fetches != 1 {
+		t.Errorf("got %d JWKS fetches, expected 1", jwksServer.fetches)
+	}
+	keys := testVerifier().keys
+	keys.Lock()
+	keys.lastFetch = keys.lastFetch.Add(-jwksRefetchInterval)
+	keys.Unlock()
+	if _, err := testVerifier().verify(token, true); err != nil {
+		t.Errorf("got %v after key rotation", err)
+	}
+	if jwksServer.fetches != 2 {
+		t.Errorf("got %d JWKS fetches, expected 2", jwksServer.fetches)
+	}
+	if _, err := testVerifier().verify(newTestSigner(t, "ES256", "unknown").sign(t, claims), true); err != JWTUnknownKeyError {
+		t.Errorf("got %v for an unknown key, expected %v", err, JWTUnknownKeyError)
+	}
+	if jwksServer.fetches != 2 {
+		t.Errorf("got %d JWKS fetches for an unknown key, expected it to be rate limited", jwksServer.fetches)
+	}
+}
+
+func TestJWTUser(t *testing.T) {
+	signer := newTestSigner(t, "EdDSA", "ed")
+	jwksServer := newTestJWKSServer(t, signer)
+	setupTestJWT(t, jwksServer.server.URL)
+
+	expired := &ConsolemeChallengeResponse{
+		EncodedJwt: signer.sign(t, map[string]interface{}{"email": "user@example.com", "exp": time.Now().Add(-time.Hour).Unix()}),
+		User:       "someone-else@example.com",
+		Expires:    time.Now().Add(time.Hour).Unix(),
+	}
+	if HasValidJwt(expired) {
+		t.Errorf("expected an expired JWT to be invalid despite its expiration field")
+	}
+	if user := jwtUser(expired); user != "user@example.com" {
+		t.Errorf("got user %q, expected the user from the JWT claims", user)
+	}
+
+	forged := &ConsolemeChallengeResponse{
+		EncodedJwt: newTestSigner(t, "EdDSA", "ed").sign(t, map[string]interface{}{"email": "admin@example.com"}),
+	}
+	if user := jwtUser(forged); user != "" {
+		t.Errorf("got user %q from a JWT with an invalid signature", user)
+	}
+}
@@ -3,26 +3,188 @@ package httpAuth
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/netflix/weep/pkg/config"
 	"github.com/netflix/weep/pkg/httpAuth/challenge"
 	"github.com/netflix/weep/pkg/httpAuth/custom"
 	"github.com/netflix/weep/pkg/httpAuth/mtls"
+	"github.com/netflix/weep/pkg/httpAuth/oauth"
+	"github.com/netflix/weep/pkg/httpAuth/sigv4"
+	"github.com/netflix/weep/pkg/httpAuth/token"
+	"github.com/netflix/weep/pkg/logging"
+
 	"github.com/spf13/viper"
 )
 
+func init() {
+	RegisterProvider("challenge", Provider{
+		NewHTTPClient: func() (*http.Client, error) {
+			if err := challenge.RefreshChallenge(); err != nil {
+				return nil, err
+			}
+			return challenge.NewHTTPClient(viper.GetString("consoleme_url"))
+		},
+		Login:             challenge.Login,
+		MonitorExpiration: challenge.MonitorExpiration,
+		ClassifyError:     challenge.ClassifyError,
+	})
+	RegisterProvider("device_code", Provider{
+		NewHTTPClient: func() (*http.Client, error) {
+			if err := oauth.Authenticate(oauth.DeviceCodeFlow); err != nil {
+				return nil, err
+			}
+			return oauth.NewHTTPClient()
+		},
+		Login: func() error {
+			return oauth.Login(oauth.DeviceCodeFlow)
+		},
+		ClassifyError: oauth.ClassifyError,
+	})
+	RegisterProvider("mtls", Provider{
+		NewHTTPClient: mtls.NewHTTPClient,
+	})
+	RegisterProvider("sigv4", Provider{
+		NewHTTPClient: sigv4.NewHTTPClient,
+		Preflight:     sigv4.SignRequest,
+	})
+	RegisterProvider("token", Provider{
+		NewHTTPClient: token.NewHTTPClient,
+		Preflight:     token.SetHeader,
+		ClassifyError: token.ClassifyError,
+	})
+	RegisterProvider("pkce", Provider{
+		NewHTTPClient: func() (*http.Client, error) {
+			if err := oauth.Authenticate(oauth.PKCEFlow); err != nil {
+				return nil, err
+			}
+			return oauth.NewHTTPClient()
+		},
+		Login: func() error {
+			return oauth.Login(oauth.PKCEFlow)
+		},
+		ClassifyError: oauth.ClassifyError,
+	})
+}
+
+var (
+	activeMu     sync.Mutex
+	activeMethod string
+	// activeChosen is closed once an authentication method has succeeded
+	activeChosen = make(chan struct{})
+)
+
+// ActiveMethod returns the authentication method that last produced a client, or an empty string
+// if none has yet
+func ActiveMethod() string {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	return activeMethod
+}
+
+func setActiveMethod(method string) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if activeMethod == method {
+		return
+	}
+	if activeMethod == "" {
+		close(activeChosen)
+	}
+	logging.Log.Infof("authenticating to ConsoleMe with %s", method)
+	activeMethod = method
+}
+
+// GetAuthenticatedClient returns a client for the first configured authentication method that
+// works. A client factory registered with custom.RegisterClientFactory takes precedence.
 func GetAuthenticatedClient() (*http.Client, error) {
-	authenticationMethod := viper.GetString("authentication_method")
-	consoleMeUrl := viper.GetString("consoleme_url")
 	if custom.UseCustom() {
+		setActiveMethod("custom")
 		return custom.NewHTTPClient()
-	} else if authenticationMethod == "mtls" {
-		return mtls.NewHTTPClient()
-	} else if authenticationMethod == "challenge" {
-		err := challenge.RefreshChallenge()
-		if err != nil {
-			return nil, err
+	}
+	methods := config.AuthenticationMethods()
+	if len(methods) == 0 {
+		return nil, NoAuthenticationMethodError
+	}
+	var failures []string
+	var lastErr error
+	for _, method := range methods {
+		provider, ok := getProvider(method)
+		if !ok {
+			lastErr = fmt.Errorf("%w: %s", UnsupportedMethodError, method)
+		} else if client, err := provider.NewHTTPClient(); err != nil {
+			lastErr = err
+		} else {
+			setActiveMethod(method)
+			return client, nil
 		}
-		return challenge.NewHTTPClient(consoleMeUrl)
+		logging.Log.Warnf("could not authenticate with %s: %v", method, lastErr)
+		failures = append(failures, fmt.Sprintf("%s: %v", method, lastErr))
+	}
+	if len(methods) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no authentication method succeeded: %s", strings.Join(failures, "; "))
+}
+
+// RunPreflight prepares a request to ConsoleMe. It runs the functions registered with
+// custom.RegisterRequestPreflight, then the active method's Preflight, so a signature covers
+// every change made to the request.
+func RunPreflight(req *http.Request) error {
+	if err := custom.RunPreflightFunctions(req); err != nil {
+		return err
+	}
+	if provider, ok := getProvider(ActiveMethod()); ok && provider.Preflight != nil {
+		return provider.Preflight(req)
+	}
+	return nil
+}
+
+// ClassifyError returns the active method's error for an error response from ConsoleMe, or nil if
+// the method leaves the response to the caller
+func ClassifyError(statusCode int, body []byte) error {
+	if provider, ok := getProvider(ActiveMethod()); ok && provider.ClassifyError != nil {
+		return provider.ClassifyError(statusCode, body)
+	}
+	return nil
+}
+
+// Login authenticates again with the active method, or the first configured method that supports
+// it, replacing any stored credentials
+func Login() error {
+	if custom.UseCustom() {
+		return fmt.Errorf("custom authentication doesn't support login")
+	}
+	methods := config.AuthenticationMethods()
+	if active := ActiveMethod(); active != "" {
+		methods = []string{active}
+	}
+	for _, method := range methods {
+		if provider, ok := getProvider(method); ok && provider.Login != nil {
+			return provider.Login()
+		}
+	}
+	return fmt.Errorf("%w: %s", LoginUnsupportedError, strings.Join(methods, ", "))
+}
+
+// MonitorExpiration warns ahead of the expiry of credentials that can't be renewed without the
+// user, for long-running commands like weep serve. When more than one method is configured, it
+// waits until one has been chosen. It returns when stop is closed.
+func MonitorExpiration(stop <-chan struct{}) {
+	if custom.UseCustom() {
+		return
+	}
+	methods := config.AuthenticationMethods()
+	if len(methods) != 1 {
+		select {
+		case <-activeChosen:
+			methods = []string{ActiveMethod()}
+		case <-stop:
+			return
+		}
+	}
+	if provider, ok := getProvider(methods[0]); ok && provider.MonitorExpiration != nil {
+		provider.MonitorExpiration(stop)
 	}
-	return nil, fmt.Errorf("Authentication method unsupported or not provided.")
 }
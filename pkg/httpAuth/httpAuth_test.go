@@ -0,0 +1,208 @@
+package httpAuth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth/custom"
+
+	"github.com/spf13/viper"
+)
+
+// setTestProviders registers providers for the test and configures authentication_method
+func setTestProviders(t *testing.T, methods interface{}, registered map[string]Provider) {
+	for name, provider := range registered {
+		RegisterProvider(name, provider)
+	}
+	viper.Set("authentication_method", methods)
+	t.Cleanup(func() {
+		providersMu.Lock()
+		for name := range registered {
+			delete(providers, name)
+		}
+		providersMu.Unlock()
+		viper.Set("authentication_method", nil)
+		activeMu.Lock()
+		activeMethod = ""
+		activeChosen = make(chan struct{})
+		activeMu.Unlock()
+	})
+}
+
+func TestGetAuthenticatedClientFallback(t *testing.T) {
+	client := &http.Client{}
+	var logins []string
+	setTestProviders(t, []string{"unavailable", "unknown", "available"}, map[string]Provider{
+		"unavailable": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return nil, errors.New("no certificates")
+			},
+		},
+		"available": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return client, nil
+			},
+			Login: func() error {
+				logins = append(logins, "available")
+				return nil
+			},
+		},
+	})
+
+	got, err := GetAuthenticatedClient()
+	if err != nil || got != client {
+		t.Fatalf("got client %v and error %v, expected the fallback client", got, err)
+	}
+	if active := ActiveMethod(); active != "available" {
+		t.Errorf("got active method %q, expected available", active)
+	}
+	if err := Login(); err != nil || len(logins) != 1 {
+		t.Errorf("got error %v and logins %v, expected the active method to log in", err, logins)
+	}
+}
+
+func TestGetAuthenticatedClientErrors(t *testing.T) {
+	unavailable := errors.New("no certificates")
+	setTestProviders(t, "unavailable", map[string]Provider{
+		"unavailable": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return nil, unavailable
+			},
+		},
+	})
+	if _, err := GetAuthenticatedClient(); err != unavailable {
+		t.Errorf("got %v with one method, expected its error", err)
+	}
+	if err := Login(); !errors.Is(err, LoginUnsupportedError) {
+		t.Errorf("got %v, expected %v", err, LoginUnsupportedError)
+	}
+
+	viper.Set("authentication_method", "unavailable, unknown")
+	_, err := GetAuthenticatedClient()
+	if err == nil || !strings.Contains(err.Error(), "unavailable: no certificates") || !strings.Contains(err.Error(), "unknown: "+string(UnsupportedMethodError)) {
+		t.Errorf("got %v, expected the error of each method", err)
+	}
+	if ActiveMethod() != "" {
+		t.Errorf("got active method %q after every method failed", ActiveMethod())
+	}
+}
+
+func TestMonitorExpirationWaitsForMethod(t *testing.T) {
+	monitored := make(chan string, 1)
+	monitor := func(name string) func(stop <-chan struct{}) {
+		return func(stop <-chan struct{}) {
+			monitored <- name
+		}
+	}
+	setTestProviders(t, []string{"first", "second"}, map[string]Provider{
+		"first": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return nil, errors.New("unavailable")
+			},
+			MonitorExpiration: monitor("first"),
+		},
+		"second": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return &http.Client{}, nil
+			},
+			MonitorExpiration: monitor("second"),
+		},
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go MonitorExpiration(stop)
+	select {
+	case name := <-monitored:
+		t.Fatalf("%s was monitored before a method was chosen", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := GetAuthenticatedClient(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-monitored:
+		if name != "second" {
+			t.Errorf("got %s monitored, expected second", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the chosen method to be monitored")
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	var calls []string
+	custom.RegisterRequestPreflight(func(req *http.Request) error {
+		if req.Header.Get("X-Test") == "" {
+			return nil
+		}
+		calls = append(calls, "custom")
+		return nil
+	})
+	setTestProviders(t, "signing", map[string]Provider{
+		"signing": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return &http.Client{}, nil
+			},
+			Preflight: func(req *http.Request) error {
+				calls = append(calls, "signing")
+				return nil
+			},
+		},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "https://consoleme.example.com/api/v1/get_roles", nil)
+	req.Header.Set("X-Test", "true")
+	if err := RunPreflight(req); err != nil || len(calls) != 1 {
+		t.Errorf("got error %v and calls %v before a method was chosen", err, calls)
+	}
+	if _, err := GetAuthenticatedClient(); err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+	if err := RunPreflight(req); err != nil || strings.Join(calls, ",") != "custom,signing" {
+		t.Errorf("got error %v and calls %v, expected the method to run after custom preflights", err, calls)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	rejected := errors.New("rejected")
+	setTestProviders(t, []string{"plain", "classifying"}, map[string]Provider{
+		"plain": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return nil, errors.New("unavailable")
+			},
+			ClassifyError: func(statusCode int, body []byte) error {
+				t.Errorf("an inactive method classified the error")
+				return nil
+			},
+		},
+		"classifying": {
+			NewHTTPClient: func() (*http.Client, error) {
+				return &http.Client{}, nil
+			},
+			ClassifyError: func(statusCode int, body []byte) error {
+				if statusCode == http.StatusUnauthorized {
+					return rejected
+				}
+				return nil
+			},
+		},
+	})
+
+	if err := ClassifyError(http.StatusUnauthorized, nil); err != nil {
+		t.Errorf("got %v before a method was chosen, expected nil", err)
+	}
+	if _, err := GetAuthenticatedClient(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClassifyError(http.StatusUnauthorized, nil); err != rejected {
+		t.Errorf("got %v, expected the active method's error", err)
+	}
+	if err := ClassifyError(http.StatusForbidden, nil); err != nil {
+		t.Errorf("got %v, expected the response to be left to the caller", err)
+	}
+}
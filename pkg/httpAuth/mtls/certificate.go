@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/netflix/weep/pkg/health"
 	"github.com/netflix/weep/pkg/logging"
 
 	"github.com/netflix/weep/pkg/metadata"
@@ -19,6 +21,7 @@ import (
 
 	"github.com/bep/debounce"
 	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
 )
 
 // wrappedCertificate is a wrapper for a tls.Certificate that supports automatically
@@ -29,10 +32,43 @@ type wrappedCertificate struct {
 	x509Certificate *x509.Certificate
 	certFile        string
 	keyFile         string
+	// reloadError is the error from the last reload, if it failed and the previous certificate is
+	// still in use
+	reloadError error
+	// onReload is called after the certificate is reloaded
+	onReload func()
+	// certState and keyState describe the files as of the last load, to detect replaced files
+	certState fileState
+	keyState  fileState
 }
 
-// newWrappedCertificate initializes and returns a wrappedCertificate that will auto-
-// refresh on cert/key file changes.
+// fileState identifies the contents of a file, following symlinks, so a change can be detected
+// however the file was replaced
+type fileState struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// newWatcher creates the file watcher. It's a variable so tests can simulate a platform without
+// file notifications.
+var newWatcher = fsnotify.NewWatcher
+
+// statFile returns the current state of name. Missing files have an empty state.
+func statFile(name string) fileState {
+	var state fileState
+	if path, err := filepath.EvalSymlinks(name); err == nil {
+		state.path = path
+	}
+	if info, err := os.Stat(name); err == nil {
+		state.size = info.Size()
+		state.modTime = info.ModTime()
+	}
+	return state
+}
+
+// newWrappedCertificate loads and returns a wrappedCertificate. autoRefresh reloads it on
+// cert/key file changes.
 func newWrappedCertificate(certFile, keyFile string) (*wrappedCertificate, error) {
 	logging.Log.WithFields(logrus.Fields{
 		"certFile": certFile,
@@ -43,106 +79,221 @@ func newWrappedCertificate(certFile, keyFile string) (*wrappedCertificate, error
 		certFile: certFile,
 		keyFile:  keyFile,
 	}
-	wc.loadCertificate()
-	go wc.autoRefresh()
-	return &wc, nil
-}
-
-// getCertificate is a function to be used as the GetClientCertificate member of a tls.Config
-func (wc *wrappedCertificate) getCertificate(clientHello *tls.CertificateRequestInfo) (*tls.Certificate, error) {
-	logging.Log.Debug("getCertificate called")
-	wc.RLock()
-	defer wc.RUnlock()
-
-	return wc.certificate, nil
-}
-
-func (wc *wrappedCertificate) watchExpiration() {
-	expiration := wc.x509Certificate.NotAfter
-	if expiration.Before(time.Now()) {
-		// cert is expired, set unhealthy
-	} else if expiration.Before(time.Now().Add(-6 * time.Hour)) {
-		// cert is expiring soon, log warning
+	if err := wc.loadCertificate(); err != nil {
+		return nil, err
 	}
+	return &wc, nil
 }
 
-// loadCertificate replaces certificate with a keypair loaded in from the filesystem.
-func (wc *wrappedCertificate) loadCertificate() {
+// loadCertificate replaces certificate with a keypair loaded in from the filesystem. If the
+// keypair can't be loaded, the current certificate stays in use and the error is reported in
+// weep's health status until a reload succeeds.
+func (wc *wrappedCertificate) loadCertificate() error {
 	logging.Log.Debug("reloading mTLS certificate")
 	wc.Lock()
 	defer wc.Unlock()
-	cert, err := tls.LoadX509KeyPair(wc.certFile, wc.keyFile)
+	// Record the state before loading so a file that changes during the load is loaded again
+	wc.certState = statFile(wc.certFile)
+	wc.keyState = statFile(wc.keyFile)
+	// LoadX509KeyPair checks that the key matches the certificate, so a half-finished rotation
+	// never replaces a working pair
+	cert, x509Cert, err := loadKeyPair(wc.certFile, wc.keyFile)
 	if err != nil {
 		logging.Log.Errorf("could not reload mTLS cert: %v", err)
-		return
+		wc.reloadError = err
+		if wc.certificate != nil {
+			health.WeepStatus.SetDegraded(wc.healthComponent(), fmt.Sprintf("could not reload mTLS certificate %s, using the previous one: %v", wc.certFile, err))
+		}
+		return err
 	}
-	wc.certificate = &cert
-	wc.x509Certificate, err = x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		logging.Log.Errorf("could not parse x509 certificate")
+	wc.certificate = cert
+	wc.x509Certificate = x509Cert
+	if wc.reloadError != nil {
+		health.WeepStatus.ClearDegraded(wc.healthComponent())
+		wc.reloadError = nil
 	}
-	wc.updateInstanceInfo()
+	return nil
 }
 
-func (wc *wrappedCertificate) autoRefresh() {
-	logging.Log.Debug("starting mTLS cert auto-refresher")
+// healthComponent identifies reload errors for this certificate in weep's health status
+func (wc *wrappedCertificate) healthComponent() string {
+	return healthComponent + ":" + wc.certFile
+}
+
+// notAfter returns when the certificate expires
+func (wc *wrappedCertificate) notAfter() time.Time {
+	wc.RLock()
+	defer wc.RUnlock()
+	return wc.x509Certificate.NotAfter
+}
 
-	// create the fsnotify watcher that we'll use to monitor the cert and key files
-	watcher, err := fsnotify.NewWatcher()
+// loadKeyPair loads and parses a certificate and its private key
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, *x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		logging.Log.Errorf("mTLS cert watcher encountered an error: %v", err)
-		return
+		return nil, nil, fmt.Errorf("could not parse x509 certificate: %w", err)
 	}
-	defer watcher.Close()
+	return &cert, x509Cert, nil
+}
 
-	// this channel will block the autoRefresh function from returning until
-	// it's time for the program to exit (i.e. on an OS interrupt)
+// autoRefresh reloads the certificate in the background when its files change, until weep exits
+func (wc *wrappedCertificate) autoRefresh() {
+	// this channel stops the watcher when it's time for the program to exit
+	// (i.e. on an OS interrupt)
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	stop := make(chan struct{})
+	wc.watchFiles(stop)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+}
+
+// watchFiles watches the directories that hold the cert and key files, rather than the files
+// themselves, so certificates rotated by renaming a file or swapping a symlink over the old one
+// are picked up. The files are also checked every mtls_settings.poll_interval seconds, for
+// filesystems that don't support change notifications. The watches are in place when watchFiles
+// returns, and the returned channel is closed once watching has stopped.
+func (wc *wrappedCertificate) watchFiles(stop <-chan struct{}) <-chan struct{} {
+	logging.Log.Debug("starting mTLS cert auto-refresher")
 
 	// fsnotify gives us a buuuunch of events when a refresh is done, so this
 	// is here to cut down on some churn
 	debounced := debounce.New(100 * time.Millisecond)
 
-	// spin off a goroutine to handle fsnotify events
+	// a nil channel is never ready, so without a watcher only polling is done
+	var events <-chan fsnotify.Event
+	var watcherErrors <-chan error
+	watcher, err := newWatcher()
+	if err != nil {
+		logging.Log.Errorf("mTLS cert watcher encountered an error, falling back to polling: %v", err)
+	} else {
+		wc.addWatches(watcher)
+		events, watcherErrors = watcher.Events, watcher.Errors
+	}
+
+	var ticker *time.Ticker
+	var poll <-chan time.Time
+	if interval := viper.GetInt("mtls_settings.poll_interval"); interval > 0 {
+		ticker = time.NewTicker(time.Duration(interval) * time.Second)
+		poll = ticker.C
+	} else if watcher == nil {
+		logging.Log.Warn("mTLS cert polling is disabled, certificate changes will not be loaded")
+	}
+
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+		if ticker != nil {
+			defer ticker.Stop()
+		}
 		for {
 			select {
-			case event, ok := <-watcher.Events:
+			case event, ok := <-events:
 				if !ok {
-					return
+					events = nil
+					continue
 				}
 				logging.Log.Debugf("event received: %v", event)
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					debounced(func() { wc.loadCertificate() })
+				if wc.isFileEvent(event) {
+					debounced(func() {
+						wc.reload()
+						// a swapped symlink may point to a directory that isn't watched yet
+						wc.addWatches(watcher)
+					})
 				}
-			case watcherError, ok := <-watcher.Errors:
+			case watcherError, ok := <-watcherErrors:
 				if !ok {
-					return
+					watcherErrors = nil
+					continue
 				}
 				logging.LogError(watcherError, "problem with mTLS file watcher")
+			case <-poll:
+				if wc.filesChanged() {
+					logging.Log.Debug("mTLS cert files changed")
+					wc.reload()
+				}
+			case <-stop:
+				logging.Log.Debug("stopping mTLS cert auto-refresher")
+				return
 			}
 		}
 	}()
+	return done
+}
 
-	// add cert and key files to the watcher
+// addWatches adds the directories of the cert and key files, and of the files their symlinks
+// point to, to watcher. Adding a directory that is already watched has no effect.
+func (wc *wrappedCertificate) addWatches(watcher *fsnotify.Watcher) {
 	for _, file := range []string{wc.certFile, wc.keyFile} {
-		err = watcher.Add(file)
-		if err != nil {
-			logging.LogError(err, "failed to add file to watcher")
+		dirs := []string{filepath.Dir(file)}
+		if resolved, err := filepath.EvalSymlinks(file); err == nil {
+			dirs = append(dirs, filepath.Dir(resolved))
+		}
+		for _, dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				logging.LogError(err, "failed to add directory to watcher")
+			}
 		}
 	}
+}
+
+// isFileEvent returns whether event may have changed the cert or key file. Other files in the
+// watched directories are ignored unless replacing them replaced one of ours, as with symlinks.
+func (wc *wrappedCertificate) isFileEvent(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	if name == filepath.Clean(wc.certFile) || name == filepath.Clean(wc.keyFile) {
+		return true
+	}
+	return wc.filesChanged()
+}
+
+// filesChanged returns whether the cert or key file has changed since it was last loaded
+func (wc *wrappedCertificate) filesChanged() bool {
+	wc.RLock()
+	defer wc.RUnlock()
+	return statFile(wc.certFile) != wc.certState || statFile(wc.keyFile) != wc.keyState
+}
+
+// reload loads the certificate again and calls onReload if it succeeded
+func (wc *wrappedCertificate) reload() {
+	if wc.loadCertificate() == nil && wc.onReload != nil {
+		wc.onReload()
+	}
+}
 
-	<-interrupt
-	logging.Log.Debug("stopping mTLS cert auto-refresher")
+// Info returns details about the certificate in use
+func (wc *wrappedCertificate) Info() *CertificateInfo {
+	wc.RLock()
+	defer wc.RUnlock()
+	info := newCertificateInfo(wc.x509Certificate, wc.certFile, wc.keyFile, time.Now())
+	if wc.reloadError != nil {
+		info.ReloadError = wc.reloadError.Error()
+	}
+	return info
 }
 
 func (wc *wrappedCertificate) Fingerprint() string {
+	wc.RLock()
+	defer wc.RUnlock()
 	fingerprintBytes := sha256.Sum256(wc.certificate.Certificate[0])
 	return fmt.Sprintf("%x", fingerprintBytes)
 }
 
 func (wc *wrappedCertificate) CreateTime() time.Time {
+	wc.RLock()
+	defer wc.RUnlock()
 	return wc.x509Certificate.NotBefore
 }
 
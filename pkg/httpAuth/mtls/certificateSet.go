@@ -0,0 +1,204 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netflix/weep/pkg/health"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+// healthComponent identifies the mTLS certificates in weep's health status
+const healthComponent = "mtls"
+
+// expirationCheckInterval is how often the certificates' validity is checked. It's a variable so
+// tests can shorten it.
+var expirationCheckInterval = time.Minute
+
+// activeCertificates is the set of certificates used by the mTLS client, for status reporting
+var activeCertificates *certificateSet
+
+// keyPair is the location of a certificate and its private key
+type keyPair struct {
+	certFile string
+	keyFile  string
+}
+
+// certificateSet holds every configured certificate and chooses the one to present to a server.
+// Keeping all of them loaded lets weep keep working while certificates are rotated.
+type certificateSet struct {
+	sync.Mutex
+	certificates []*wrappedCertificate
+	// expirationState is what was last reported about the preferred certificate's validity, so
+	// each warning is logged once
+	expirationState string
+}
+
+// newCertificateSet loads each key pair. Pairs that can't be loaded are skipped, as long as at
+// least one can be.
+func newCertificateSet(pairs []keyPair) (*certificateSet, error) {
+	cs := &certificateSet{}
+	var lastErr error
+	for _, pair := range pairs {
+		wc, err := newWrappedCertificate(pair.certFile, pair.keyFile)
+		if err != nil {
+			logging.Log.Warnf("could not load mTLS certificate %s: %v", pair.certFile, err)
+			lastErr = err
+			continue
+		}
+		cs.certificates = append(cs.certificates, wc)
+	}
+	if len(cs.certificates) == 0 {
+		if lastErr == nil {
+			lastErr = ClientCertificatesNotFoundError
+		}
+		return nil, lastErr
+	}
+	return cs, nil
+}
+
+// watch reloads each certificate when its files change and checks the certificates' validity
+// until weep exits
+func (cs *certificateSet) watch() {
+	for _, wc := range cs.certificates {
+		wc.onReload = func() {
+			cs.checkExpiration(time.Now())
+		}
+		wc.autoRefresh()
+	}
+	go cs.watchExpiration()
+}
+
+// getCertificate is a function to be used as the GetClientCertificate member of a tls.Config
+func (cs *certificateSet) getCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	logging.Log.Debug("getCertificate called")
+	wc := cs.choose(cri, time.Now())
+	wc.updateInstanceInfo()
+	wc.RLock()
+	defer wc.RUnlock()
+	return wc.certificate, nil
+}
+
+// choose returns the currently valid certificate that the server accepts, preferring the one that
+// expires last. The server accepts a certificate when its issuer is one of the CAs in the request,
+// or when the request doesn't list any. If no certificate fits, the one that expires last is
+// returned and the server decides. A nil request chooses among every valid certificate.
+func (cs *certificateSet) choose(cri *tls.CertificateRequestInfo, now time.Time) *wrappedCertificate {
+	var accepted, latest *wrappedCertificate
+	for _, wc := range cs.certificates {
+		wc.RLock()
+		cert, x509Cert := wc.certificate, wc.x509Certificate
+		wc.RUnlock()
+		if latest == nil || x509Cert.NotAfter.After(latest.notAfter()) {
+			latest = wc
+		}
+		if now.Before(x509Cert.NotBefore) || now.After(x509Cert.NotAfter) {
+			continue
+		}
+		if cri != nil && cri.SupportsCertificate(cert) != nil {
+			continue
+		}
+		if accepted == nil || x509Cert.NotAfter.After(accepted.notAfter()) {
+			accepted = wc
+		}
+	}
+	if accepted != nil {
+		return accepted
+	}
+	return latest
+}
+
+// watchExpiration checks the certificates' validity period until weep exits
+func (cs *certificateSet) watchExpiration() {
+	ticker := time.NewTicker(expirationCheckInterval)
+	defer ticker.Stop()
+	for {
+		cs.checkExpiration(time.Now())
+		<-ticker.C
+	}
+}
+
+// checkExpiration marks weep unhealthy when no certificate is currently valid, and logs a warning
+// and marks it degraded when the certificate that expires last does so within
+// mtls_settings.expiry_warning seconds
+func (cs *certificateSet) checkExpiration(now time.Time) {
+	cs.Lock()
+	defer cs.Unlock()
+	wc := cs.choose(nil, now)
+	wc.RLock()
+	cert, certFile := wc.x509Certificate, wc.certFile
+	wc.RUnlock()
+	warnBefore := time.Duration(viper.GetInt("mtls_settings.expiry_warning")) * time.Second
+	previous := cs.expirationState
+	switch {
+	case now.After(cert.NotAfter):
+		cs.expirationState = "expired"
+		health.WeepStatus.ClearDegraded(healthComponent)
+		reason := fmt.Sprintf("mTLS certificate %s expired at %s", certFile, cert.NotAfter.Format(time.RFC3339))
+		health.WeepStatus.SetUnhealthy(reason)
+		if previous != cs.expirationState {
+			logging.Log.Error(reason)
+		}
+	case now.Before(cert.NotBefore):
+		cs.expirationState = "not_yet_valid"
+		health.WeepStatus.ClearDegraded(healthComponent)
+		reason := fmt.Sprintf("mTLS certificate %s is not valid until %s", certFile, cert.NotBefore.Format(time.RFC3339))
+		health.WeepStatus.SetUnhealthy(reason)
+		if previous != cs.expirationState {
+			logging.Log.Error(reason)
+		}
+	case cert.NotAfter.Sub(now) < warnBefore:
+		cs.expirationState = "expiring"
+		reason := fmt.Sprintf("mTLS certificate %s expires in %s", certFile, cert.NotAfter.Sub(now).Round(time.Minute))
+		clearUnhealthy(previous)
+		health.WeepStatus.SetDegraded(healthComponent, reason)
+		if previous != cs.expirationState {
+			logging.Log.Warn(reason)
+		}
+	default:
+		cs.expirationState = "valid"
+		clearUnhealthy(previous)
+		health.WeepStatus.ClearDegraded(healthComponent)
+	}
+}
+
+// clearUnhealthy restores weep's health if the certificates were the reason it was unhealthy
+func clearUnhealthy(previous string) {
+	if previous == "expired" || previous == "not_yet_valid" {
+		health.WeepStatus.SetHealthy()
+	}
+}
+
+// Info returns details about each certificate, marking the one presented to servers that accept
+// any of them
+func (cs *certificateSet) Info() []*CertificateInfo {
+	now := time.Now()
+	preferred := cs.choose(nil, now)
+	var infos []*CertificateInfo
+	for _, wc := range cs.certificates {
+		info := wc.Info()
+		info.Preferred = wc == preferred
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,372 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/weep/pkg/health"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// writeTestCertificate writes a self-signed certificate for name valid from notBefore to notAfter,
+// and its key, to dir
+func writeTestCertificate(t *testing.T, dir, name string, notBefore, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: name, Organization: []string{"Netflix"}},
+		DNSNames:       []string{"weep.example.com"},
+		EmailAddresses: []string{"user@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/weep"}},
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func resetTestHealth(t *testing.T) {
+	t.Cleanup(func() {
+		health.WeepStatus.SetHealthy()
+		health.WeepStatus.ClearDegraded(healthComponent)
+	})
+}
+
+func TestNewWrappedCertificateMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newWrappedCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Errorf("expected an error for missing certificate files")
+	}
+	if _, err := newCertificateSet([]keyPair{{filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")}}); err == nil {
+		t.Errorf("expected an error when no certificate can be loaded")
+	}
+}
+
+func TestCheckExpiration(t *testing.T) {
+	resetTestHealth(t)
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "current", now.Add(-24*time.Hour), now.Add(24*time.Hour))
+	// An older certificate that expires first doesn't affect the health status
+	oldCertFile, oldKeyFile := writeTestCertificate(t, dir, "old", now.Add(-48*time.Hour), now.Add(time.Hour))
+	cs, err := newCertificateSet([]keyPair{{oldCertFile, oldKeyFile}, {certFile, keyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Description      string
+		Now              time.Time
+		ExpectedHealthy  bool
+		ExpectedDegraded bool
+		ExpectedReason   string
+	}{
+		{Description: "valid", Now: now, ExpectedHealthy: true},
+		{Description: "expiring", Now: now.Add(20 * time.Hour), ExpectedHealthy: true, ExpectedDegraded: true, ExpectedReason: "expires in 4h0m"},
+		{Description: "expired", Now: now.Add(25 * time.Hour), ExpectedReason: "expired at"},
+		{Description: "not yet valid", Now: now.Add(-49 * time.Hour), ExpectedReason: "is not valid until"},
+		{Description: "valid again", Now: now, ExpectedHealthy: true},
+	}
+	for _, tc := range cases {
+		cs.checkExpiration(tc.Now)
+		healthy, reason := health.WeepStatus.Get()
+		degraded, _ := health.WeepStatus.Degraded()
+		if healthy != tc.ExpectedHealthy || degraded != tc.ExpectedDegraded || !strings.Contains(reason, tc.ExpectedReason) {
+			t.Errorf("%s: got healthy %v, degraded %v, reason %q", tc.Description, healthy, degraded, reason)
+		}
+	}
+}
+
+func TestLoadCertificateKeepsPreviousOnFailure(t *testing.T) {
+	resetTestHealth(t)
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, dir, "weep-test", now.Add(-time.Hour), now.Add(24*time.Hour))
+	wc := &wrappedCertificate{certFile: certFile, keyFile: keyFile}
+	if err := wc.loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := wc.Fingerprint()
+
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.loadCertificate(); err == nil {
+		t.Fatal("expected an error reloading an invalid certificate")
+	}
+	if wc.Fingerprint() != fingerprint {
+		t.Errorf("expected the previous certificate to stay in use")
+	}
+	if degraded, reason := health.WeepStatus.Degraded(); !degraded || !strings.Contains(reason, "could not reload") {
+		t.Errorf("got degraded %v (%s) after a failed reload", degraded, reason)
+	}
+	if info := wc.Info(); info.ReloadError == "" {
+		t.Errorf("expected the reload error in the certificate info")
+	}
+
+	writeTestCertificate(t, dir, "weep-test", now.Add(-time.Hour), now.Add(48*time.Hour))
+	if err := wc.loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if degraded, reason := health.WeepStatus.Degraded(); degraded {
+		t.Errorf("got degraded (%s) after a successful reload", reason)
+	}
+}
+
+func TestCertificateInfo(t *testing.T) {
+	// Certificate validity is stored with second precision
+	now := time.Now().Truncate(time.Second)
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "weep-test", now.Add(-2*time.Hour), now.Add(3*time.Hour))
+	_, cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := newCertificateInfo(cert, certFile, keyFile, now)
+	expectedSANs := []string{"DNS:weep.example.com", "email:user@example.com", "IP:127.0.0.1", "URI:spiffe://example.com/weep"}
+	if !reflect.DeepEqual(info.SANs, expectedSANs) {
+		t.Errorf("got SANs %v, expected %v", info.SANs, expectedSANs)
+	}
+	if info.Subject != "CN=weep-test,O=Netflix" || info.Issuer != info.Subject || info.SerialNumber != "2a" {
+		t.Errorf("got subject %q, issuer %q, serial %q", info.Subject, info.Issuer, info.SerialNumber)
+	}
+	if info.AgeSeconds != 7200 || info.RemainingSeconds != 10800 || info.Expired() {
+		t.Errorf("got age %d, remaining %d", info.AgeSeconds, info.RemainingSeconds)
+	}
+	if len(info.FingerprintSHA256) != 64 {
+		t.Errorf("got fingerprint %q", info.FingerprintSHA256)
+	}
+}
+
+func TestChooseCertificate(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	var pairs []keyPair
+	for _, c := range []struct {
+		Name      string
+		NotBefore time.Time
+		NotAfter  time.Time
+	}{
+		{"old", now.Add(-48 * time.Hour), now.Add(24 * time.Hour)},
+		{"new", now.Add(-time.Hour), now.Add(72 * time.Hour)},
+		{"future", now.Add(time.Hour), now.Add(96 * time.Hour)},
+	} {
+		certFile, keyFile := writeTestCertificate(t, dir, c.Name, c.NotBefore, c.NotAfter)
+		pairs = append(pairs, keyPair{certFile, keyFile})
+	}
+	cs, err := newCertificateSet(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := func(i int) []byte {
+		return cs.certificates[i].x509Certificate.RawIssuer
+	}
+
+	cases := []struct {
+		Description   string
+		AcceptableCAs [][]byte
+		Now           time.Time
+		Expected      string
+	}{
+		{Description: "any CA", Expected: "new.pem"},
+		{Description: "old CA", AcceptableCAs: [][]byte{issuer(0)}, Expected: "old.pem"},
+		{Description: "both CAs", AcceptableCAs: [][]byte{issuer(0), issuer(1)}, Expected: "new.pem"},
+		{Description: "certificate not valid yet", AcceptableCAs: [][]byte{issuer(2)}, Expected: "future.pem"},
+		{Description: "unknown CA", AcceptableCAs: [][]byte{[]byte("unknown")}, Expected: "future.pem"},
+		{Description: "old certificate expired", AcceptableCAs: [][]byte{issuer(0)}, Now: now.Add(48 * time.Hour), Expected: "future.pem"},
+	}
+	for _, tc := range cases {
+		cri := &tls.CertificateRequestInfo{
+			AcceptableCAs:    tc.AcceptableCAs,
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			Version:          tls.VersionTLS13,
+		}
+		checkTime := tc.Now
+		if checkTime.IsZero() {
+			checkTime = now
+		}
+		if got := filepath.Base(cs.choose(cri, checkTime).certFile); got != tc.Expected {
+			t.Errorf("%s: got %s, expected %s", tc.Description, got, tc.Expected)
+		}
+	}
+
+	infos := cs.Info()
+	if len(infos) != 3 || infos[0].Preferred || !infos[1].Preferred || infos[2].Preferred {
+		t.Errorf("expected only the newest valid certificate to be preferred")
+	}
+}
+
+func TestGetClientCertificatePairs(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	oldCert, oldKey := writeTestCertificate(t, dir, "old", now.Add(-time.Hour), now.Add(time.Hour))
+	newCert, newKey := writeTestCertificate(t, dir, "new", now.Add(-time.Hour), now.Add(2*time.Hour))
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("mtls_settings.certs", []string{"old.pem", newCert, "missing.pem"})
+	viper.Set("mtls_settings.keys", []string{newKey, "old-key.pem"})
+	viper.Set("mtls_settings.catrust", "ca.pem")
+	t.Cleanup(func() {
+		viper.Set("mtls_settings.certs", nil)
+		viper.Set("mtls_settings.keys", nil)
+		viper.Set("mtls_settings.catrust", nil)
+	})
+
+	pairs, caFiles, _, err := getClientCertificatePairs([]string{t.TempDir(), dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []keyPair{{oldCert, oldKey}, {newCert, newKey}}
+	if !reflect.DeepEqual(pairs, expected) || !reflect.DeepEqual(caFiles, []string{caFile}) {
+		t.Errorf("got pairs %v and CAs %v, expected %v and %s", pairs, caFiles, expected, caFile)
+	}
+
+	viper.Set("mtls_settings.keys", []string{"unrelated.pem"})
+	if _, _, _, err := getClientCertificatePairs([]string{dir}); err == nil {
+		t.Errorf("expected an error when no key matches a certificate")
+	}
+}
+
+// waitForFingerprint waits for wc to load a certificate with a different fingerprint than previous
+func waitForFingerprint(t *testing.T, wc *wrappedCertificate, previous string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if wc.Fingerprint() != previous {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("certificate was not reloaded")
+}
+
+// startWatching loads the certificate and watches its files until the test ends
+func startWatching(t *testing.T, certFile, keyFile string) *wrappedCertificate {
+	wc, err := newWrappedCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := wc.watchFiles(stop)
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return wc
+}
+
+func TestWatchFilesRename(t *testing.T) {
+	resetTestHealth(t)
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, dir, "weep-test", now.Add(-time.Hour), now.Add(time.Hour))
+	wc := startWatching(t, certFile, keyFile)
+	fingerprint := wc.Fingerprint()
+
+	newCert, newKey := writeTestCertificate(t, t.TempDir(), "weep-test", now.Add(-time.Hour), now.Add(2*time.Hour))
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	// The new certificate doesn't match the old key, so the old pair stays in use
+	if err := wc.loadCertificate(); err == nil || wc.Fingerprint() != fingerprint {
+		t.Errorf("expected a certificate without its key to be rejected")
+	}
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	waitForFingerprint(t, wc, fingerprint)
+	if degraded, reason := health.WeepStatus.Degraded(); degraded {
+		t.Errorf("got degraded (%s) after a successful rotation", reason)
+	}
+}
+
+func TestWatchFilesSymlinkSwap(t *testing.T) {
+	// Lay out the files the way Kubernetes secret volumes do
+	dir := t.TempDir()
+	now := time.Now()
+	if err := os.Mkdir(filepath.Join(dir, "..v1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, filepath.Join(dir, "..v1"), "weep-test", now.Add(-time.Hour), now.Add(time.Hour))
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "weep-test.pem"), filepath.Join(dir, "weep-test-key.pem")
+	for _, name := range []string{"weep-test.pem", "weep-test-key.pem"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wc := startWatching(t, certFile, keyFile)
+	fingerprint := wc.Fingerprint()
+
+	if err := os.Mkdir(filepath.Join(dir, "..v2"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, filepath.Join(dir, "..v2"), "weep-test", now.Add(-time.Hour), now.Add(2*time.Hour))
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitForFingerprint(t, wc, fingerprint)
+}
+
+func TestWatchFilesPolling(t *testing.T) {
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		return nil, errors.New("not supported")
+	}
+	viper.Set("mtls_settings.poll_interval", 1)
+	t.Cleanup(func() {
+		newWatcher = fsnotify.NewWatcher
+		viper.Set("mtls_settings.poll_interval", nil)
+	})
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, dir, "weep-test", now.Add(-time.Hour), now.Add(time.Hour))
+	wc := startWatching(t, certFile, keyFile)
+	fingerprint := wc.Fingerprint()
+	if wc.filesChanged() {
+		t.Errorf("expected unchanged files")
+	}
+
+	writeTestCertificate(t, dir, "weep-test", now.Add(-time.Hour), now.Add(2*time.Hour))
+	waitForFingerprint(t, wc, fingerprint)
+}
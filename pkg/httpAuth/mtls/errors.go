@@ -23,5 +23,10 @@ func (e Error) Error() string { return string(e) }
 const ClientCertificatesNotFoundError = Error("could not find client certificates")
 const EmbeddedConfigDisabledError = Error("embedded config is disabled")
 const HomeDirectoryError = Error("could not resolve user's home directory")
+const InvalidCABundleError = Error("CA bundle contains no PEM certificates")
+const InvalidPinError = Error("invalid mtls_settings.spki_pins entry")
+const MissingServerCertificateError = Error("server did not present a certificate")
 const MissingTLSConfigError = Error("missing required mTLS configuration")
+const PinMismatchError = Error("server public key does not match any of mtls_settings.spki_pins")
 const UnsupportedOSError = Error("running on unsupported operating system")
+const UntrustedServerCertificateError = Error("server certificate is not trusted")
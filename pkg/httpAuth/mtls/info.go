@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtls
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// CertificateInfo describes an mTLS client certificate
+type CertificateInfo struct {
+	CertFile          string    `json:"cert_file" yaml:"cert_file"`
+	KeyFile           string    `json:"key_file" yaml:"key_file"`
+	Subject           string    `json:"subject" yaml:"subject"`
+	Issuer            string    `json:"issuer" yaml:"issuer"`
+	SANs              []string  `json:"sans,omitempty" yaml:"sans,omitempty"`
+	SerialNumber      string    `json:"serial_number" yaml:"serial_number"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256" yaml:"fingerprint_sha256"`
+	NotBefore         time.Time `json:"not_before" yaml:"not_before"`
+	NotAfter          time.Time `json:"not_after" yaml:"not_after"`
+	AgeSeconds        int       `json:"age_seconds" yaml:"age_seconds"`
+	RemainingSeconds  int       `json:"remaining_seconds" yaml:"remaining_seconds"`
+	ReloadError       string    `json:"reload_error,omitempty" yaml:"reload_error,omitempty"`
+	// Preferred is set on the certificate presented to servers that accept any of them
+	Preferred bool `json:"preferred" yaml:"preferred"`
+}
+
+func newCertificateInfo(cert *x509.Certificate, certFile, keyFile string, now time.Time) *CertificateInfo {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return &CertificateInfo{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SANs:              sans,
+		SerialNumber:      fmt.Sprintf("%x", cert.SerialNumber),
+		FingerprintSHA256: fmt.Sprintf("%x", sha256.Sum256(cert.Raw)),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		AgeSeconds:        int(now.Sub(cert.NotBefore).Seconds()),
+		RemainingSeconds:  int(cert.NotAfter.Sub(now).Seconds()),
+	}
+}
+
+// Expired returns whether the certificate is outside its validity period
+func (i *CertificateInfo) Expired() bool {
+	return i.RemainingSeconds < 0 || i.AgeSeconds < 0
+}
+
+// Status returns details about the certificates used by the mTLS client, or nil if mTLS isn't in use
+func Status() []*CertificateInfo {
+	if activeCertificates == nil {
+		return nil
+	}
+	return activeCertificates.Info()
+}
+
+// LoadCertificateInfo finds the configured certificates and keys and returns details about each
+// certificate, without setting up a client
+func LoadCertificateInfo() ([]*CertificateInfo, error) {
+	dirs, err := getTLSDirs()
+	if err != nil {
+		return nil, err
+	}
+	pairs, _, _, err := getClientCertificatePairs(dirs)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := newCertificateSet(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return certificates.Info(), nil
+}
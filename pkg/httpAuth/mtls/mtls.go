@@ -18,14 +18,13 @@ package mtls
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/netflix/weep/pkg/logging"
 
 	"github.com/netflix/weep/pkg/config"
+	"github.com/netflix/weep/pkg/httpAuth/transport"
 	"github.com/netflix/weep/pkg/util"
 
 	"github.com/spf13/viper"
@@ -33,6 +32,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 )
@@ -44,8 +44,9 @@ func init() {
 		var err error
 		tlsConfig, err = getTLSConfig()
 		if err != nil {
+			// NewHTTPClient tries again and returns the error, so another authentication method
+			// can be used
 			logging.Log.Errorf("could not initialize mtls: %v", err)
-			tlsConfig = &tls.Config{}
 		}
 	}
 }
@@ -59,64 +60,43 @@ func getTLSConfig() (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	certFile, keyFile, caFile, insecure, err := getClientCertificatePaths(dirs)
+	pairs, caFiles, insecure, err := getClientCertificatePairs(dirs)
 	if err != nil {
 		return nil, err
 	}
-	tlsConfig, err = makeTLSConfig(certFile, keyFile, caFile, insecure)
+	// The extra CA bundles for every authentication method are trusted too
+	caFiles = append(caFiles, transport.CABundles()...)
+	tlsConfig, err = makeTLSConfig(pairs, caFiles, insecure)
 	if err != nil {
 		return nil, err
 	}
 	return tlsConfig, nil
 }
 
-func makeTLSConfig(certFile, keyFile, caFile string, insecure bool) (*tls.Config, error) {
-	if certFile == "" || keyFile == "" || caFile == "" {
+func makeTLSConfig(pairs []keyPair, caFiles []string, insecure bool) (*tls.Config, error) {
+	if len(pairs) == 0 || len(caFiles) == 0 {
 		logging.LogError(fmt.Errorf("mTLS cert, key, or CA file not defined in configuration"), "mTLS could not be initialized")
 		return nil, MissingTLSConfigError
 	}
-	caCert, _ := ioutil.ReadFile(caFile)
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if insecure {
+		logging.Log.Warn("mTLS server hostname verification is disabled by mtls_settings.insecure")
+	}
+	verifier, err := newServerVerifier(caFiles, insecure)
+	if err != nil {
+		return nil, err
+	}
 
-	wrappedCert, err := newWrappedCertificate(certFile, keyFile)
+	certificates, err := newCertificateSet(pairs)
 	if err != nil {
 		return nil, err
 	}
+	certificates.choose(nil, time.Now()).updateInstanceInfo()
+	certificates.watch()
+	activeCertificates = certificates
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify:   insecure,
-		RootCAs:              caCertPool,
-		GetClientCertificate: wrappedCert.getCertificate,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			// Based on the golang verification code. See https://golang.org/src/crypto/tls/handshake_client.go
-			certs := make([]*x509.Certificate, len(rawCerts))
-			for i, asn1Data := range rawCerts {
-				cert, err := x509.ParseCertificate(asn1Data)
-				if err != nil {
-					return fmt.Errorf("tls: failed to parse certificate from server: %w", err)
-				}
-				certs[i] = cert
-			}
-
-			opts := x509.VerifyOptions{
-				Roots:         caCertPool,
-				DNSName:       "",
-				Intermediates: x509.NewCertPool(),
-			}
-
-			for i, cert := range certs {
-				if i == 0 {
-					continue
-				}
-				opts.Intermediates.AddCert(cert)
-			}
-			verifiedChains, err := certs[0].Verify(opts)
-			if err != nil {
-				return err
-			}
-			return nil
-		},
+		GetClientCertificate: certificates.getCertificate,
 	}
+	verifier.configure(tlsConfig)
 	return tlsConfig, nil
 }
 
@@ -126,13 +106,11 @@ func NewHTTPClient() (*http.Client, error) {
 		return nil, err
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
+	t, err := transport.New(tlsConfig)
+	if err != nil {
+		return nil, err
 	}
-
-	return client, nil
+	return &http.Client{Transport: t}, nil
 }
 
 // getTLSDirs returns a list of directories to search for mTLS certs based on platform
@@ -152,59 +130,78 @@ func getTLSDirs() ([]string, error) {
 	return mtlsDirs, nil
 }
 
-func getClientCertificatePaths(configDirs []string) (string, string, string, bool, error) {
+// getClientCertificatePairs returns every configured certificate with the key that matches it,
+// and the CA bundles. Each file is used as-is if it exists, otherwise the first match in the list
+// of dirs from the config is used.
+func getClientCertificatePairs(configDirs []string) ([]keyPair, []string, bool, error) {
 	certs := viper.GetStringSlice("mtls_settings.certs")
-	if certs == nil {
-		certs = make([]string, 0)
-	}
 	// Backward compatibility, still allow the old key
-	cert := viper.GetString("mtls_settings.cert")
-	if cert != "" {
+	if cert := viper.GetString("mtls_settings.cert"); cert != "" {
 		certs = append(certs, cert)
 	}
 	keys := viper.GetStringSlice("mtls_settings.keys")
-	if keys == nil {
-		keys = make([]string, 0)
-	}
 	// Backward compatibility, still allow the old key
-	key := viper.GetString("mtls_settings.key")
-	if key != "" {
+	if key := viper.GetString("mtls_settings.key"); key != "" {
 		keys = append(keys, key)
 	}
-	caFile := viper.GetString("mtls_settings.catrust")
 	insecure := viper.GetBool("mtls_settings.insecure")
 
-	for _, cert := range certs {
-		for _, key := range keys {
-			// If cert, key, and catrust are paths that exist, we'll just use those
-			if util.FileExists(cert) && util.FileExists(key) && util.FileExists(caFile) {
-				return cert, key, caFile, insecure, nil
+	caTrusts := viper.GetStringSlice("mtls_settings.catrusts")
+	// Backward compatibility, still allow the old key
+	if caTrust := viper.GetString("mtls_settings.catrust"); caTrust != "" {
+		caTrusts = append(caTrusts, caTrust)
+	}
+	caFiles := findFiles(caTrusts, configDirs)
+	if len(caFiles) == 0 {
+		return nil, nil, false, config.ClientCertificatesNotFoundError
+	}
+	certPaths := findFiles(certs, configDirs)
+	keyPaths := findFiles(keys, configDirs)
+
+	var pairs []keyPair
+	for _, certPath := range certPaths {
+		for _, keyPath := range keyPaths {
+			if _, _, err := loadKeyPair(certPath, keyPath); err == nil {
+				pairs = append(pairs, keyPair{certFile: certPath, keyFile: keyPath})
+				break
 			}
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, nil, false, config.ClientCertificatesNotFoundError
+	}
+	return pairs, caFiles, insecure, nil
+}
 
-			var foundCertPath, foundKeyPath, foundCaPath string
-			// Otherwise, look for the files in the list of dirs from the config
-			for _, metatronDir := range configDirs {
-				certPath := filepath.Join(metatronDir, cert)
-				if foundCertPath == "" && util.FileExists(certPath) {
-					foundCertPath = certPath
-				}
-
-				keyPath := filepath.Join(metatronDir, key)
-				if foundKeyPath == "" && util.FileExists(keyPath) {
-					foundKeyPath = keyPath
-				}
-
-				caPath := filepath.Join(metatronDir, caFile)
-				if foundCaPath == "" && util.FileExists(caPath) {
-					foundCaPath = caPath
-				}
-			}
+// findFiles returns the path of each file that can be found, without duplicates
+func findFiles(names []string, configDirs []string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		path := findFile(name, configDirs)
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths
+}
 
-			if foundCertPath != "" && foundKeyPath != "" && foundCaPath != "" {
-				// We have all the files we need!
-				return foundCertPath, foundKeyPath, foundCaPath, insecure, nil
-			}
+// findFile returns name if it exists, otherwise the first dir from the config that contains it,
+// or an empty string if it can't be found
+func findFile(name string, configDirs []string) string {
+	if name == "" {
+		return ""
+	}
+	if util.FileExists(name) {
+		return name
+	}
+	for _, dir := range configDirs {
+		path := filepath.Join(dir, name)
+		if util.FileExists(path) {
+			return path
 		}
 	}
-	return "", "", "", false, config.ClientCertificatesNotFoundError
+	return ""
 }
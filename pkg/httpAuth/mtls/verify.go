@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// pinPrefix is the optional prefix of SPKI pins, as used by HTTP Public Key Pinning
+const pinPrefix = "sha256/"
+
+// serverVerifier checks the identity of the servers weep connects to with mTLS: their certificate
+// chains against the configured CA bundles, their hostnames against the host being dialled, and
+// optionally their public keys against a list of pins.
+type serverVerifier struct {
+	roots   *x509.CertPool
+	caFiles []string
+	// serverName overrides the hostname that certificates are checked against
+	serverName string
+	// pins holds the base64-encoded SHA-256 hashes of the allowed SubjectPublicKeyInfos
+	pins map[string]bool
+	// skipHostname turns off hostname verification, for servers whose certificate doesn't name
+	// the host they're reached at
+	skipHostname bool
+}
+
+// newServerVerifier loads the CA bundles and reads the hostname override and pins from
+// mtls_settings.server_name and mtls_settings.spki_pins
+func newServerVerifier(caFiles []string, skipHostname bool) (*serverVerifier, error) {
+	v := &serverVerifier{
+		roots:        x509.NewCertPool(),
+		caFiles:      caFiles,
+		serverName:   viper.GetString("mtls_settings.server_name"),
+		skipHostname: skipHostname,
+		pins:         make(map[string]bool),
+	}
+	for _, caFile := range caFiles {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle %s: %w", caFile, err)
+		}
+		if !v.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", InvalidCABundleError, caFile)
+		}
+	}
+
+	for _, pin := range viper.GetStringSlice("mtls_settings.spki_pins") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix)
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%w: %q is not a base64-encoded SHA-256 hash", InvalidPinError, pin)
+		}
+		v.pins[pin] = true
+	}
+	return v, nil
+}
+
+// configure sets up c to verify servers. The standard verification checks the chain and the
+// hostname, which is the host being dialled unless mtls_settings.server_name overrides it. When
+// the hostname check is skipped, verifyConnection checks the chain itself.
+func (v *serverVerifier) configure(c *tls.Config) {
+	c.RootCAs = v.roots
+	c.ServerName = v.serverName
+	c.InsecureSkipVerify = v.skipHostname
+	c.VerifyConnection = v.verifyConnection
+}
+
+// verifyConnection is a function to be used as the VerifyConnection member of a tls.Config. It
+// checks the pins, and the certificate chain if the standard verification is turned off.
+func (v *serverVerifier) verifyConnection(cs tls.ConnectionState) error {
+	chains := cs.VerifiedChains
+	if v.skipHostname {
+		var err error
+		if chains, err = v.verifyChain(cs.PeerCertificates); err != nil {
+			return err
+		}
+	}
+	if len(v.pins) > 0 {
+		return v.verifyPins(chains)
+	}
+	return nil
+}
+
+// verifyChain checks the server's certificate chain against the CA bundles without checking its
+// hostname. Based on the golang verification code. See https://golang.org/src/crypto/tls/handshake_client.go
+func (v *serverVerifier) verifyChain(certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, MissingServerCertificateError
+	}
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%w by %s: %v", UntrustedServerCertificateError, strings.Join(v.caFiles, ", "), err)
+	}
+	return chains, nil
+}
+
+// verifyPins checks that a public key in one of the verified chains is pinned
+func (v *serverVerifier) verifyPins(chains [][]*x509.Certificate) error {
+	var presented []string
+	seen := make(map[string]bool)
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := spkiPin(cert)
+			if v.pins[pin] {
+				return nil
+			}
+			if !seen[pin] {
+				seen[pin] = true
+				presented = append(presented, pinPrefix+pin)
+			}
+		}
+	}
+	return fmt.Errorf("%w, the server's chain has %s", PinMismatchError, strings.Join(presented, ", "))
+}
+
+// spkiPin returns the base64-encoded SHA-256 hash of the certificate's SubjectPublicKeyInfo
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
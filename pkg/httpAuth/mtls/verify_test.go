@@ -0,0 +1,181 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// testCA is a certificate authority that issues test server certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue returns a server certificate for hosts signed by the CA
+func (ca *testCA) issue(t *testing.T, hosts ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func setTestServerIdentity(t *testing.T, serverName string, pins []string) {
+	viper.Set("mtls_settings.server_name", serverName)
+	viper.Set("mtls_settings.spki_pins", pins)
+	t.Cleanup(func() {
+		viper.Set("mtls_settings.server_name", nil)
+		viper.Set("mtls_settings.spki_pins", nil)
+	})
+}
+
+func TestServerVerifierHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	otherCA := newTestCA(t, dir, "other-ca")
+	localhost := ca.issue(t, "localhost")
+	consoleMe := ca.issue(t, "consoleme.example.com")
+	caPin := pinPrefix + spkiPin(ca.cert)
+	otherPin := pinPrefix + spkiPin(otherCA.cert)
+	var hostnameError x509.HostnameError
+	var unknownAuthorityError x509.UnknownAuthorityError
+
+	cases := []struct {
+		Description   string
+		Cert          tls.Certificate
+		CAFiles       []string
+		ServerName    string
+		Pins          []string
+		SkipHostname  bool
+		ExpectedError error
+		ExpectedAs    interface{}
+		ExpectedText  string
+	}{
+		// consoleme_url isn't involved, so the same configuration works for SWAG
+		{Description: "dialled hostname", Cert: localhost, CAFiles: []string{ca.file}},
+		{Description: "trusted by the second bundle", Cert: localhost, CAFiles: []string{otherCA.file, ca.file}},
+		{Description: "untrusted", Cert: localhost, CAFiles: []string{otherCA.file}, ExpectedAs: &unknownAuthorityError},
+		{Description: "wrong hostname", Cert: consoleMe, CAFiles: []string{ca.file}, ExpectedAs: &hostnameError},
+		{Description: "server name override", Cert: consoleMe, CAFiles: []string{ca.file}, ServerName: "consoleme.example.com"},
+		{Description: "wrong server name override", Cert: localhost, CAFiles: []string{ca.file}, ServerName: "consoleme.example.com", ExpectedAs: &hostnameError},
+		{Description: "hostname check skipped", Cert: consoleMe, CAFiles: []string{ca.file}, SkipHostname: true},
+		{Description: "untrusted with hostname check skipped", Cert: consoleMe, CAFiles: []string{otherCA.file}, SkipHostname: true, ExpectedError: UntrustedServerCertificateError, ExpectedText: "other-ca.pem"},
+		{Description: "pinned CA", Cert: localhost, CAFiles: []string{ca.file}, Pins: []string{otherPin, caPin}},
+		{Description: "pin without prefix", Cert: localhost, CAFiles: []string{ca.file}, Pins: []string{strings.TrimPrefix(caPin, pinPrefix)}},
+		{Description: "pin mismatch", Cert: localhost, CAFiles: []string{ca.file}, Pins: []string{otherPin}, ExpectedError: PinMismatchError, ExpectedText: caPin},
+		{Description: "pin mismatch with hostname check skipped", Cert: consoleMe, CAFiles: []string{ca.file}, Pins: []string{otherPin}, SkipHostname: true, ExpectedError: PinMismatchError},
+	}
+	for _, tc := range cases {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{tc.Cert}}
+		server.StartTLS()
+		setTestServerIdentity(t, tc.ServerName, tc.Pins)
+		v, err := newServerVerifier(tc.CAFiles, tc.SkipHostname)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Description, err)
+		}
+		tlsConfig := &tls.Config{}
+		v.configure(tlsConfig)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+		if err == nil {
+			resp.Body.Close()
+		}
+		server.Close()
+		switch {
+		case tc.ExpectedAs != nil:
+			if !errors.As(err, tc.ExpectedAs) {
+				t.Errorf("%s: got error %v, expected %T", tc.Description, err, tc.ExpectedAs)
+			}
+		case !errors.Is(err, tc.ExpectedError) || (err != nil && !strings.Contains(err.Error(), tc.ExpectedText)):
+			t.Errorf("%s: got error %v, expected %v", tc.Description, err, tc.ExpectedError)
+		}
+	}
+}
+
+func TestVerifyConnectionWithoutCertificate(t *testing.T) {
+	setTestServerIdentity(t, "", nil)
+	v, err := newServerVerifier(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verifyConnection(tls.ConnectionState{}); err != MissingServerCertificateError {
+		t.Errorf("got %v, expected %v", err, MissingServerCertificateError)
+	}
+}
+
+func TestNewServerVerifierErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no certificates here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestServerIdentity(t, "", nil)
+	if _, err := newServerVerifier([]string{ca.file, empty}, false); !errors.Is(err, InvalidCABundleError) {
+		t.Errorf("got %v for a bundle without certificates, expected %v", err, InvalidCABundleError)
+	}
+	setTestServerIdentity(t, "", []string{"sha256/bm90IGEgaGFzaA=="})
+	if _, err := newServerVerifier([]string{ca.file}, false); !errors.Is(err, InvalidPinError) {
+		t.Errorf("got %v for an invalid pin, expected %v", err, InvalidPinError)
+	}
+}
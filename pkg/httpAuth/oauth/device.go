@@ -0,0 +1,141 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/netflix/weep/pkg/logging"
+)
+
+// deviceCodeGrantType is the grant type for device access token requests, from RFC 8628 section 3.4
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+var (
+	// defaultPollInterval is used when the identity provider doesn't send an interval
+	defaultPollInterval = 5 * time.Second
+	// slowDownIncrement is added to the poll interval for every slow_down response
+	slowDownIncrement = 5 * time.Second
+	// intervalUnit is the unit of the interval and expires_in values sent by the identity provider
+	intervalUnit = time.Second
+)
+
+// deviceAuthorizationResponse is described in RFC 8628 section 3.2
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+	ErrorCode               string `json:"error"`
+	ErrorDescription        string `json:"error_description"`
+}
+
+// DeviceCodeFlow logs in with the OAuth 2.0 device authorization grant (RFC 8628). The user
+// completes the login on any device with a browser, so it works on headless hosts.
+func DeviceCodeFlow(ctx context.Context, s *Settings) (*Token, error) {
+	if s.DeviceAuthorizationEndpoint == "" {
+		return nil, MissingSettingsError
+	}
+	form := url.Values{"client_id": {s.ClientID}}
+	if len(s.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+	if s.Audience != "" {
+		form.Set("audience", s.Audience)
+	}
+	var auth deviceAuthorizationResponse
+	if err := postForm(ctx, s.DeviceAuthorizationEndpoint, form, &auth); err != nil {
+		return nil, err
+	}
+	if auth.ErrorCode != "" {
+		return nil, &tokenError{Code: auth.ErrorCode, Description: auth.ErrorDescription}
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, fmt.Errorf("incomplete device authorization response from %s", s.DeviceAuthorizationEndpoint)
+	}
+
+	// Written to stderr so it isn't mixed with credential_process output
+	fmt.Fprintf(os.Stderr, "To log in, visit %s and enter the code %s\n", auth.VerificationURI, auth.UserCode)
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "Or visit %s\n", auth.VerificationURIComplete)
+	}
+
+	interval := defaultPollInterval
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * intervalUnit
+	}
+	return pollDeviceToken(ctx, s, auth.DeviceCode, interval, time.Duration(auth.ExpiresIn)*intervalUnit)
+}
+
+// pollDeviceToken polls the token endpoint until the user completes the login, as described in
+// RFC 8628 section 3.5
+func pollDeviceToken(ctx context.Context, s *Settings, deviceCode string, interval, expiresIn time.Duration) (*Token, error) {
+	var expired <-chan time.Time
+	if expiresIn > 0 {
+		expired = time.After(expiresIn)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	form := url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {deviceCode},
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-expired:
+			return nil, DeviceCodeExpiredError
+		case <-interrupt:
+			return nil, fmt.Errorf("interrupt received")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		t, err := requestToken(ctx, s, form)
+		if err == nil {
+			logging.Log.Info("device login complete")
+			return t, nil
+		}
+		tokenErr, ok := err.(*tokenError)
+		if !ok {
+			return nil, err
+		}
+		switch tokenErr.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += slowDownIncrement
+			logging.Log.Debugf("identity provider asked to slow down, polling every %s", interval)
+		case "access_denied":
+			return nil, AccessDeniedError
+		case "expired_token":
+			return nil, DeviceCodeExpiredError
+		default:
+			return nil, tokenErr
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package oauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceCodeFlow(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.pendingPolls = 2
+	idp.slowDownPolls = 1
+	setupTestOAuth(t, idp)
+
+	if err := Authenticate(DeviceCodeFlow); err != nil {
+		t.Fatalf("device login failed: %v", err)
+	}
+	stored, err := loadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken != "access-1" || stored.RefreshToken != "refresh-1" || !stored.Valid() {
+		t.Errorf("got stored token %+v", stored)
+	}
+	if idp.polls != 4 {
+		t.Errorf("got %d polls, expected 4", idp.polls)
+	}
+	// The first poll was answered with slow_down, so every later interval must be longer
+	for i, interval := range idp.pollIntervals[1:] {
+		if interval < 30*time.Millisecond {
+			t.Errorf("poll %d came after %s, expected slow_down to increase the interval", i+2, interval)
+		}
+	}
+
+	// A valid stored token doesn't start another login
+	if err := Authenticate(DeviceCodeFlow); err != nil || idp.polls != 4 {
+		t.Errorf("got %v with %d polls, expected the stored token to be reused", err, idp.polls)
+	}
+}
+
+func TestDeviceCodeFlowDenied(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.deny = true
+	setupTestOAuth(t, idp)
+
+	if err := Authenticate(DeviceCodeFlow); err != AccessDeniedError {
+		t.Errorf("got %v, expected %v", err, AccessDeniedError)
+	}
+}
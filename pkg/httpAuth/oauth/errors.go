@@ -0,0 +1,29 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oauth
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const LoginRequiredError = Error("OAuth login has expired or is missing, run weep again to log in")
+const MissingSettingsError = Error("missing required oauth_settings configuration")
+const AccessDeniedError = Error("the login request was denied")
+const DeviceCodeExpiredError = Error("the device code expired before the login was completed")
+const StateMismatchError = Error("the state returned by the identity provider doesn't match the login request")
+const NonceMismatchError = Error("the nonce in the ID token doesn't match the login request")
+const LoginTimeoutError = Error("timed out waiting for the browser login to complete")
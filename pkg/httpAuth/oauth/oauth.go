@@ -0,0 +1,481 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	werrors "github.com/netflix/weep/pkg/errors"
+	"github.com/netflix/weep/pkg/httpAuth/store"
+	"github.com/netflix/weep/pkg/httpAuth/transport"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+// expiryLeeway is how long before its expiry a token is treated as expired, so it isn't sent
+// just before it stops working
+const expiryLeeway = 30 * time.Second
+
+// idpTimeout limits each request to the identity provider
+const idpTimeout = 30 * time.Second
+
+// refreshLockTimeout is how long to wait for another process that is refreshing the token
+const refreshLockTimeout = 2 * idpTimeout
+
+// idpClient returns the client for requests to the identity provider
+func idpClient() (*http.Client, error) {
+	client, err := transport.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = idpTimeout
+	return client, nil
+}
+
+// Settings are read from oauth_settings
+type Settings struct {
+	// Issuer is used to discover any endpoints that aren't configured
+	Issuer                      string   `mapstructure:"issuer"`
+	ClientID                    string   `mapstructure:"client_id"`
+	Scopes                      []string `mapstructure:"scopes"`
+	Audience                    string   `mapstructure:"audience"`
+	DeviceAuthorizationEndpoint string   `mapstructure:"device_authorization_endpoint"`
+	AuthorizationEndpoint       string   `mapstructure:"authorization_endpoint"`
+	TokenEndpoint               string   `mapstructure:"token_endpoint"`
+	// RedirectPort is the loopback port for the authorization code redirect. A random port is used
+	// if it's 0, which identity providers following RFC 8252 allow for loopback redirects.
+	RedirectPort int `mapstructure:"redirect_port"`
+	// UseIDToken sends the ID token to ConsoleMe instead of the access token
+	UseIDToken bool `mapstructure:"use_id_token"`
+}
+
+// Token is the token set stored after a login
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Valid returns true if the token can be sent to ConsoleMe
+func (t *Token) Valid() bool {
+	if t == nil || t.AccessToken == "" {
+		return false
+	}
+	return t.Expiry.IsZero() || time.Now().Add(expiryLeeway).Before(t.Expiry)
+}
+
+// Flow runs an interactive login and returns the resulting token
+type Flow func(ctx context.Context, s *Settings) (*Token, error)
+
+// tokenResponse is a response from a token endpoint, as described in RFC 6749 section 5
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	IDToken          string `json:"id_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	ErrorCode        string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// tokenError is an error response from a token endpoint
+type tokenError struct {
+	Code        string
+	Description string
+}
+
+func (e *tokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+func (r *tokenResponse) token() *Token {
+	t := &Token{
+		AccessToken:  r.AccessToken,
+		TokenType:    r.TokenType,
+		RefreshToken: r.RefreshToken,
+		IDToken:      r.IDToken,
+	}
+	if r.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return t
+}
+
+// LoadSettings reads oauth_settings and discovers missing endpoints from the issuer
+func LoadSettings() (*Settings, error) {
+	var s Settings
+	if err := viper.UnmarshalKey("oauth_settings", &s); err != nil {
+		return nil, err
+	}
+	if s.ClientID == "" {
+		return nil, MissingSettingsError
+	}
+	if s.Issuer != "" && (s.TokenEndpoint == "" || s.DeviceAuthorizationEndpoint == "" || s.AuthorizationEndpoint == "") {
+		if err := s.discover(); err != nil {
+			return nil, err
+		}
+	}
+	if s.TokenEndpoint == "" {
+		return nil, MissingSettingsError
+	}
+	return &s, nil
+}
+
+// discovery is the part of an OpenID Connect discovery document that weep uses
+type discovery struct {
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+}
+
+// discoveries caches discovery documents by issuer, since LoadSettings runs for every client and
+// login
+var discoveries = struct {
+	sync.Mutex
+	byIssuer map[string]*discovery
+}{byIssuer: make(map[string]*discovery)}
+
+// discover fills in endpoints from the issuer's OpenID Connect discovery document
+func (s *Settings) discover() error {
+	d, err := getDiscovery(s.Issuer)
+	if err != nil {
+		return err
+	}
+	if s.TokenEndpoint == "" {
+		s.TokenEndpoint = d.TokenEndpoint
+	}
+	if s.DeviceAuthorizationEndpoint == "" {
+		s.DeviceAuthorizationEndpoint = d.DeviceAuthorizationEndpoint
+	}
+	if s.AuthorizationEndpoint == "" {
+		s.AuthorizationEndpoint = d.AuthorizationEndpoint
+	}
+	return nil
+}
+
+// getDiscovery returns the issuer's discovery document, fetching it the first time
+func getDiscovery(issuer string) (*discovery, error) {
+	discoveries.Lock()
+	defer discoveries.Unlock()
+	if d, ok := discoveries.byIssuer[issuer]; ok {
+		return d, nil
+	}
+	d, err := fetchDiscovery(issuer)
+	if err != nil {
+		return nil, err
+	}
+	discoveries.byIssuer[issuer] = d
+	return d, nil
+}
+
+// fetchDiscovery downloads the issuer's OpenID Connect discovery document
+func fetchDiscovery(issuer string) (*discovery, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	client, err := idpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(wellKnown)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch OpenID configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch OpenID configuration: unexpected status %d", resp.StatusCode)
+	}
+	var d discovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("could not parse OpenID configuration: %w", err)
+	}
+	return &d, nil
+}
+
+// postForm sends a form to an endpoint of the identity provider and decodes the response
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	client, err := idpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unexpected response from %s with status %d: %w", endpoint, resp.StatusCode, err)
+	}
+	return nil
+}
+
+// requestToken sends a token request and returns the token, or a *tokenError
+func requestToken(ctx context.Context, s *Settings, form url.Values) (*Token, error) {
+	form.Set("client_id", s.ClientID)
+	var resp tokenResponse
+	if err := postForm(ctx, s.TokenEndpoint, form, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ErrorCode != "" {
+		return nil, &tokenError{Code: resp.ErrorCode, Description: resp.ErrorDescription}
+	}
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("token response from %s has no access token", s.TokenEndpoint)
+	}
+	return resp.token(), nil
+}
+
+// refresh exchanges the refresh token for a new token. The refresh token is kept if the
+// identity provider doesn't issue a new one.
+func refresh(ctx context.Context, s *Settings, t *Token) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.RefreshToken},
+	}
+	if len(s.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+	refreshed, err := requestToken(ctx, s, form)
+	if err != nil {
+		return nil, err
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = t.RefreshToken
+	}
+	if refreshed.IDToken == "" {
+		refreshed.IDToken = t.IDToken
+	}
+	return refreshed, nil
+}
+
+// Authenticate makes sure there's a valid token, refreshing the stored token if possible and
+// running flow otherwise
+func Authenticate(flow Flow) error {
+	s, err := LoadSettings()
+	if err != nil {
+		return err
+	}
+	t, err := loadToken()
+	if err != nil {
+		logging.Log.Debugf("unable to read existing OAuth token: %v", err)
+	}
+	if t.Valid() {
+		return nil
+	}
+	ctx := context.Background()
+	if t != nil && t.RefreshToken != "" {
+		_, err := refreshStored(ctx, s, t)
+		if err == nil {
+			return nil
+		}
+		logging.Log.Infof("could not refresh OAuth token, logging in again: %v", err)
+	}
+	t, err = flow(ctx, s)
+	if err != nil {
+		return err
+	}
+	return saveToken(t)
+}
+
+// Login runs flow and stores the new token, even if the stored token is still valid
+func Login(flow Flow) error {
+	s, err := LoadSettings()
+	if err != nil {
+		return err
+	}
+	t, err := flow(context.Background(), s)
+	if err != nil {
+		return err
+	}
+	return saveToken(t)
+}
+
+// NewHTTPClient returns a client that sends the stored token with every request and refreshes
+// it when it expires
+func NewHTTPClient() (*http.Client, error) {
+	s, err := LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadToken()
+	if err != nil || t == nil {
+		return nil, LoginRequiredError
+	}
+	base, err := transport.Default()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &bearerTransport{
+			base:     base,
+			settings: s,
+			token:    t,
+		},
+	}, nil
+}
+
+// bearerTransport adds the token to requests as a bearer token
+type bearerTransport struct {
+	sync.Mutex
+	base     http.RoundTripper
+	settings *Settings
+	token    *Token
+}
+
+func (bt *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t, err := bt.currentToken(r.Context())
+	if err != nil {
+		if r.Body != nil {
+			_ = r.Body.Close()
+		}
+		return nil, err
+	}
+	value := t.AccessToken
+	if bt.settings.UseIDToken && t.IDToken != "" {
+		value = t.IDToken
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+value)
+	return bt.base.RoundTrip(r)
+}
+
+// currentToken returns a valid token. When the token has expired, it uses the stored token if
+// weep login or another process has saved a valid one since, and refreshes it otherwise.
+func (bt *bearerTransport) currentToken(ctx context.Context) (*Token, error) {
+	bt.Lock()
+	defer bt.Unlock()
+	if bt.token.Valid() {
+		return bt.token, nil
+	}
+	if stored, err := loadToken(); err == nil && stored.Valid() {
+		bt.token = stored
+		return stored, nil
+	}
+	refreshed, err := refreshStored(ctx, bt.settings, bt.token)
+	if err != nil {
+		logging.Log.Errorf("could not refresh OAuth token: %v", err)
+		return nil, LoginRequiredError
+	}
+	bt.token = refreshed
+	return refreshed, nil
+}
+
+// refreshStored refreshes t and stores the result while holding the token lock, so only one
+// process uses a refresh token that the identity provider may rotate. The stored token is used
+// instead of t if another process has saved one, and returned as it is if it's valid.
+func refreshStored(ctx context.Context, s *Settings, t *Token) (*Token, error) {
+	unlock, err := store.Lock(tokenName, refreshLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if stored, err := loadToken(); err == nil && stored != nil {
+		if stored.Valid() {
+			return stored, nil
+		}
+		t = stored
+	}
+	if t == nil || t.RefreshToken == "" {
+		return nil, LoginRequiredError
+	}
+	refreshed, err := refresh(ctx, s, t)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveToken(refreshed); err != nil {
+		logging.Log.Warnf("could not save refreshed OAuth token: %v", err)
+	}
+	return refreshed, nil
+}
+
+// tokenName is the name of the OAuth token in the credential store
+const tokenName = "oauth_token"
+
+func loadToken() (*Token, error) {
+	credentialStore, err := store.New()
+	if err != nil {
+		return nil, err
+	}
+	b, err := credentialStore.Get(tokenName)
+	if err != nil {
+		return nil, err
+	}
+	var t Token
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func saveToken(t *Token) error {
+	credentialStore, err := store.New()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return credentialStore.Put(tokenName, b)
+}
+
+// ClassifyError deletes the stored token when ConsoleMe reports that it's invalid, so the next
+// command logs in again, and returns nil for any other error response
+func ClassifyError(statusCode int, body []byte) error {
+	var response struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Code != "invalid_jwt" {
+		return nil
+	}
+	logging.Log.Errorf("OAuth token is invalid or has expired. Please run `weep login` to re-authenticate.")
+	if err := DeleteToken(); err != nil {
+		logging.Log.Errorf("failed to delete OAuth token: %v", err)
+	}
+	return werrors.InvalidJWT
+}
+
+// DeleteToken removes the stored token
+func DeleteToken() error {
+	credentialStore, err := store.New()
+	if err != nil {
+		return err
+	}
+	return credentialStore.Delete(tokenName)
+}
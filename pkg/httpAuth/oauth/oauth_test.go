@@ -0,0 +1,327 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	werrors "github.com/netflix/weep/pkg/errors"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// stubIdP is a minimal identity provider supporting discovery, the device authorization grant,
+// and refresh tokens
+type stubIdP struct {
+	sync.Mutex
+	server         *httptest.Server
+	pendingPolls   int
+	slowDownPolls  int
+	deny           bool
+	polls          int
+	refreshes      int
+	lastPoll       time.Time
+	pollIntervals  []time.Duration
+	issuedAccess   string
+	issuedRefresh  string
+	expiresIn      int64
+	refreshedToken string
+	authRequest    url.Values
+	idTokenNonce   string
+	discoveries    int
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	idp := &stubIdP{issuedAccess: "access-1", issuedRefresh: "refresh-1", expiresIn: 3600, refreshedToken: "access-2"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		idp.Lock()
+		idp.discoveries++
+		idp.Unlock()
+		writeTestJSON(w, map[string]string{
+			"issuer":                        idp.server.URL,
+			"token_endpoint":                idp.server.URL + "/token",
+			"device_authorization_endpoint": idp.server.URL + "/device",
+			"authorization_endpoint":        idp.server.URL + "/authorize",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		idp.Lock()
+		idp.authRequest = r.URL.Query()
+		idp.Unlock()
+		state := r.URL.Query().Get("state")
+		redirect := r.URL.Query().Get("redirect_uri") + "?" + url.Values{"code": {"code-123"}, "state": {state}}.Encode()
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_id") != "weep" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeTestJSON(w, map[string]string{"error": "invalid_client"})
+			return
+		}
+		writeTestJSON(w, map[string]interface{}{
+			"device_code":      "device-123",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": idp.server.URL + "/activate",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.Lock()
+		defer idp.Unlock()
+		switch r.PostFormValue("grant_type") {
+		case deviceCodeGrantType:
+			now := time.Now()
+			if !idp.lastPoll.IsZero() {
+				idp.pollIntervals = append(idp.pollIntervals, now.Sub(idp.lastPoll))
+			}
+			idp.lastPoll = now
+			idp.polls++
+			if r.PostFormValue("device_code") != "device-123" {
+				w.WriteHeader(http.StatusBadRequest)
+				writeTestJSON(w, map[string]string{"error": "invalid_grant"})
+				return
+			}
+			if idp.deny {
+				w.WriteHeader(http.StatusBadRequest)
+				writeTestJSON(w, map[string]string{"error": "access_denied"})
+				return
+			}
+			if idp.slowDownPolls > 0 {
+				idp.slowDownPolls--
+				w.WriteHeader(http.StatusBadRequest)
+				writeTestJSON(w, map[string]string{"error": "slow_down"})
+				return
+			}
+			if idp.pendingPolls > 0 {
+				idp.pendingPolls--
+				w.WriteHeader(http.StatusBadRequest)
+				writeTestJSON(w, map[string]string{"error": "authorization_pending"})
+				return
+			}
+			writeTestJSON(w, map[string]interface{}{
+				"access_token":  idp.issuedAccess,
+				"refresh_token": idp.issuedRefresh,
+				"token_type":    "Bearer",
+				"expires_in":    idp.expiresIn,
+			})
+		case "authorization_code":
+			challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+			if r.PostFormValue("code") != "code-123" ||
+				r.PostFormValue("redirect_uri") != idp.authRequest.Get("redirect_uri") ||
+				base64.RawURLEncoding.EncodeToString(challenge[:]) != idp.authRequest.Get("code_challenge") {
+				w.WriteHeader(http.StatusBadRequest)
+				writeTestJSON(w, map[string]string{"error": "invalid_grant"})
+				return
+			}
+			nonce := idp.authRequest.Get("nonce")
+			if idp.idTokenNonce != "" {
+				nonce = idp.idTokenNonce
+			}
+			writeTestJSON(w, map[string]interface{}{
+				"access_token":  idp.issuedAccess,
+				"refresh_token": idp.issuedRefresh,
+				"id_token":      testJWT(map[string]interface{}{"sub": "user@example.com", "nonce": nonce}),
+				"token_type":    "Bearer",
+				"expires_in":    idp.expiresIn,
+			})
+		case "refresh_token":
+			idp.refreshes++
+			if r.PostFormValue("refresh_token") != idp.issuedRefresh {
+				w.WriteHeader(http.StatusBadRequest)
+				writeTestJSON(w, map[string]string{"error": "invalid_grant"})
+				return
+			}
+			writeTestJSON(w, map[string]interface{}{
+				"access_token": idp.refreshedToken,
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+			})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			writeTestJSON(w, map[string]string{"error": "unsupported_grant_type"})
+		}
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// testJWT returns an unsigned JWT with claims
+func testJWT(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func writeTestJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// setupTestOAuth points oauth_settings at idp, stores tokens in a temporary home directory, and
+// shortens poll intervals so tests run quickly
+func setupTestOAuth(t *testing.T, idp *stubIdP) {
+	t.Setenv("HOME", t.TempDir())
+	homedir.DisableCache = true
+	viper.Set("oauth_settings.issuer", idp.server.URL)
+	viper.Set("oauth_settings.client_id", "weep")
+	viper.Set("oauth_settings.scopes", []string{"openid", "offline_access"})
+	// The credential store has its own tests, and CI hosts don't always have a machine ID
+	viper.Set("credential_store.type", "plaintext")
+
+	oldUnit, oldSlowDown := intervalUnit, slowDownIncrement
+	intervalUnit, slowDownIncrement = 10*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() {
+		intervalUnit, slowDownIncrement = oldUnit, oldSlowDown
+		homedir.DisableCache = false
+		viper.Set("oauth_settings", nil)
+		viper.Set("credential_store", nil)
+	})
+}
+
+func TestLoadSettingsCachesDiscovery(t *testing.T) {
+	idp := newStubIdP(t)
+	setupTestOAuth(t, idp)
+	for i := 0; i < 3; i++ {
+		s, err := LoadSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.TokenEndpoint != idp.server.URL+"/token" {
+			t.Errorf("got token endpoint %s", s.TokenEndpoint)
+		}
+	}
+	if idp.discoveries != 1 {
+		t.Errorf("got %d discovery requests, expected the document to be fetched once", idp.discoveries)
+	}
+}
+
+func TestBearerTransportRefresh(t *testing.T) {
+	idp := newStubIdP(t)
+	setupTestOAuth(t, idp)
+	if err := saveToken(&Token{AccessToken: "expired", RefreshToken: "refresh-1", Expiry: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var authorization string
+	consoleme := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer consoleme.Close()
+
+	client, err := NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(consoleme.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if authorization != "Bearer access-2" {
+		t.Errorf("got Authorization %q, expected the refreshed token", authorization)
+	}
+	stored, _ := loadToken()
+	if stored == nil || stored.AccessToken != "access-2" || stored.RefreshToken != "refresh-1" {
+		t.Errorf("got stored token %+v, expected the refreshed token with the original refresh token", stored)
+	}
+	if idp.refreshes != 1 {
+		t.Errorf("got %d refreshes, expected 1", idp.refreshes)
+	}
+}
+
+func TestBearerTransportReadsStoreAfterCreation(t *testing.T) {
+	idp := newStubIdP(t)
+	setupTestOAuth(t, idp)
+	expired := time.Now().Add(-time.Minute)
+	if err := saveToken(&Token{AccessToken: "expired", RefreshToken: "refresh-1", Expiry: expired}); err != nil {
+		t.Fatal(err)
+	}
+
+	var authorization string
+	consoleme := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer consoleme.Close()
+	get := func(client *http.Client) {
+		resp, err := client.Get(consoleme.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// weep login stores a new token while the client is in use
+	client, err := NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveToken(&Token{AccessToken: "logged-in", RefreshToken: "refresh-1", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	get(client)
+	if authorization != "Bearer logged-in" {
+		t.Errorf("got Authorization %q, expected the token stored after the client was created", authorization)
+	}
+	if idp.refreshes != 0 {
+		t.Errorf("got %d refreshes, expected the stored token to be used", idp.refreshes)
+	}
+
+	// Another weep process refreshes, and the identity provider rotates the refresh token
+	if err := saveToken(&Token{AccessToken: "expired", RefreshToken: "refresh-1", Expiry: expired}); err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Lock()
+	idp.issuedRefresh = "refresh-2"
+	idp.Unlock()
+	if err := saveToken(&Token{AccessToken: "expired", RefreshToken: "refresh-2", Expiry: expired}); err != nil {
+		t.Fatal(err)
+	}
+	get(client)
+	if authorization != "Bearer access-2" {
+		t.Errorf("got Authorization %q, expected a token refreshed with the stored refresh token", authorization)
+	}
+	if stored, _ := loadToken(); stored == nil || stored.RefreshToken != "refresh-2" {
+		t.Errorf("got stored token %+v, expected the rotated refresh token to be kept", stored)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		Description string
+		StatusCode  int
+		Body        string
+		Expected    error
+		Deleted     bool
+	}{
+		{Description: "invalid_jwt", StatusCode: http.StatusForbidden, Body: `{"code": "invalid_jwt"}`, Expected: werrors.InvalidJWT, Deleted: true},
+		{Description: "other ConsoleMe error", StatusCode: http.StatusForbidden, Body: `{"code": "900"}`},
+		{Description: "not JSON", StatusCode: http.StatusInternalServerError, Body: "oops"},
+	}
+	idp := newStubIdP(t)
+	for _, tc := range cases {
+		setupTestOAuth(t, idp)
+		if err := saveToken(&Token{AccessToken: "access-1", Expiry: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ClassifyError(tc.StatusCode, []byte(tc.Body)); err != tc.Expected {
+			t.Errorf("%s: got %v, expected %v", tc.Description, err, tc.Expected)
+		}
+		if stored, _ := loadToken(); (stored == nil) != tc.Deleted {
+			t.Errorf("%s: got stored token %+v, expected it deleted %v", tc.Description, stored, tc.Deleted)
+		}
+	}
+}
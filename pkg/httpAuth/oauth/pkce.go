@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/util"
+)
+
+var (
+	// openBrowser opens the authorization URL. It doesn't write to stdout, which may be
+	// credential_process output.
+	openBrowser = util.OpenLinkQuietly
+	// loginTimeout is how long to wait for the browser to be redirected back to weep
+	loginTimeout = 5 * time.Minute
+)
+
+const callbackPath = "/callback"
+
+// callbackResult is the outcome of the redirect back from the identity provider
+type callbackResult struct {
+	code string
+	err  error
+}
+
+// PKCEFlow logs in with the OAuth 2.0 authorization code grant and PKCE (RFC 7636). The browser
+// is redirected back to a listener on 127.0.0.1, so there's no need to poll for the result.
+func PKCEFlow(ctx context.Context, s *Settings) (*Token, error) {
+	if s.AuthorizationEndpoint == "" {
+		return nil, MissingSettingsError
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(s.RedirectPort)))
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for the login redirect: %w", err)
+	}
+	redirectURI := fmt.Sprintf("http://%s%s", ln.Addr(), callbackPath)
+
+	results := make(chan callbackResult, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           callbackHandler(state, results),
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.Log.Errorf("login redirect listener failed: %v", err)
+		}
+	}()
+	defer srv.Close()
+
+	authURL, err := authorizationURL(s, redirectURI, state, nonce, verifier)
+	if err != nil {
+		return nil, err
+	}
+	logging.Log.Debugf("opening authorization URL %s", authURL)
+	// Written to stderr so it isn't mixed with credential_process output
+	if err := openBrowser(authURL); err != nil {
+		logging.Log.Debugf("could not open browser: %v", err)
+		fmt.Fprintf(os.Stderr, "Open this URL in a browser to log in:\n%s\n", authURL)
+	} else {
+		fmt.Fprintln(os.Stderr, "Link opened in a new browser window.")
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	var result callbackResult
+	select {
+	case result = <-results:
+	case <-time.After(loginTimeout):
+		return nil, LoginTimeoutError
+	case <-interrupt:
+		return nil, fmt.Errorf("interrupt received")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	t, err := requestToken(ctx, s, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {result.code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.IDToken != "" {
+		if err := checkNonce(t.IDToken, nonce); err != nil {
+			return nil, err
+		}
+	}
+	logging.Log.Info("browser login complete")
+	return t, nil
+}
+
+// authorizationURL returns the URL the browser is sent to, with an S256 code challenge
+func authorizationURL(s *Settings, redirectURI, state, nonce, verifier string) (string, error) {
+	u, err := url.Parse(s.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", s.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	if len(s.Scopes) > 0 {
+		q.Set("scope", strings.Join(s.Scopes, " "))
+	}
+	if s.Audience != "" {
+		q.Set("audience", s.Audience)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// callbackHandler receives the redirect from the identity provider and sends the result on
+// results. Requests without the expected state aren't from the login weep started, so they're
+// rejected without ending it. Only the first redirect with the expected state is used.
+func callbackHandler(state string, results chan<- callbackResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != callbackPath {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			logging.Log.Warnf("ignoring login redirect from %s: %v", r.RemoteAddr, StateMismatchError)
+			http.Error(w, StateMismatchError.Error(), http.StatusBadRequest)
+			return
+		}
+		var result callbackResult
+		switch {
+		case q.Get("error") != "":
+			result.err = &tokenError{Code: q.Get("error"), Description: q.Get("error_description")}
+		case q.Get("code") == "":
+			result.err = fmt.Errorf("the login redirect has no authorization code")
+		default:
+			result.code = q.Get("code")
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		if result.err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Login failed: %v\n", result.err)
+		} else {
+			fmt.Fprintln(w, "Login complete, you can close this window.")
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	}
+}
+
+// checkNonce makes sure the nonce claim of an ID token matches the one sent with the login
+// request. The token comes straight from the token endpoint over TLS, so its signature isn't
+// checked here.
+func checkNonce(idToken, nonce string) error {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed ID token: %w", err)
+	}
+	var claims struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed ID token: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return NonceMismatchError
+	}
+	return nil
+}
+
+// randomString returns n random bytes encoded with unpadded base64url
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
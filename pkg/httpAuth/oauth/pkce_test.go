@@ -0,0 +1,90 @@
+package oauth
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// browseTo follows the login the way a browser would, including the redirect back to weep
+func browseTo(t *testing.T) func(string) error {
+	return func(link string) error {
+		resp, err := http.Get(link)
+		if err != nil {
+			t.Errorf("browser request failed: %v", err)
+			return nil
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
+
+func TestPKCEFlow(t *testing.T) {
+	idp := newStubIdP(t)
+	setupTestOAuth(t, idp)
+	oldOpen := openBrowser
+	openBrowser = browseTo(t)
+	defer func() { openBrowser = oldOpen }()
+
+	if err := Authenticate(PKCEFlow); err != nil {
+		t.Fatalf("PKCE login failed: %v", err)
+	}
+	stored, err := loadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken != "access-1" || stored.RefreshToken != "refresh-1" || stored.IDToken == "" {
+		t.Errorf("got stored token %+v", stored)
+	}
+	if method := idp.authRequest.Get("code_challenge_method"); method != "S256" {
+		t.Errorf("got code_challenge_method %q, expected S256", method)
+	}
+	if scope := idp.authRequest.Get("scope"); scope != "openid offline_access" {
+		t.Errorf("got scope %q", scope)
+	}
+}
+
+func TestPKCEFlowIgnoresForgedCallback(t *testing.T) {
+	idp := newStubIdP(t)
+	setupTestOAuth(t, idp)
+	oldOpen := openBrowser
+	defer func() { openBrowser = oldOpen }()
+	openBrowser = func(link string) error {
+		// Another page sends a redirect with its own code before the real login completes
+		u, _ := url.Parse(link)
+		forged := u.Query().Get("redirect_uri") + "?" + url.Values{"code": {"forged-code"}, "state": {"forged"}}.Encode()
+		resp, err := http.Get(forged)
+		if err != nil {
+			t.Errorf("forged callback failed: %v", err)
+			return nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d for a forged callback, expected %d", resp.StatusCode, http.StatusBadRequest)
+		}
+		return browseTo(t)(link)
+	}
+
+	if err := Authenticate(PKCEFlow); err != nil {
+		t.Fatalf("got %v, expected the forged callback to be ignored", err)
+	}
+	if stored, _ := loadToken(); stored == nil || stored.AccessToken != "access-1" {
+		t.Errorf("got stored token %+v", stored)
+	}
+}
+
+func TestPKCEFlowRejectsNonceMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.idTokenNonce = "replayed"
+	setupTestOAuth(t, idp)
+	oldOpen := openBrowser
+	openBrowser = browseTo(t)
+	defer func() { openBrowser = oldOpen }()
+
+	if err := Authenticate(PKCEFlow); err != NonceMismatchError {
+		t.Errorf("got %v, expected %v", err, NonceMismatchError)
+	}
+	if stored, _ := loadToken(); stored != nil {
+		t.Errorf("a token was stored after a failed login")
+	}
+}
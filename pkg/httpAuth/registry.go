@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpAuth
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Provider authenticates to ConsoleMe with one authentication method
+type Provider struct {
+	// NewHTTPClient returns a client whose requests to ConsoleMe are authenticated. An error
+	// makes GetAuthenticatedClient try the next configured method.
+	NewHTTPClient func() (*http.Client, error)
+	// Login authenticates again, replacing any stored credentials. It's nil for methods that
+	// don't need a login.
+	Login func() error
+	// MonitorExpiration warns ahead of the expiry of credentials that can't be renewed without
+	// the user, and returns when stop is closed. It's nil for methods that don't need it.
+	MonitorExpiration func(stop <-chan struct{})
+	// Preflight authenticates a request to ConsoleMe once it's built, for methods that sign
+	// each request. It's nil for methods whose client authenticates requests.
+	Preflight func(req *http.Request) error
+	// ClassifyError returns the error for an error response from ConsoleMe when the method
+	// knows better than the caller what went wrong, or nil to leave the response to the caller.
+	// It's nil for methods that don't need it.
+	ClassifyError func(statusCode int, body []byte) error
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]Provider)
+)
+
+// RegisterProvider makes an authentication method available under name, for use in
+// authentication_method. Registering a name again replaces the provider, including the
+// built-in ones.
+func RegisterProvider(name string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = provider
+}
+
+// getProvider returns the provider registered under name
+func getProvider(name string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// Providers returns the names of the registered authentication methods
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
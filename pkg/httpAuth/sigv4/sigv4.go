@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sigv4 authenticates to ConsoleMe by signing each request with AWS Signature Version 4,
+// the way API Gateway's IAM authorization works. The credentials come from the standard AWS
+// chain: environment variables, the shared config and credentials files, and the instance
+// metadata service.
+package sigv4
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth/transport"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/spf13/viper"
+)
+
+// requestSigner signs requests for one service and region
+type requestSigner struct {
+	signer  *v4.Signer
+	service string
+	region  string
+}
+
+var (
+	signerMu sync.Mutex
+	signer   *requestSigner
+)
+
+// now is a variable so tests can fix the signing time
+var now = time.Now
+
+// NewHTTPClient checks that AWS credentials are available and returns a client for ConsoleMe.
+// The requests are signed by SignRequest, which runs as a preflight when they're built.
+func NewHTTPClient() (*http.Client, error) {
+	if _, err := getSigner(); err != nil {
+		return nil, err
+	}
+	return transport.NewClient()
+}
+
+// SignRequest signs req with the credentials from the AWS chain. The body is read into memory to
+// compute its hash, and replaced with a copy.
+func SignRequest(req *http.Request) error {
+	s, err := getSigner()
+	if err != nil {
+		return err
+	}
+	var body io.ReadSeeker
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return fmt.Errorf("could not read request body to sign it: %w", err)
+		}
+		req.Body.Close()
+		body = bytes.NewReader(b)
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+	}
+	if _, err := s.signer.Sign(req, body, s.service, s.region, now()); err != nil {
+		return fmt.Errorf("could not sign request: %w", err)
+	}
+	return nil
+}
+
+// getSigner returns the signer, creating it the first time
+func getSigner() (*requestSigner, error) {
+	signerMu.Lock()
+	defer signerMu.Unlock()
+	if signer != nil {
+		return signer, nil
+	}
+	s, err := newSigner()
+	if err != nil {
+		return nil, err
+	}
+	signer = s
+	return signer, nil
+}
+
+// newSigner loads credentials from the AWS chain, using sigv4_settings.profile if it's set, and
+// makes sure they can be retrieved
+func newSigner() (*requestSigner, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           viper.GetString("sigv4_settings.profile"),
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", NoCredentialsError, err)
+	}
+	credentials := sess.Config.Credentials
+	value, err := credentials.Get()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", NoCredentialsError, err)
+	}
+	logging.Log.Debugf("signing ConsoleMe requests with AWS credentials from %s", value.ProviderName)
+
+	region := viper.GetString("sigv4_settings.region")
+	if region == "" {
+		region = aws.StringValue(sess.Config.Region)
+	}
+	if region == "" {
+		region = viper.GetString("aws.region")
+	}
+	return &requestSigner{
+		signer:  v4.NewSigner(credentials),
+		service: viper.GetString("sigv4_settings.service"),
+		region:  region,
+	}, nil
+}
@@ -0,0 +1,149 @@
+package sigv4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth/sigv4/sigv4test"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/spf13/viper"
+)
+
+const (
+	testAccessKeyID     = "AKIDEXAMPLE"
+	testSecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testSessionToken    = "session-token"
+)
+
+// setTestEnvironment isolates the AWS credential chain from the host and resets the signer
+func setTestEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	viper.Set("sigv4_settings.service", "execute-api")
+	signer = nil
+	t.Cleanup(func() {
+		viper.Set("sigv4_settings.service", nil)
+		viper.Set("sigv4_settings.region", nil)
+		signer = nil
+		now = time.Now
+	})
+}
+
+func TestSignRequest(t *testing.T) {
+	setTestEnvironment(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", testAccessKeyID)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSecretAccessKey)
+	t.Setenv("AWS_SESSION_TOKEN", testSessionToken)
+	t.Setenv("AWS_REGION", "us-west-2")
+
+	verifier := &sigv4test.Verifier{
+		Provider: &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     testAccessKeyID,
+			SecretAccessKey: testSecretAccessKey,
+			SessionToken:    testSessionToken,
+		}},
+		Service: "execute-api",
+		Region:  "us-west-2",
+	}
+	server := httptest.NewServer(verifier)
+	defer server.Close()
+
+	client, err := NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		Description string
+		Method      string
+		Path        string
+		Body        string
+	}{
+		{Description: "GET with a query string", Method: http.MethodGet, Path: "/api/v1/policies/typeahead?resource=s3&search=a%20b"},
+		{Description: "POST with a body", Method: http.MethodPost, Path: "/api/v1/get_credentials", Body: `{"requested_role":"arn:aws:iam::123456789012:role/test"}`},
+	}
+	for _, tc := range cases {
+		var body io.Reader
+		if tc.Body != "" {
+			body = bytes.NewBufferString(tc.Body)
+		}
+		req, err := http.NewRequest(tc.Method, server.URL+tc.Path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequest(req); err != nil {
+			t.Fatalf("%s: %v", tc.Description, err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Description, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d: %v", tc.Description, resp.StatusCode, verifier.Err)
+		}
+		if string(verifier.Body) != tc.Body {
+			t.Errorf("%s: ConsoleMe got body %q, expected %q", tc.Description, verifier.Body, tc.Body)
+		}
+	}
+
+	// A signature for another region is rejected
+	viper.Set("sigv4_settings.region", "eu-west-1")
+	signer = nil
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/get_roles", nil)
+	if err := SignRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d for a signature for the wrong region", resp.StatusCode)
+	}
+}
+
+// TestSignRequestKnownAnswer checks a signature against the get-vanilla case from the AWS
+// Signature Version 4 test suite
+func TestSignRequestKnownAnswer(t *testing.T) {
+	setTestEnvironment(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", testAccessKeyID)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSecretAccessKey)
+	viper.Set("sigv4_settings.service", "service")
+	viper.Set("sigv4_settings.region", "us-east-1")
+	now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("got Authorization %s, expected %s", got, expected)
+	}
+}
+
+func TestNewHTTPClientWithoutCredentials(t *testing.T) {
+	setTestEnvironment(t)
+	if _, err := NewHTTPClient(); !errors.Is(err, NoCredentialsError) {
+		t.Errorf("got %v, expected %v", err, NoCredentialsError)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sigv4test checks AWS Signature Version 4 signatures in tests.
+package sigv4test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// Verifier stands in for an AWS endpoint, or a ConsoleMe behind IAM authorization. It checks the
+// signature of each request by signing an identical request with the expected credentials.
+type Verifier struct {
+	Provider credentials.Provider
+	Service  string
+	Region   string
+	// Body, Payload, and Authorization are the body, payload hash, and Authorization header of
+	// the last request
+	Body          []byte
+	Payload       string
+	Authorization string
+	// Verified is whether the last request's signature matched, and Err is why it didn't
+	Verified bool
+	Err      error
+}
+
+func (v *Verifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.Err = v.Verify(r)
+	v.Verified = v.Err == nil
+	if !v.Verified {
+		http.Error(w, v.Err.Error(), http.StatusForbidden)
+		return
+	}
+	fmt.Fprint(w, "{}")
+}
+
+// Verify returns an error if r wasn't signed with the expected credentials for the service and
+// region. Only the headers the signature says it covers are signed again.
+func (v *Verifier) Verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	v.Authorization = auth
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+	var signedHeaders []string
+	for _, part := range strings.Split(auth, ", ") {
+		if strings.HasPrefix(part, "SignedHeaders=") {
+			signedHeaders = strings.Split(strings.TrimPrefix(part, "SignedHeaders="), ";")
+		}
+	}
+	if r.Body != nil {
+		if v.Body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+	}
+	v.Payload = r.Header.Get("X-Amz-Content-Sha256")
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	req, err := http.NewRequest(r.Method, "http://"+host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range signedHeaders {
+		if h != "host" {
+			req.Header[http.CanonicalHeaderKey(h)] = r.Header.Values(h)
+		}
+	}
+	var body io.ReadSeeker
+	if len(v.Body) > 0 {
+		body = bytes.NewReader(v.Body)
+	}
+	value, err := v.Provider.Retrieve()
+	if err != nil {
+		return err
+	}
+	if _, err := v4.NewSigner(credentials.NewStaticCredentialsFromCreds(value)).Sign(req, body, v.Service, v.Region, signTime); err != nil {
+		return err
+	}
+	if expected := req.Header.Get("Authorization"); expected != auth {
+		return fmt.Errorf("got %s, expected %s", auth, expected)
+	}
+	return nil
+}
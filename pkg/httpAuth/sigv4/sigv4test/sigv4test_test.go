@@ -0,0 +1,46 @@
+package sigv4test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// The get-vanilla case from the AWS Signature Version 4 test suite
+const (
+	vanillaDate          = "20150830T123600Z"
+	vanillaAuthorization = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+)
+
+func TestVerifierKnownAnswer(t *testing.T) {
+	v := &Verifier{
+		Provider: &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		}},
+		Service: "service",
+		Region:  "us-east-1",
+	}
+	cases := []struct {
+		Description   string
+		Date          string
+		Authorization string
+		Valid         bool
+	}{
+		{Description: "matching signature", Date: vanillaDate, Authorization: vanillaAuthorization, Valid: true},
+		{Description: "different time", Date: "20150830T123601Z", Authorization: vanillaAuthorization},
+		{Description: "different signature", Date: vanillaDate, Authorization: vanillaAuthorization[:len(vanillaAuthorization)-1] + "0"},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Amz-Date", tc.Date)
+		req.Header.Set("Authorization", tc.Authorization)
+		if err := v.Verify(req); (err == nil) != tc.Valid {
+			t.Errorf("%s: got %v, expected valid %v", tc.Description, err, tc.Valid)
+		}
+	}
+}
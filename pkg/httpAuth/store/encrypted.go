@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"path/filepath"
+	"sync"
+
+	"github.com/netflix/weep/pkg/logging"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptedSuffix is appended to the credential name to get the encrypted file name, which keeps
+// encrypted files apart from the plaintext files written by earlier versions of weep
+const encryptedSuffix = ".enc"
+
+// encryptedMagic starts every encrypted file and identifies the format version
+var encryptedMagic = []byte("WEEPENC1")
+
+const (
+	saltSize   = 16
+	keySize    = 32
+	iterations = 200000
+)
+
+// EncryptedFileStore keeps each credential in a file encrypted with AES-256-GCM. The key for each
+// file is derived from a secret and a random per-file salt with PBKDF2-HMAC-SHA256, and the
+// credential name is authenticated so files can't be swapped for one another.
+type EncryptedFileStore struct {
+	dir    string
+	secret []byte
+}
+
+// deriveKey is a variable so tests can count how often keys are derived
+var deriveKey = func(secret, salt []byte) []byte {
+	return pbkdf2.Key(secret, salt, iterations, keySize, sha256.New)
+}
+
+// derivedKeys remembers the keys derived in this process, because deriving a key is deliberately
+// slow and a store is created for every read and write. New files are written with one salt per
+// secret, and keys are looked up by salt and secret.
+var derivedKeys = struct {
+	sync.Mutex
+	writeSalts map[string][]byte
+	keys       map[string][]byte
+}{writeSalts: make(map[string][]byte), keys: make(map[string][]byte)}
+
+// NewEncryptedFileStore returns an EncryptedFileStore that keeps credentials in dir, encrypted
+// with keys derived from secret
+func NewEncryptedFileStore(dir string, secret []byte) *EncryptedFileStore {
+	return &EncryptedFileStore{dir: dir, secret: secret}
+}
+
+// Get returns the credential stored under name. A plaintext credential left by an earlier version
+// of weep is encrypted and the plaintext file removed.
+func (s *EncryptedFileStore) Get(name string) ([]byte, error) {
+	b, err := readFile(s.path(name))
+	if err == NotFoundError {
+		return s.migrate(name)
+	} else if err != nil {
+		return nil, err
+	}
+	return s.decrypt(name, b)
+}
+
+func (s *EncryptedFileStore) Put(name string, data []byte) error {
+	b, err := s.encrypt(name, data)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.path(name), b); err != nil {
+		return err
+	}
+	return removeFile(filepath.Join(s.dir, name))
+}
+
+func (s *EncryptedFileStore) Delete(name string) error {
+	if err := removeFile(s.path(name)); err != nil {
+		return err
+	}
+	return removeFile(filepath.Join(s.dir, name))
+}
+
+func (s *EncryptedFileStore) path(name string) string {
+	return filepath.Join(s.dir, name+encryptedSuffix)
+}
+
+// migrate moves a plaintext credential into the encrypted store
+func (s *EncryptedFileStore) migrate(name string) ([]byte, error) {
+	data, err := readFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	logging.Log.Infof("encrypting plaintext credentials in %s", filepath.Join(s.dir, name))
+	if err := s.Put(name, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *EncryptedFileStore) encrypt(name string, data []byte) ([]byte, error) {
+	salt, err := s.writeSalt()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, encryptedMagic...), salt...), nonce...)
+	return gcm.Seal(out, nonce, data, []byte(name)), nil
+}
+
+func (s *EncryptedFileStore) decrypt(name string, b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, encryptedMagic) || len(b) < len(encryptedMagic)+saltSize {
+		return nil, InvalidFormatError
+	}
+	b = b[len(encryptedMagic):]
+	salt, b := b[:saltSize], b[saltSize:]
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, InvalidFormatError
+	}
+	nonce, ciphertext := b[:gcm.NonceSize()], b[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, DecryptionError
+	}
+	return data, nil
+}
+
+// writeSalt returns the salt new files are encrypted with, generating it the first time the
+// store's secret is used. Every file still gets its own random nonce.
+func (s *EncryptedFileStore) writeSalt() ([]byte, error) {
+	derivedKeys.Lock()
+	defer derivedKeys.Unlock()
+	salt, ok := derivedKeys.writeSalts[string(s.secret)]
+	if !ok {
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		derivedKeys.writeSalts[string(s.secret)] = salt
+	}
+	return salt, nil
+}
+
+func (s *EncryptedFileStore) cipher(salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key(salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// key returns the key for salt, deriving it the first time the salt is used with the store's
+// secret
+func (s *EncryptedFileStore) key(salt []byte) []byte {
+	derivedKeys.Lock()
+	defer derivedKeys.Unlock()
+	// The salt has a fixed size, so the cache key can't be ambiguous
+	cacheKey := string(salt) + string(s.secret)
+	if key, ok := derivedKeys.keys[cacheKey]; ok {
+		return key
+	}
+	key := deriveKey(s.secret, salt)
+	derivedKeys.keys[cacheKey] = key
+	return key
+}
@@ -0,0 +1,30 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const DecryptionError = Error("could not decrypt stored credentials, they may have been written with a different key")
+const InvalidFormatError = Error("stored credentials are not in a recognized format")
+const LockTimeoutError = Error("timed out waiting for another weep process to release the credential lock")
+const MachineIDError = Error("could not determine a machine ID to derive the credential store key")
+const MissingPassphraseError = Error("credential store passphrase not set in " + PassphraseEnvVar)
+const NotFoundError = Error("no stored credentials found")
+const UnsupportedKeySourceError = Error("unsupported credential_store.key_source")
+const UnsupportedStoreError = Error("unsupported credential_store.type")
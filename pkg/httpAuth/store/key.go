@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/netflix/weep/pkg/logging"
+)
+
+// PassphraseEnvVar holds the passphrase when credential_store.key_source is passphrase
+const PassphraseEnvVar = "WEEP_CREDENTIAL_STORE_PASSPHRASE"
+
+// keyFile holds a random secret for hosts without a machine ID. It's kept under $XDG_RUNTIME_DIR
+// rather than next to the credentials, so a backup of the home directory doesn't include it.
+const keyFile = "store.key"
+
+// logRandomKey logs that the random key is in use, once per process
+var logRandomKey sync.Once
+
+// machineID is a variable so tests can replace it
+var machineID = readMachineID
+
+var (
+	ioregUUID  = regexp.MustCompile(`"IOPlatformUUID" = "([^"]+)"`)
+	regMachine = regexp.MustCompile(`MachineGuid\s+REG_SZ\s+(\S+)`)
+)
+
+// secretFor returns the secret that store keys are derived from. A machine secret combines the
+// machine ID with the current user, so copies of the weep directory can't be decrypted elsewhere.
+// Hosts without a machine ID, such as most containers, use a random secret kept in
+// $XDG_RUNTIME_DIR instead, and fail if it isn't set.
+func secretFor(keySource string) ([]byte, error) {
+	switch keySource {
+	case "machine", "":
+		id, err := machineID()
+		if err != nil {
+			runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+			if runtimeDir == "" {
+				return nil, fmt.Errorf("%w and XDG_RUNTIME_DIR isn't set, set credential_store.key_source to passphrase and %s, or credential_store.type to plaintext", err, PassphraseEnvVar)
+			}
+			dir := filepath.Join(runtimeDir, "weep")
+			logRandomKey.Do(func() {
+				logging.Log.Infof("%v, encrypting stored credentials with a random key in %s", err, filepath.Join(dir, keyFile))
+			})
+			return randomSecret(dir)
+		}
+		username := ""
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+		return []byte("weep:" + id + ":" + username), nil
+	case "passphrase":
+		passphrase := os.Getenv(PassphraseEnvVar)
+		if passphrase == "" {
+			return nil, MissingPassphraseError
+		}
+		return []byte(passphrase), nil
+	default:
+		return nil, UnsupportedKeySourceError
+	}
+}
+
+// randomSecret returns the secret in dir's key file, creating it if it doesn't exist. A new key is
+// linked into place so concurrent weep processes all end up with the same one.
+func randomSecret(dir string) ([]byte, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(dir, keyFile)
+	if b, err := readFile(filename); err != NotFoundError {
+		return b, err
+	}
+	secret := make([]byte, keySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "."+keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(secret); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Link(f.Name(), filename); os.IsExist(err) {
+		// Another process created the key first
+		return readFile(filename)
+	} else if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// readMachineID returns an identifier that is stable for the lifetime of the OS install
+func readMachineID() (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		for _, filename := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+			if b, err := ioutil.ReadFile(filename); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+				return strings.TrimSpace(string(b)), nil
+			}
+		}
+	case "darwin":
+		out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+		if m := ioregUUID.FindSubmatch(out); err == nil && m != nil {
+			return string(m[1]), nil
+		}
+	case "windows":
+		out, err := exec.Command("reg", "query", `HKLM\SOFTWARE\Microsoft\Cryptography`, "/v", "MachineGuid").Output()
+		if m := regMachine.FindSubmatch(out); err == nil && m != nil {
+			return string(m[1]), nil
+		}
+	}
+	return "", MachineIDError
+}
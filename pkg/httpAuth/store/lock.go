@@ -0,0 +1,75 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/netflix/weep/pkg/logging"
+)
+
+// lockRetryInterval is how often a waiting process tries to take the lock. It's a variable so
+// tests can shorten it.
+var lockRetryInterval = 100 * time.Millisecond
+
+// Lock takes an exclusive lock on the named credential that is shared by every weep process for
+// the current user, waiting up to timeout for another process to release it. The returned
+// function releases the lock.
+//
+// The lock is an OS file lock (flock, or LockFileEx on Windows) on a lock file that is never
+// removed. The OS releases it when the holder exits, so a process that dies can't leave a stale
+// lock behind.
+func Lock(name string, timeout time.Duration) (func(), error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(dir, name+".lock")
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if locked {
+			return func() {
+				if err := unlockFile(f); err != nil {
+					logging.Log.Warnf("could not release lock %s: %v", lockPath, err)
+				}
+				_ = f.Close()
+			}, nil
+		}
+		if !waiting {
+			logging.Log.Infof("waiting for another weep process to finish logging in")
+			waiting = true
+		}
+		if time.Now().After(deadline) {
+			_ = f.Close()
+			return nil, fmt.Errorf("%w after %s", LockTimeoutError, timeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+func setupTestLock(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	homedir.DisableCache = true
+	oldRetry := lockRetryInterval
+	lockRetryInterval = 5 * time.Millisecond
+	t.Cleanup(func() {
+		homedir.DisableCache = false
+		lockRetryInterval = oldRetry
+	})
+	return filepath.Join(home, ".weep", "credentials.lock")
+}
+
+// contendForLock takes the lock from n goroutines at once, holding it briefly each time, and
+// returns the most that held it at the same time
+func contendForLock(t *testing.T, n int) int {
+	var mu sync.Mutex
+	holders, maxHolders := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := Lock("credentials", 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	return maxHolders
+}
+
+func TestLockIsExclusive(t *testing.T) {
+	setupTestLock(t)
+	if maxHolders := contendForLock(t, 10); maxHolders != 1 {
+		t.Errorf("got %d concurrent lock holders, expected 1", maxHolders)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	setupTestLock(t)
+	unlock, err := Lock("credentials", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lock("credentials", 50*time.Millisecond); !errors.Is(err, LockTimeoutError) {
+		t.Errorf("got %v, expected %v", err, LockTimeoutError)
+	}
+	unlock()
+	release, err := Lock("credentials", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("got %v after the lock was released", err)
+	}
+	release()
+}
+
+func TestLockContendedAfterStaleLock(t *testing.T) {
+	lockPath := setupTestLock(t)
+	if _, err := Dir(); err != nil {
+		t.Fatal(err)
+	}
+	// A lock file left behind by a process that died, as earlier versions of weep could leave
+	if err := ioutil.WriteFile(lockPath, []byte("99999"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// Two waiters find the stale lock at once, and only one holds it at a time
+	for i := 0; i < 20; i++ {
+		if maxHolders := contendForLock(t, 2); maxHolders != 1 {
+			t.Fatalf("got %d concurrent lock holders, expected 1", maxHolders)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package store persists authentication material, such as ConsoleMe JWTs and OAuth tokens, in
+// the weep directory.
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// Store reads and writes named credentials
+type Store interface {
+	// Get returns the credential stored under name, or NotFoundError
+	Get(name string) ([]byte, error)
+	// Put stores data under name, replacing any existing credential
+	Put(name string, data []byte) error
+	// Delete removes the credential stored under name. Deleting a missing credential is not an error.
+	Delete(name string) error
+}
+
+// New returns the store configured in credential_store
+func New() (Store, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	switch viper.GetString("credential_store.type") {
+	case "encrypted", "":
+		secret, err := secretFor(viper.GetString("credential_store.key_source"))
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptedFileStore(dir, secret), nil
+	case "plaintext":
+		return NewFileStore(dir), nil
+	default:
+		return nil, UnsupportedStoreError
+	}
+}
+
+// Dir returns ~/.weep, creating it if it doesn't exist
+func Dir() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(home, ".weep")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		_ = os.Mkdir(dir, 0700)
+	} else {
+		_ = os.Chmod(dir, 0700)
+	}
+	return dir, nil
+}
+
+// FileStore keeps each credential in a plaintext file readable only by the current user
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore that keeps credentials in dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) Get(name string) ([]byte, error) {
+	return readFile(filepath.Join(s.dir, name))
+}
+
+func (s *FileStore) Put(name string, data []byte) error {
+	return writeFile(filepath.Join(s.dir, name), data)
+}
+
+func (s *FileStore) Delete(name string) error {
+	return removeFile(filepath.Join(s.dir, name))
+}
+
+func readFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, NotFoundError
+	}
+	return b, err
+}
+
+// writeFile replaces filename with data by renaming a temporary file over it, so readers never
+// see a partially written credential
+func writeFile(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func removeFile(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
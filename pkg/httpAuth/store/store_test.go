@@ -0,0 +1,226 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// resetDerivedKeys empties the key cache, as in a new weep process, and counts derivations
+func resetDerivedKeys(t *testing.T) *int {
+	derivations := 0
+	oldDeriveKey := deriveKey
+	deriveKey = func(secret, salt []byte) []byte {
+		derivations++
+		return oldDeriveKey(secret, salt)
+	}
+	reset := func() {
+		derivedKeys.Lock()
+		derivedKeys.writeSalts = make(map[string][]byte)
+		derivedKeys.keys = make(map[string][]byte)
+		derivedKeys.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		deriveKey = oldDeriveKey
+		reset()
+	})
+	return &derivations
+}
+
+func TestEncryptedFileStoreDerivesKeysOnce(t *testing.T) {
+	derivations := resetDerivedKeys(t)
+	dir := t.TempDir()
+	// Callers create a store for every read and write
+	for _, name := range []string{"credentials", "oauth_token", "credentials"} {
+		if err := NewEncryptedFileStore(dir, []byte("secret")).Put(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewEncryptedFileStore(dir, []byte("secret")).Get(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *derivations != 1 {
+		t.Errorf("derived %d keys for one secret, expected 1", *derivations)
+	}
+
+	// Another process derives the key for the salt it reads once, then one for the salt it writes
+	derivations = resetDerivedKeys(t)
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"credentials", "oauth_token"} {
+			if got, err := NewEncryptedFileStore(dir, []byte("secret")).Get(name); err != nil || string(got) != name {
+				t.Errorf("got %s, %v, expected %s", got, err, name)
+			}
+		}
+	}
+	if *derivations != 1 {
+		t.Errorf("derived %d keys reading files with one salt, expected 1", *derivations)
+	}
+	if err := NewEncryptedFileStore(dir, []byte("secret")).Put("credentials", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if *derivations != 2 {
+		t.Errorf("derived %d keys after writing, expected 2", *derivations)
+	}
+	if _, err := NewEncryptedFileStore(dir, []byte("other secret")).Get("credentials"); err != DecryptionError {
+		t.Errorf("got %v with another secret, expected %v", err, DecryptionError)
+	}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s := NewEncryptedFileStore(dir, []byte("secret"))
+	data := []byte(`{"encoded_jwt": "jwt"}`)
+
+	if _, err := s.Get("credentials"); err != NotFoundError {
+		t.Errorf("got %v for a missing credential, expected %v", err, NotFoundError)
+	}
+	if err := s.Put("credentials", data); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "credentials.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("jwt")) {
+		t.Errorf("stored credential contains the plaintext")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "credentials.enc")); err == nil && info.Mode().Perm()&0077 != 0 {
+		t.Errorf("got file mode %s, expected it to be readable only by the owner", info.Mode().Perm())
+	}
+	got, err := s.Get("credentials")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %s, %v, expected %s", got, err, data)
+	}
+
+	if _, err := NewEncryptedFileStore(dir, []byte("other secret")).Get("credentials"); err != DecryptionError {
+		t.Errorf("got %v with the wrong secret, expected %v", err, DecryptionError)
+	}
+	// A file renamed to another credential's name doesn't decrypt
+	if err := ioutil.WriteFile(filepath.Join(dir, "oauth_token.enc"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("oauth_token"); err != DecryptionError {
+		t.Errorf("got %v for a swapped file, expected %v", err, DecryptionError)
+	}
+
+	if err := s.Delete("credentials"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("credentials"); err != NotFoundError {
+		t.Errorf("got %v after delete, expected %v", err, NotFoundError)
+	}
+	if err := s.Delete("credentials"); err != nil {
+		t.Errorf("deleting a missing credential returned %v", err)
+	}
+}
+
+func TestEncryptedFileStoreMigratesPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte(`{"encoded_jwt": "jwt"}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "credentials"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewEncryptedFileStore(dir, []byte("secret"))
+	got, err := s.Get("credentials")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %s, %v, expected %s", got, err, data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "credentials")); !os.IsNotExist(err) {
+		t.Errorf("expected the plaintext file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "credentials.enc")); err != nil {
+		t.Errorf("expected an encrypted file, got %v", err)
+	}
+	if got, err := s.Get("credentials"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %s, %v after migration, expected %s", got, err, data)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	homedir.DisableCache = true
+	oldMachineID := machineID
+	machineID = func() (string, error) { return "test-machine", nil }
+	defer func() {
+		homedir.DisableCache = false
+		machineID = oldMachineID
+		viper.Set("credential_store", nil)
+	}()
+
+	cases := []struct {
+		Description string
+		Type        string
+		KeySource   string
+		Passphrase  string
+		Expected    error
+		Encrypted   bool
+	}{
+		{Description: "default", Encrypted: true},
+		{Description: "passphrase", Type: "encrypted", KeySource: "passphrase", Passphrase: "hunter2", Encrypted: true},
+		{Description: "missing passphrase", Type: "encrypted", KeySource: "passphrase", Expected: MissingPassphraseError},
+		{Description: "unknown key source", KeySource: "tpm", Expected: UnsupportedKeySourceError},
+		{Description: "plaintext", Type: "plaintext"},
+		{Description: "unknown type", Type: "keychain", Expected: UnsupportedStoreError},
+	}
+	for _, tc := range cases {
+		viper.Set("credential_store.type", tc.Type)
+		viper.Set("credential_store.key_source", tc.KeySource)
+		t.Setenv(PassphraseEnvVar, tc.Passphrase)
+		s, err := New()
+		if err != tc.Expected {
+			t.Errorf("%s: got error %v, expected %v", tc.Description, err, tc.Expected)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, encrypted := s.(*EncryptedFileStore); encrypted != tc.Encrypted {
+			t.Errorf("%s: got %T", tc.Description, s)
+		}
+	}
+}
+
+func TestSecretForWithoutMachineID(t *testing.T) {
+	oldMachineID := machineID
+	machineID = func() (string, error) { return "", MachineIDError }
+	defer func() { machineID = oldMachineID }()
+
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	if _, err := secretFor("machine"); !errors.Is(err, MachineIDError) || !strings.Contains(err.Error(), "passphrase") {
+		t.Errorf("got %v without XDG_RUNTIME_DIR, expected %v pointing at the passphrase key source", err, MachineIDError)
+	}
+
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	secret, err := secretFor("machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != keySize {
+		t.Errorf("got a %d byte secret, expected %d", len(secret), keySize)
+	}
+	info, err := os.Stat(filepath.Join(runtimeDir, "weep", keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("got file mode %s, expected it to be readable only by the owner", info.Mode().Perm())
+	}
+	again, err := secretFor("")
+	if err != nil || !bytes.Equal(again, secret) {
+		t.Errorf("got %x, %v the second time, expected %x", again, err, secret)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	if other, err := secretFor(""); err != nil || bytes.Equal(other, secret) {
+		t.Errorf("got the same secret for another runtime directory")
+	}
+}
@@ -0,0 +1,26 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const CommandError = Error("token command failed")
+const EmptyTokenError = Error("ConsoleMe token is empty")
+const NoTokenError = Error("no ConsoleMe token found")
+const RejectedError = Error("ConsoleMe rejected the token, check that it's valid and hasn't expired")
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package token authenticates to ConsoleMe with a static bearer token, for CI pipelines and other
+// automation that can't complete an interactive login. The token is read from an environment
+// variable, a file, or the output of a command.
+package token
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/weep/pkg/httpAuth/transport"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+// commandTimeout is how long token_settings.command may run. It's a variable so tests can
+// shorten it.
+var commandTimeout = 30 * time.Second
+
+// cache holds the token from a file or command, so it's only read again when the file changes or
+// token_settings.refresh_interval passes
+var cache struct {
+	sync.Mutex
+	token   string
+	source  string
+	size    int64
+	modTime time.Time
+	readAt  time.Time
+}
+
+// NewHTTPClient makes sure a token is available and returns a client for ConsoleMe. The token is
+// added to each request by SetHeader, which runs as a preflight when the request is built.
+func NewHTTPClient() (*http.Client, error) {
+	if _, err := Token(); err != nil {
+		return nil, err
+	}
+	return transport.NewClient()
+}
+
+// SetHeader adds the token to req in token_settings.header, after token_settings.scheme if it's
+// set
+func SetHeader(req *http.Request) error {
+	token, err := Token()
+	if err != nil {
+		return err
+	}
+	if scheme := viper.GetString("token_settings.scheme"); scheme != "" {
+		token = scheme + " " + token
+	}
+	req.Header.Set(viper.GetString("token_settings.header"), token)
+	return nil
+}
+
+// ClassifyError returns RejectedError when ConsoleMe didn't accept the token, which logging in
+// again can't fix, and nil for any other error response
+func ClassifyError(statusCode int, body []byte) error {
+	if statusCode == http.StatusUnauthorized {
+		return RejectedError
+	}
+	var response struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && response.Code == "invalid_jwt" {
+		return RejectedError
+	}
+	return nil
+}
+
+// Token returns the token from the environment variable named by token_settings.env, or if it's
+// not set, from token_settings.file or the output of token_settings.command
+func Token() (string, error) {
+	envVar := viper.GetString("token_settings.env")
+	if envVar != "" {
+		if token := strings.TrimSpace(os.Getenv(envVar)); token != "" {
+			return token, nil
+		}
+	}
+	if file := viper.GetString("token_settings.file"); file != "" {
+		return readFile(file)
+	}
+	if command := viper.GetStringSlice("token_settings.command"); len(command) > 0 {
+		return runCommand(command)
+	}
+	return "", fmt.Errorf("%w: set %s, token_settings.file, or token_settings.command", NoTokenError, envVar)
+}
+
+// readFile returns the token in file, reading it again only when the file has changed
+func readFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not read token_settings.file: %v", NoTokenError, err)
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.source == file && cache.size == info.Size() && cache.modTime.Equal(info.ModTime()) {
+		return cache.token, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not read token_settings.file: %v", NoTokenError, err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%w: %s", EmptyTokenError, file)
+	}
+	if cache.source == file {
+		logging.Log.Infof("reloaded ConsoleMe token from %s", file)
+	}
+	cache.token, cache.source = token, file
+	cache.size, cache.modTime = info.Size(), info.ModTime()
+	return token, nil
+}
+
+// runCommand returns the output of command, running it again once
+// token_settings.refresh_interval seconds have passed
+func runCommand(command []string) (string, error) {
+	source := strings.Join(command, " ")
+	refreshInterval := time.Duration(viper.GetInt("token_settings.refresh_interval")) * time.Second
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.source == source && time.Since(cache.readAt) < refreshInterval {
+		return cache.token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: %s: %v: %s", CommandError, source, err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", fmt.Errorf("%w: %s printed nothing", EmptyTokenError, source)
+	}
+	cache.token, cache.source, cache.readAt = token, source, time.Now()
+	return token, nil
+}
@@ -0,0 +1,165 @@
+package token
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// setTestConfig configures token settings for the test and clears the cached token
+func setTestConfig(t *testing.T, settings map[string]interface{}) {
+	defaults := map[string]interface{}{
+		"env":              "WEEP_TEST_TOKEN",
+		"header":           "Authorization",
+		"scheme":           "Bearer",
+		"refresh_interval": 300,
+		"file":             "",
+		"command":          nil,
+	}
+	for key, value := range settings {
+		defaults[key] = value
+	}
+	for key, value := range defaults {
+		viper.Set("token_settings."+key, value)
+	}
+	t.Setenv("WEEP_TEST_TOKEN", "")
+	t.Cleanup(func() {
+		viper.Set("token_settings", nil)
+		cache.source = ""
+	})
+}
+
+func TestToken(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(file, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, map[string]interface{}{"file": file})
+
+	if token, err := Token(); err != nil || token != "file-token" {
+		t.Errorf("got %q and error %v, expected the token from the file", token, err)
+	}
+	t.Setenv("WEEP_TEST_TOKEN", "env-token")
+	if token, err := Token(); err != nil || token != "env-token" {
+		t.Errorf("got %q and error %v, expected the environment variable to take precedence", token, err)
+	}
+}
+
+func TestTokenFileReload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(file, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, map[string]interface{}{"file": file})
+	if token, err := Token(); err != nil || token != "first" {
+		t.Fatalf("got %q and error %v", token, err)
+	}
+
+	// Rotate the token the way a secrets agent would, by replacing the file
+	replacement := filepath.Join(dir, "token.new")
+	if err := ioutil.WriteFile(replacement, []byte("second-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, file); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := Token(); err != nil || token != "second-token" {
+		t.Errorf("got %q and error %v, expected the rotated token", token, err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Token(); !errors.Is(err, EmptyTokenError) {
+		t.Errorf("got %v for an empty file, expected %v", err, EmptyTokenError)
+	}
+}
+
+func TestTokenCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	setTestConfig(t, map[string]interface{}{
+		"command": []string{"sh", "-c", "echo run >> " + counter + "; echo command-token"},
+	})
+	for i := 0; i < 2; i++ {
+		if token, err := Token(); err != nil || token != "command-token" {
+			t.Fatalf("got %q and error %v", token, err)
+		}
+	}
+	if b, _ := ioutil.ReadFile(counter); string(b) != "run\n" {
+		t.Errorf("expected the command to run once within the refresh interval, got runs %q", b)
+	}
+
+	viper.Set("token_settings.command", []string{"sh", "-c", "echo denied >&2; exit 1"})
+	if _, err := Token(); !errors.Is(err, CommandError) {
+		t.Errorf("got %v for a failing command, expected %v", err, CommandError)
+	}
+
+	viper.Set("token_settings.command", []string{"sleep", "5"})
+	commandTimeout = 10 * time.Millisecond
+	defer func() { commandTimeout = 30 * time.Second }()
+	if _, err := Token(); !errors.Is(err, CommandError) {
+		t.Errorf("got %v for a command that timed out, expected %v", err, CommandError)
+	}
+}
+
+func TestNoToken(t *testing.T) {
+	setTestConfig(t, nil)
+	if _, err := NewHTTPClient(); !errors.Is(err, NoTokenError) {
+		t.Errorf("got %v, expected %v", err, NoTokenError)
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	cases := []struct {
+		Description string
+		Header      string
+		Scheme      string
+		Expected    string
+	}{
+		{Description: "bearer token", Header: "Authorization", Scheme: "Bearer", Expected: "Bearer secret"},
+		{Description: "custom header", Header: "X-Api-Token", Scheme: "", Expected: "secret"},
+	}
+	for _, tc := range cases {
+		setTestConfig(t, map[string]interface{}{"header": tc.Header, "scheme": tc.Scheme})
+		t.Setenv("WEEP_TEST_TOKEN", "secret")
+		req, _ := http.NewRequest(http.MethodGet, "https://consoleme.example.com/api/v1/get_roles", nil)
+		if err := SetHeader(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get(tc.Header); got != tc.Expected {
+			t.Errorf("%s: got %s header %q, expected %q", tc.Description, tc.Header, got, tc.Expected)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		Description string
+		StatusCode  int
+		Body        string
+		Expected    error
+	}{
+		{Description: "unauthorized", StatusCode: http.StatusUnauthorized, Expected: RejectedError},
+		{Description: "invalid_jwt", StatusCode: http.StatusForbidden, Body: `{"code": "invalid_jwt"}`, Expected: RejectedError},
+		{Description: "other ConsoleMe error", StatusCode: http.StatusForbidden, Body: `{"code": "900"}`},
+		{Description: "not JSON", StatusCode: http.StatusInternalServerError, Body: "oops"},
+	}
+	for _, tc := range cases {
+		if err := ClassifyError(tc.StatusCode, []byte(tc.Body)); err != tc.Expected {
+			t.Errorf("%s: got %v, expected %v", tc.Description, err, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package transport builds the HTTP transport used for every request to ConsoleMe and the
+// services behind its authentication methods, so timeouts, proxies, trusted CAs, HTTP/2 and
+// connection pooling are the same whichever method is in use.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	sharedMu sync.Mutex
+	shared   *http.Transport
+)
+
+// Default returns the transport shared by requests that don't need their own TLS configuration.
+// It's built from the configuration on first use.
+func Default() (*http.Transport, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if shared == nil {
+		t, err := New(nil)
+		if err != nil {
+			return nil, err
+		}
+		shared = t
+	}
+	return shared, nil
+}
+
+// NewClient returns a client that uses the shared transport
+func NewClient() (*http.Client, error) {
+	t, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// New builds a transport from server.http_timeout and http_settings. TLS connections use
+// tlsConfig if it isn't nil, otherwise they trust the system roots and http_settings.ca_bundles.
+func New(tlsConfig *tls.Config) (*http.Transport, error) {
+	if tlsConfig == nil {
+		roots, err := rootCAs()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{RootCAs: roots}
+	}
+	proxy, err := proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(viper.GetInt("server.http_timeout")) * time.Second
+	maxIdleConnsPerHost := viper.GetInt("http_settings.max_idle_conns_per_host")
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = runtime.GOMAXPROCS(0) + 1
+	}
+	t := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     viper.GetBool("http_settings.http2"),
+		MaxIdleConns:          viper.GetInt("http_settings.max_idle_conns"),
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       viper.GetInt("http_settings.max_conns_per_host"),
+		IdleConnTimeout:       time.Duration(viper.GetInt("http_settings.idle_conn_timeout")) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !t.ForceAttemptHTTP2 {
+		// A non-nil, empty map turns off HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t, nil
+}
+
+// CABundles returns the extra CA bundles from http_settings.ca_bundles
+func CABundles() []string {
+	return viper.GetStringSlice("http_settings.ca_bundles")
+}
+
+// rootCAs returns the system roots with the extra CA bundles added, or nil to use the system
+// roots as they are
+func rootCAs() (*x509.CertPool, error) {
+	bundles := CABundles()
+	if len(bundles) == 0 {
+		return nil, nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	for _, bundle := range bundles {
+		pem, err := ioutil.ReadFile(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle %s: %w", bundle, err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", InvalidCABundleError, bundle)
+		}
+	}
+	return roots, nil
+}
+
+// proxyFunc returns the proxy function for http_settings.proxy and http_settings.no_proxy. Without
+// a configured proxy, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+func proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	proxy := viper.GetString("http_settings.proxy")
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("%w: %s", InvalidProxyError, proxy)
+	}
+	noProxy := viper.GetStringSlice("http_settings.no_proxy")
+	if !viper.IsSet("http_settings.no_proxy") {
+		noProxy = []string{os.Getenv("NO_PROXY"), os.Getenv("no_proxy")}
+	}
+	bypass := parseNoProxy(noProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass.matches(req.URL) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// noProxy holds the hosts that are reached directly instead of through the proxy
+type noProxy struct {
+	all     bool
+	domains []string
+	hosts   []string
+	cidrs   []*net.IPNet
+}
+
+// parseNoProxy parses entries in the usual no_proxy format: "*", IP addresses, CIDR ranges, and
+// domain names, which match their subdomains too. Entries may be comma-separated and may have a
+// port.
+func parseNoProxy(entries []string) noProxy {
+	var n noProxy
+	for _, entry := range entries {
+		for _, e := range strings.Split(entry, ",") {
+			e = strings.ToLower(strings.TrimSpace(e))
+			switch {
+			case e == "":
+			case e == "*":
+				n.all = true
+			case strings.Contains(e, "/"):
+				if _, cidr, err := net.ParseCIDR(e); err == nil {
+					n.cidrs = append(n.cidrs, cidr)
+				}
+			default:
+				if host, port, err := net.SplitHostPort(e); err == nil {
+					// The port has to match too
+					n.hosts = append(n.hosts, net.JoinHostPort(strings.Trim(host, "[]"), port))
+					continue
+				}
+				n.domains = append(n.domains, strings.TrimPrefix(strings.TrimPrefix(e, "*"), "."))
+			}
+		}
+	}
+	return n
+}
+
+// matches reports whether u should bypass the proxy
+func (n noProxy) matches(u *url.URL) bool {
+	if n.all {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, cidr := range n.cidrs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, h := range n.hosts {
+		if h == net.JoinHostPort(host, port) {
+			return true
+		}
+	}
+	for _, d := range n.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
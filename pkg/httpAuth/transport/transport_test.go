@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/netflix/weep/pkg/config/configtest"
+)
+
+func TestProxy(t *testing.T) {
+	configtest.Set(t, map[string]interface{}{
+		"http_settings.proxy":    "http://proxy.example.com:3128",
+		"http_settings.no_proxy": []string{"internal.example.com, .corp.example.com", "10.0.0.0/8", "consoleme.example.com:8443"},
+	})
+	tr, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		Description string
+		URL         string
+		Proxied     bool
+	}{
+		{Description: "external host", URL: "https://consoleme.example.com/api/v1/get_roles", Proxied: true},
+		{Description: "domain in no_proxy", URL: "https://internal.example.com/", Proxied: false},
+		{Description: "subdomain in no_proxy", URL: "https://idp.internal.example.com/", Proxied: false},
+		{Description: "domain with a leading dot", URL: "http://corp.example.com/", Proxied: false},
+		{Description: "similar suffix", URL: "https://notinternal.example.com/", Proxied: true},
+		{Description: "address in a CIDR range", URL: "http://10.1.2.3/", Proxied: false},
+		{Description: "host and port in no_proxy", URL: "https://consoleme.example.com:8443/", Proxied: false},
+		{Description: "loopback", URL: "http://127.0.0.1:9091/", Proxied: false},
+	}
+	for _, tc := range cases {
+		u, _ := url.Parse(tc.URL)
+		proxyURL, err := tr.Proxy(&http.Request{URL: u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proxied := proxyURL != nil; proxied != tc.Proxied {
+			t.Errorf("%s: got proxy %v, expected proxied to be %v", tc.Description, proxyURL, tc.Proxied)
+		}
+	}
+
+	configtest.Set(t, map[string]interface{}{"http_settings.proxy": "://invalid"})
+	if _, err := New(nil); !errors.Is(err, InvalidProxyError) {
+		t.Errorf("got %v, expected %v", err, InvalidProxyError)
+	}
+}
+
+func TestCABundles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(bundle, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalid, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: tr}).Get(server.URL); err == nil {
+		t.Errorf("expected the test server to be untrusted without a CA bundle")
+	}
+
+	configtest.Set(t, map[string]interface{}{"http_settings.ca_bundles": []string{bundle}})
+	if tr, err = New(nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the CA bundle to be trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	configtest.Set(t, map[string]interface{}{"http_settings.ca_bundles": []string{invalid}})
+	if _, err := New(nil); !errors.Is(err, InvalidCABundleError) {
+		t.Errorf("got %v, expected %v", err, InvalidCABundleError)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cases := []struct {
+		Description string
+		HTTP2       bool
+		Expected    string
+	}{
+		{Description: "HTTP/2 enabled", HTTP2: true, Expected: "HTTP/2.0"},
+		{Description: "HTTP/2 disabled", HTTP2: false, Expected: "HTTP/1.1"},
+	}
+	for _, tc := range cases {
+		configtest.Set(t, map[string]interface{}{"http_settings.http2": tc.HTTP2})
+		tr, err := New(server.Client().Transport.(*http.Transport).TLSClientConfig.Clone())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: tr}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tc.Expected {
+			t.Errorf("%s: got %s, expected %s", tc.Description, body, tc.Expected)
+		}
+	}
+}
@@ -67,6 +67,11 @@ func StartupTime() string {
 	return weepStartupTime.UTC().Format("2006-01-02T15:04:05Z")
 }
 
+// StartupTimestamp returns the time weep started
+func StartupTimestamp() time.Time {
+	return weepStartupTime
+}
+
 func elapsedSeconds(startTime, endTime time.Time) int {
 	if startTime.IsZero() || endTime.IsZero() {
 		return 0
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	PeerNotFoundError  = Error("could not find the process on the other end of the connection")
+	UnsupportedOSError = Error("peer process lookup is not supported on this operating system")
+)
+
+// Process describes the local process on the other end of a TCP connection.
+// PID is zero and Executable is empty when the socket owner is known but the
+// process itself could not be inspected, usually because it belongs to another user.
+type Process struct {
+	PID        int    `json:"pid,omitempty"`
+	UID        int    `json:"uid"`
+	GIDs       []int  `json:"gids,omitempty"`
+	Executable string `json:"executable,omitempty"`
+	exePath    string
+}
+
+// ExecutableHash returns the hex-encoded SHA-256 digest of the process's executable.
+// The binary is read through procfs rather than Executable, so a file replaced on disk
+// after the process started can't be used to spoof the hash.
+func (p *Process) ExecutableHash() (string, error) {
+	if p.exePath == "" {
+		return "", PeerNotFoundError
+	}
+	f, err := os.Open(p.exePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type contextKey struct{}
+
+// WithProcess returns a shallow copy of r that carries p, so later handlers can skip
+// another lookup.
+func WithProcess(r *http.Request, p *Process) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, p))
+}
+
+// FromRequest identifies the process that sent r by matching the request's
+// remote and local addresses against the host's socket table.
+func FromRequest(r *http.Request) (*Process, error) {
+	if p, ok := r.Context().Value(contextKey{}).(*Process); ok {
+		return p, nil
+	}
+	remote, err := parseAddr(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil, PeerNotFoundError
+	}
+	local, err := parseAddr(localAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return Lookup(remote, local)
+}
+
+func parseAddr(addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, PeerNotFoundError
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	procRoot       = "/proc"
+	socketTables   = []string{"net/tcp", "net/tcp6"}
+	errMalformedIP = Error("malformed address in socket table")
+)
+
+// Lookup finds the process that owns the TCP socket bound to remote and connected to local,
+// i.e. the client side of a connection accepted by weep.
+func Lookup(remote, local *net.TCPAddr) (*Process, error) {
+	for _, table := range socketTables {
+		uid, inode, found, err := findSocket(filepath.Join(procRoot, table), remote, local)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		p := &Process{UID: uid}
+		if pid, ok := findSocketOwner(inode); ok {
+			p.PID = pid
+			p.exePath = filepath.Join(procRoot, strconv.Itoa(pid), "exe")
+			p.Executable, _ = os.Readlink(p.exePath)
+			p.GIDs, _ = readGroups(pid)
+		}
+		return p, nil
+	}
+	return nil, PeerNotFoundError
+}
+
+// findSocket scans a /proc/net/tcp style table for a socket with the given local and remote
+// addresses and returns its owner UID and inode.
+func findSocket(table string, localAddr, remoteAddr *net.TCPAddr) (int, string, bool, error) {
+	f, err := os.Open(table)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip the header line
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		l, err := parseProcAddr(fields[1])
+		if err != nil || !addrEqual(l, localAddr) {
+			continue
+		}
+		r, err := parseProcAddr(fields[2])
+		if err != nil || !addrEqual(r, remoteAddr) {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return 0, "", false, err
+		}
+		return uid, fields[9], true, nil
+	}
+	return 0, "", false, scanner.Err()
+}
+
+// findSocketOwner walks /proc/*/fd looking for a file descriptor that refers to the socket inode.
+// Processes owned by other users are skipped unless weep has permission to read their fds.
+func findSocketOwner(inode string) (int, bool) {
+	target := fmt.Sprintf("socket:[%s]", inode)
+	procs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return 0, false
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && link == target {
+				return pid, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// readGroups returns the primary and supplementary group IDs of a process from /proc/<pid>/status.
+func readGroups(pid int) ([]int, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var gids []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var values []string
+		switch {
+		case strings.HasPrefix(line, "Gid:"):
+			// Gid: real effective saved filesystem
+			values = strings.Fields(strings.TrimPrefix(line, "Gid:"))
+			if len(values) > 1 {
+				values = values[1:2]
+			}
+		case strings.HasPrefix(line, "Groups:"):
+			values = strings.Fields(strings.TrimPrefix(line, "Groups:"))
+		default:
+			continue
+		}
+		for _, v := range values {
+			gid, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, err
+			}
+			gids = append(gids, gid)
+		}
+	}
+	return gids, scanner.Err()
+}
+
+// parseProcAddr decodes an address like 0100007F:1F93 from /proc/net/tcp. The kernel prints
+// the address as 32-bit words in host byte order, which is little-endian on every platform
+// weep is built for.
+func parseProcAddr(s string) (*net.TCPAddr, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, errMalformedIP
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, errMalformedIP
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, errMalformedIP
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func addrEqual(a, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,106 @@
+package peer
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseProcAddr(t *testing.T) {
+	cases := []struct {
+		Description   string
+		Input         string
+		ExpectedIP    string
+		ExpectedPort  int
+		ExpectedError bool
+	}{
+		{
+			Description:  "ipv4 loopback",
+			Input:        "0100007F:238B",
+			ExpectedIP:   "127.0.0.1",
+			ExpectedPort: 9099,
+		},
+		{
+			Description:  "ipv6 loopback",
+			Input:        "00000000000000000000000001000000:238B",
+			ExpectedIP:   "::1",
+			ExpectedPort: 9099,
+		},
+		{
+			Description:  "ipv4-mapped ipv6",
+			Input:        "0000000000000000FFFF00000100007F:0050",
+			ExpectedIP:   "127.0.0.1",
+			ExpectedPort: 80,
+		},
+		{
+			Description:   "missing port",
+			Input:         "0100007F",
+			ExpectedError: true,
+		},
+		{
+			Description:   "bad length",
+			Input:         "0100:0050",
+			ExpectedError: true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		addr, err := parseProcAddr(tc.Input)
+		if tc.ExpectedError {
+			if err == nil {
+				t.Errorf("%s failed: expected error, got nil", tc.Description)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s failed: unexpected error: %v", tc.Description, err)
+			continue
+		}
+		if !addr.IP.Equal(net.ParseIP(tc.ExpectedIP)) || addr.Port != tc.ExpectedPort {
+			t.Errorf("%s failed: got %s, expected %s:%d", tc.Description, addr, tc.ExpectedIP, tc.ExpectedPort)
+		}
+	}
+}
+
+// TestLookup connects to a loopback listener and makes sure the client end of the
+// connection resolves to this test process.
+func TestLookup(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer server.Close()
+
+	p, err := Lookup(server.RemoteAddr().(*net.TCPAddr), server.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if p.PID != os.Getpid() {
+		t.Errorf("got pid %d, expected %d", p.PID, os.Getpid())
+	}
+	if p.UID != os.Getuid() {
+		t.Errorf("got uid %d, expected %d", p.UID, os.Getuid())
+	}
+	if p.Executable == "" {
+		t.Errorf("executable not set")
+	}
+	if len(p.GIDs) == 0 || p.GIDs[0] != os.Getegid() {
+		t.Errorf("got gids %v, expected primary gid %d", p.GIDs, os.Getegid())
+	}
+	if hash, err := p.ExecutableHash(); err != nil || len(hash) != 64 {
+		t.Errorf("got hash %q and error %v, expected sha256 digest", hash, err)
+	}
+}
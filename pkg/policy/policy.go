@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/netflix/weep/pkg/peer"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/spf13/viper"
+)
+
+// Rule allows processes matching every populated field to obtain credentials. A rule with
+// no Roles applies to any role that isn't named by another rule.
+type Rule struct {
+	Roles       []string `mapstructure:"roles"`
+	UIDs        []int    `mapstructure:"uids"`
+	Groups      []string `mapstructure:"groups"`
+	Executables []string `mapstructure:"executables"`
+	SHA256      []string `mapstructure:"sha256"`
+	gids        []int
+}
+
+type Config struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Rules   []Rule `mapstructure:"rules"`
+}
+
+// Policy is an allowlist of local processes that may obtain credentials
+type Policy struct {
+	rules []Rule
+}
+
+// Load reads the process policy from the server.process_policy config key. It returns
+// nil if the policy is disabled.
+func Load() (*Policy, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("server.process_policy", &cfg); err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return New(cfg.Rules)
+}
+
+// New creates a Policy from rules, resolving group names to IDs.
+func New(rules []Rule) (*Policy, error) {
+	for i := range rules {
+		for _, group := range rules[i].Groups {
+			gid, err := lookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			rules[i].gids = append(rules[i].gids, gid)
+		}
+	}
+	return &Policy{rules: rules}, nil
+}
+
+// Allowed returns true if process may obtain credentials for role, which is an ARN or a bare role
+// name. When access is denied, the second return value describes why.
+func (p *Policy) Allowed(process *peer.Process, role string) (bool, string) {
+	if process == nil {
+		return false, "requesting process could not be identified"
+	}
+	rules := p.rulesFor(role)
+	if len(rules) == 0 {
+		return false, "no rule allows access to role"
+	}
+	for _, rule := range rules {
+		if rule.matches(process) {
+			return true, ""
+		}
+	}
+	return false, "requesting process does not match any rule for role"
+}
+
+// rulesFor returns the rules that name role, falling back to rules that don't name any role.
+func (p *Policy) rulesFor(role string) []Rule {
+	var specific, general []Rule
+	for _, rule := range p.rules {
+		if len(rule.Roles) == 0 {
+			general = append(general, rule)
+			continue
+		}
+		for _, configured := range rule.Roles {
+			if roleMatches(configured, role) {
+				specific = append(specific, rule)
+				break
+			}
+		}
+	}
+	if len(specific) > 0 {
+		return specific
+	}
+	return general
+}
+
+// roleMatches compares a configured role against a requested role. Both can be full ARNs or bare
+// role names, and a bare name matches an ARN for a role with that name.
+func roleMatches(configured, role string) bool {
+	if strings.EqualFold(configured, role) {
+		return true
+	}
+	if !strings.HasPrefix(role, "arn:") {
+		return strings.EqualFold(roleName(configured), role)
+	}
+	return strings.EqualFold(configured, roleName(role))
+}
+
+// roleName returns the name at the end of a role ARN
+func roleName(roleArn string) string {
+	splitArn := strings.Split(roleArn, "/")
+	return splitArn[len(splitArn)-1]
+}
+
+func (r Rule) matches(process *peer.Process) bool {
+	if len(r.UIDs) > 0 && !intInSlice(process.UID, r.UIDs) {
+		return false
+	}
+	if len(r.gids) > 0 {
+		found := false
+		for _, gid := range process.GIDs {
+			if intInSlice(gid, r.gids) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Executables) > 0 {
+		if process.Executable == "" || !util.StringInSlice(process.Executable, r.Executables) {
+			return false
+		}
+	}
+	if len(r.SHA256) > 0 {
+		hash, err := process.ExecutableHash()
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, h := range r.SHA256 {
+			if strings.EqualFold(h, hash) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupGroup returns the ID of a group specified by name or numeric ID
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("invalid group in process policy: %w", err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+func intInSlice(elem int, list []int) bool {
+	for _, i := range list {
+		if i == elem {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/netflix/weep/pkg/peer"
+)
+
+func TestAllowed(t *testing.T) {
+	p, err := New([]Rule{
+		{
+			Roles:       []string{"prod_admin"},
+			Executables: []string{"/usr/bin/terraform"},
+		},
+		{
+			Roles: []string{"arn:aws:iam::123456789012:role/prod_readonly"},
+			UIDs:  []int{1001},
+		},
+		{
+			UIDs:   []int{1000},
+			Groups: []string{"20"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	cases := []struct {
+		Description     string
+		Process         *peer.Process
+		Role            string
+		ExpectedAllowed bool
+	}{
+		{
+			Description:     "unidentified process",
+			Process:         nil,
+			Role:            "arn:aws:iam::123456789012:role/dev",
+			ExpectedAllowed: false,
+		},
+		{
+			Description:     "general rule matches",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{1000, 20}},
+			Role:            "arn:aws:iam::123456789012:role/dev",
+			ExpectedAllowed: true,
+		},
+		{
+			Description:     "general rule wrong uid",
+			Process:         &peer.Process{UID: 1001, GIDs: []int{20}},
+			Role:            "arn:aws:iam::123456789012:role/dev",
+			ExpectedAllowed: false,
+		},
+		{
+			Description:     "general rule missing group",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{1000}},
+			Role:            "arn:aws:iam::123456789012:role/dev",
+			ExpectedAllowed: false,
+		},
+		{
+			Description:     "role rule matches executable",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{20}, Executable: "/usr/bin/terraform"},
+			Role:            "arn:aws:iam::123456789012:role/prod_admin",
+			ExpectedAllowed: true,
+		},
+		{
+			Description:     "role rule takes precedence over general rule",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{20}, Executable: "/usr/bin/curl"},
+			Role:            "arn:aws:iam::123456789012:role/prod_admin",
+			ExpectedAllowed: false,
+		},
+		{
+			Description:     "role requested by name uses the rule for its ARN",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{20}},
+			Role:            "prod_readonly",
+			ExpectedAllowed: false,
+		},
+		{
+			Description:     "role requested by name allowed by a rule for its ARN",
+			Process:         &peer.Process{UID: 1001},
+			Role:            "prod_readonly",
+			ExpectedAllowed: true,
+		},
+		{
+			Description:     "role rule applies to the same name in another account",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{20}, Executable: "/usr/bin/curl"},
+			Role:            "arn:aws:iam::210987654321:role/prod_admin",
+			ExpectedAllowed: false,
+		},
+		{
+			Description:     "unnamed role falls back to general rule",
+			Process:         &peer.Process{UID: 1000, GIDs: []int{20}},
+			Role:            "arn:aws:iam::123456789012:role/hashed",
+			ExpectedAllowed: true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		allowed, reason := p.Allowed(tc.Process, tc.Role)
+		if allowed != tc.ExpectedAllowed {
+			t.Errorf("%s failed: got allowed %v (%s), expected %v", tc.Description, allowed, reason, tc.ExpectedAllowed)
+		}
+	}
+}
+
+func TestAllowedHash(t *testing.T) {
+	p, err := New([]Rule{{SHA256: []string{"abc123"}}})
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+	if allowed, _ := p.Allowed(&peer.Process{UID: 1000, Executable: "/usr/bin/terraform"}, "role"); allowed {
+		t.Errorf("process without a readable executable should not match a hash rule")
+	}
+}
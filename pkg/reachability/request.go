@@ -1,18 +1,33 @@
 package reachability
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 
 	"github.com/netflix/weep/pkg/logging"
 )
 
-// TestReachability sends a GET request to the address IMDS is expected to run, while checks
-// whether this test was received by this same Weep instance, otherwise logs a warning
-func TestReachability() {
+const (
+	// IPv4Endpoint is the IPv4 address of IMDS
+	IPv4Endpoint = "169.254.169.254"
+	// IPv6Endpoint is the IPv6 address of IMDS on Nitro instances
+	IPv6Endpoint = "fd00:ec2::254"
+)
+
+// TestReachability sends a GET request to each address IMDS is expected to run, while checks
+// whether each test was received by this same Weep instance, otherwise logs a warning
+func TestReachability(endpoints ...string) {
+	for _, endpoint := range endpoints {
+		testEndpoint(endpoint)
+	}
+}
+
+func testEndpoint(endpoint string) {
 	go func() {
-		logging.Log.Debug("Doing a healthcheck request on 169.254.169.254")
-		resp, err := http.Get("http://169.254.169.254/healthcheck?reachability=1")
+		logging.Log.Debugf("Doing a healthcheck request on %s", endpoint)
+		resp, err := http.Get(fmt.Sprintf("http://%s/healthcheck?reachability=1", net.JoinHostPort(endpoint, "80")))
 
 		// A response can be successful but have being served by another process on the
 		// IMDS port/an actual IMDS. So we prefer relying on the reachability signal (which
@@ -21,16 +36,18 @@ func TestReachability() {
 		if err != nil {
 			logging.Log.WithField("err", err).Debug("Received an error from healthcheck route")
 		} else {
+			resp.Body.Close()
 			logging.Log.WithField("status", resp.StatusCode).Debug("Received a response from healthcheck route")
 		}
 	}()
 
 	received := wait()
 	if received {
-		logging.Log.Info("Reachability test was successful")
+		logging.Log.Infof("Reachability test on %s was successful", endpoint)
 	} else {
 		logging.Log.Warningf(
-			"Reachability test was unsuccessful. Looks like we aren't being served in 169.254.169.254. Did you `%s setup`?",
+			"Reachability test was unsuccessful. Looks like we aren't being served in %s. Did you `%s setup`?",
+			endpoint,
 			os.Args[0],
 		)
 	}
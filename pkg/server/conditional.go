@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/netflix/weep/pkg/audit"
+	"github.com/netflix/weep/pkg/cache"
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/metadata"
+	"github.com/netflix/weep/pkg/types"
+)
+
+// bufferedResponseWriter holds a handler's response so headers that depend on the body
+// can be set before anything is sent to the client
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// sent runs after the body has been written, and not for a 304
+	sent []func()
+}
+
+func newBufferedResponseWriter(w http.ResponseWriter) *bufferedResponseWriter {
+	return &bufferedResponseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// finish sets the ETag and Last-Modified headers and writes the buffered response, or a 304
+// if the request's conditional headers show the client already has it
+func (b *bufferedResponseWriter) finish(r *http.Request) {
+	header := b.ResponseWriter.Header()
+	etag := contentETag(b.body.Bytes())
+	header.Set("ETag", etag)
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = defaultLastModified()
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if b.status == http.StatusOK && (r.Method == http.MethodGet || r.Method == http.MethodHead) && notModified(r, etag, lastModified) {
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		b.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	b.ResponseWriter.WriteHeader(b.status)
+	if _, err := b.ResponseWriter.Write(b.body.Bytes()); err != nil {
+		logging.Log.Errorf("failed to write response: %v", err)
+		return
+	}
+	for _, f := range b.sent {
+		f()
+	}
+}
+
+// afterSent runs f once the response body has actually been sent. When w buffers the response,
+// that's after the conditional headers have been checked, so nothing runs for a 304.
+func afterSent(w http.ResponseWriter, f func()) {
+	if b, ok := w.(*bufferedResponseWriter); ok {
+		b.sent = append(b.sent, f)
+		return
+	}
+	f()
+}
+
+// auditCredentialsIssued records that credentials from rp are sent in the response to r
+func auditCredentialsIssued(w http.ResponseWriter, r *http.Request, source string, rp *creds.RefreshableProvider) {
+	afterSent(w, func() {
+		audit.CredentialsIssued(r, source, rp)
+	})
+}
+
+// setLastModified records when the content of a response last changed
+func setLastModified(w http.ResponseWriter, t types.Time) {
+	if !t.Time().IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// defaultLastModified returns the last time the default role's credentials were refreshed,
+// or the time weep started if there is no default role
+func defaultLastModified() time.Time {
+	if c, err := cache.GlobalCache.GetDefault(); err == nil && !c.LastRefreshed.Time().IsZero() {
+		return c.LastRefreshed.Time()
+	}
+	return metadata.StartupTimestamp()
+}
+
+// contentETag returns a strong ETag for body
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since when it isn't present,
+// as described in RFC 7232
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/netflix/weep/pkg/cache"
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/gorilla/mux"
+)
+
+// CredentialEndpoint is an ECS credential provider endpoint for a single role, listening on an
+// ephemeral loopback port. Requests must present Token in the Authorization header.
+type CredentialEndpoint struct {
+	URL   string
+	Token string
+	srv   *http.Server
+}
+
+// NewCredentialEndpoint retrieves credentials for role and starts serving them. The credentials
+// are refreshed automatically for as long as the endpoint is running.
+func NewCredentialEndpoint(role, region string, assumeChain []string) (*CredentialEndpoint, error) {
+	if err := configure(); err != nil {
+		return nil, err
+	}
+	client, err := creds.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	rp, err := cache.GlobalCache.GetOrSet(client, role, region, assumeChain)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateAuthorizationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	resolve := func(r *http.Request) (*creds.RefreshableProvider, error) {
+		return rp, nil
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/ecs/credentials", TaskMetadataMiddleware(AuthorizationMiddleware(token, ProcessPolicyMiddleware("exec", providerRoleNames(rp), resolve, ecsCredentialHandler("exec", resolve, ecsCredentialResponse)))))
+	router.HandleFunc("/{path:.*}", TaskMetadataMiddleware(NotFoundHandler))
+
+	e := &CredentialEndpoint{
+		URL:   fmt.Sprintf("http://%s/ecs/credentials", ln.Addr()),
+		Token: token,
+		srv: &http.Server{
+			ReadTimeout:       1 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       30 * time.Second,
+			ReadHeaderTimeout: 2 * time.Second,
+			Handler:           router,
+		},
+	}
+	go func() {
+		if err := e.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.LogError(err, "credential endpoint failed")
+		}
+	}()
+	logging.Log.Debugf("serving credentials for %s on %s", rp.RoleArn, e.URL)
+	return e, nil
+}
+
+// Close stops the endpoint
+func (e *CredentialEndpoint) Close() error {
+	return e.srv.Close()
+}
+
+// AuthorizationMiddleware rejects requests that don't present token in the Authorization header,
+// the way AWS SDKs send AWS_CONTAINER_AUTHORIZATION_TOKEN
+func AuthorizationMiddleware(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logging.Log.Warn("request with invalid authorization token")
+			util.WriteError(w, "invalid authorization token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func generateAuthorizationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
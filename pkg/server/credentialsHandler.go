@@ -23,12 +23,11 @@ import (
 
 	"github.com/netflix/weep/pkg/logging"
 
-	"github.com/netflix/weep/pkg/cache"
 	"github.com/netflix/weep/pkg/util"
 )
 
 func RoleHandler(w http.ResponseWriter, r *http.Request) {
-	defaultRole, err := cache.GlobalCache.GetDefault()
+	defaultRole, err := instanceRoleResolver(r)
 	if err != nil {
 		util.WriteError(w, "error", 500)
 		return
@@ -40,7 +39,7 @@ func RoleHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func IMDSHandler(w http.ResponseWriter, r *http.Request) {
-	c, err := cache.GlobalCache.GetDefault()
+	c, err := instanceRoleResolver(r)
 	if err != nil {
 		logging.Log.Errorf("could not get credentials from cache: %e", err)
 		util.WriteError(w, err.Error(), http.StatusBadRequest)
@@ -63,8 +62,11 @@ func IMDSHandler(w http.ResponseWriter, r *http.Request) {
 		Expiration:      c.Expiration.UTC().Format("2006-01-02T15:04:05Z"),
 	}
 
+	setLastModified(w, c.LastRefreshed)
 	err = json.NewEncoder(w).Encode(credentialResponse)
 	if err != nil {
 		logging.Log.Errorf("failed to write response: %v", err)
+		return
 	}
+	auditCredentialsIssued(w, r, "imds", c)
 }
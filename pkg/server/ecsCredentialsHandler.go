@@ -29,6 +29,7 @@ import (
 	"github.com/netflix/weep/pkg/util"
 
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/gorilla/mux"
 )
 
@@ -54,27 +55,94 @@ func parseAssumeRoleQuery(r *http.Request) ([]string, error) {
 	return roles, nil
 }
 
-func getCredentialHandler(region string) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var client, err = creds.GetClient()
-		if err != nil {
-			logging.LogError(err, "error getting credentials")
-			util.WriteError(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+// ecsRoleNames returns the names of the role ecsRoleResolver returns for r, without fetching
+// credentials for it
+func ecsRoleNames(r *http.Request) ([]string, error) {
+	assume, err := parseAssumeRoleQuery(r)
+	if err != nil {
+		return nil, err
+	}
+	requestedRole := mux.Vars(r)["role"]
+	sr, err := ecsSourceRole(r, requestedRole, assume)
+	if err != nil {
+		return nil, err
+	}
+	if sr != nil {
+		return append([]string{sr.Role}, sr.Assume...), nil
+	}
+	return append([]string{requestedRole}, assume...), nil
+}
+
+// ecsSourceRole returns the mapping for the source address of r, or nil if there isn't one.
+// Sources with a mapped role always get that role, and can't ask for a different one.
+func ecsSourceRole(r *http.Request, requestedRole string, assume []string) (*SourceRole, error) {
+	sr := sourceRoleFor(r)
+	if sr != nil && !sr.matches(requestedRole, assume) {
+		logging.Log.Warnf("%s requested %s but is mapped to %s", r.RemoteAddr, requestedRole, sr.Role)
+		return nil, fmt.Errorf("source is mapped to role %s", sr.Role)
+	}
+	return sr, nil
+}
+
+// ecsRoleResolver returns a RoleResolver for the role named in the path of an ECS credential request, or
+// the role mapped to the request's source address
+func ecsRoleResolver(region string) RoleResolver {
+	return func(r *http.Request) (*creds.RefreshableProvider, error) {
 		assume, err := parseAssumeRoleQuery(r)
 		if err != nil {
 			logging.LogError(err, "error parsing assume role query")
-			util.WriteError(w, err.Error(), http.StatusBadRequest)
-			return
+			return nil, err
 		}
 		vars := mux.Vars(r)
 		requestedRole := vars["role"]
 
+		sr, err := ecsSourceRole(r, requestedRole, assume)
+		if err != nil {
+			return nil, err
+		}
+		if sr != nil {
+			return sr.provider, nil
+		}
+
+		client, err := creds.GetClient()
+		if err != nil {
+			logging.LogError(err, "error getting credentials")
+			return nil, err
+		}
 		cached, err := cache.GlobalCache.GetOrSet(client, requestedRole, region, assume)
 		if err != nil {
 			// TODO: handle error better and return a helpful response/status
 			logging.Log.Errorf("failed to get credentials: %s", err)
+			return nil, err
+		}
+		return cached, nil
+	}
+}
+
+func getCredentialHandler(region string) func(http.ResponseWriter, *http.Request) {
+	return ecsCredentialHandler("ecs", ecsRoleResolver(region), ecsCredentialResponse)
+}
+
+// credentialResponse returns the response body for credentials from rp
+type credentialResponse func(rp *creds.RefreshableProvider, value credentials.Value) interface{}
+
+// ecsCredentialResponse is the format used by the ECS container credential provider
+func ecsCredentialResponse(rp *creds.RefreshableProvider, value credentials.Value) interface{} {
+	return ECSMetaDataCredentialResponse{
+		AccessKeyId:     value.AccessKeyID,
+		Expiration:      rp.Expiration.UTC().Format("2006-01-02T15:04:05Z"),
+		RoleArn:         rp.RoleArn,
+		SecretAccessKey: value.SecretAccessKey,
+		Token:           value.SessionToken,
+	}
+}
+
+// ecsCredentialHandler serves credentials for the role returned by resolve, in the format returned
+// by respond. source identifies the endpoint in audit logs.
+func ecsCredentialHandler(source string, resolve RoleResolver, respond credentialResponse) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cached, err := resolve(r)
+		if err != nil {
 			util.WriteError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -86,18 +154,13 @@ func getCredentialHandler(region string) func(http.ResponseWriter, *http.Request
 			return
 		}
 
-		credentialResponse := ECSMetaDataCredentialResponse{
-			AccessKeyId:     fmt.Sprintf("%s", cachedCredentials.AccessKeyID),
-			Expiration:      cached.Expiration.UTC().Format("2006-01-02T15:04:05Z"),
-			RoleArn:         cached.RoleArn,
-			SecretAccessKey: fmt.Sprintf("%s", cachedCredentials.SecretAccessKey),
-			Token:           fmt.Sprintf("%s", cachedCredentials.SessionToken),
-		}
-
 		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(credentialResponse)
+		setLastModified(w, cached.LastRefreshed)
+		err = json.NewEncoder(w).Encode(respond(cached, cachedCredentials))
 		if err != nil {
 			logging.Log.Errorf("failed to write response: %v", err)
+			return
 		}
+		auditCredentialsIssued(w, r, source, cached)
 	}
 }
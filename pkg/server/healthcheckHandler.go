@@ -9,11 +9,15 @@ import (
 	"github.com/netflix/weep/pkg/reachability"
 
 	"github.com/netflix/weep/pkg/health"
+	"github.com/netflix/weep/pkg/httpAuth/mtls"
 )
 
 type healthcheckResponse struct {
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+	Status   int    `json:"status"`
+	Message  string `json:"message"`
+	Degraded bool   `json:"degraded,omitempty"`
+	// MTLSCertificates describes the mTLS client certificates, including their age and remaining validity
+	MTLSCertificates []*mtls.CertificateInfo `json:"mtls_certificates,omitempty"`
 }
 
 func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,9 +34,12 @@ func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
 		reachability.Notify()
 	}
 
+	degraded, _ := health.WeepStatus.Degraded()
 	resp := healthcheckResponse{
-		Status:  status,
-		Message: reason,
+		Status:           status,
+		Message:          reason,
+		Degraded:         degraded,
+		MTLSCertificates: mtls.Status(),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -22,19 +22,22 @@ import (
 
 	"github.com/netflix/weep/pkg/logging"
 
-	"github.com/netflix/weep/pkg/cache"
 	"github.com/netflix/weep/pkg/util"
 )
 
 func IamInfoHandler(w http.ResponseWriter, r *http.Request) {
-	rawArn := cache.GlobalCache.DefaultArn()
+	var rawArn, lastUpdated string
+	if c, err := instanceRoleResolver(r); err == nil {
+		rawArn = c.RoleArn
+		lastUpdated = c.LastRefreshed.UTC().Format("2006-01-02T15:04:05Z")
+	}
 	awsArn, _ := util.ArnParse(rawArn)
 
 	awsArn.ResourceType = "instance-profile"
 
 	iamInfo := MetaDataIamInfoResponse{
 		Code:               "Success",
-		LastUpdated:        cache.GlobalCache.DefaultLastUpdated(),
+		LastUpdated:        lastUpdated,
 		InstanceProfileARN: awsArn.ArnString(),
 		InstanceProfileID:  "AIPAI",
 	}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SpotTerminationEvent         = "spot-termination"
+	ScheduledEvent               = "scheduled-event"
+	RebalanceRecommendationEvent = "rebalance-recommendation"
+)
+
+// IMDSEventRequest is the body of a request to the admin API to inject an IMDS event
+type IMDSEventRequest struct {
+	Type string `json:"type"`
+	// InSeconds is how long from now the event takes effect
+	InSeconds int `json:"in_seconds"`
+	// Action is the spot interruption action: terminate, stop, or hibernate
+	Action string `json:"action,omitempty"`
+	// Code is the scheduled event code, e.g. system-reboot or instance-retirement
+	Code string `json:"code,omitempty"`
+	// DurationSeconds is how long a scheduled event's maintenance window lasts
+	DurationSeconds int `json:"duration_seconds,omitempty"`
+}
+
+type spotInstanceAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
+
+type scheduledEvent struct {
+	NotBefore   string `json:"NotBefore"`
+	Code        string `json:"Code"`
+	Description string `json:"Description"`
+	EventId     string `json:"EventId"`
+	NotAfter    string `json:"NotAfter"`
+	State       string `json:"State"`
+}
+
+type rebalanceRecommendation struct {
+	NoticeTime string `json:"noticeTime"`
+}
+
+// imdsEventState holds events injected through the admin API
+type imdsEventState struct {
+	sync.RWMutex
+	spotAction      *spotInstanceAction
+	scheduledEvents []scheduledEvent
+	rebalance       *rebalanceRecommendation
+}
+
+var imdsEvents = &imdsEventState{}
+
+func (s *imdsEventState) inject(req IMDSEventRequest) error {
+	now := time.Now().UTC()
+	at := now.Add(time.Duration(req.InSeconds) * time.Second)
+
+	s.Lock()
+	defer s.Unlock()
+	switch req.Type {
+	case SpotTerminationEvent:
+		action := req.Action
+		if action == "" {
+			action = "terminate"
+		}
+		if !util.StringInSlice(action, []string{"terminate", "stop", "hibernate"}) {
+			return fmt.Errorf("invalid spot action: %s", action)
+		}
+		s.spotAction = &spotInstanceAction{
+			Action: action,
+			Time:   at.Format("2006-01-02T15:04:05Z"),
+		}
+	case ScheduledEvent:
+		code := req.Code
+		if code == "" {
+			code = "system-reboot"
+		}
+		duration := time.Duration(req.DurationSeconds) * time.Second
+		if duration == 0 {
+			duration = 2 * time.Hour
+		}
+		s.scheduledEvents = append(s.scheduledEvents, scheduledEvent{
+			NotBefore:   at.Format("2 Jan 2006 15:04:05 GMT"),
+			Code:        code,
+			Description: fmt.Sprintf("scheduled %s injected by weep", code),
+			EventId:     fmt.Sprintf("instance-event-%017x", now.UnixNano()),
+			NotAfter:    at.Add(duration).Format("2 Jan 2006 15:04:05 GMT"),
+			State:       "active",
+		})
+	case RebalanceRecommendationEvent:
+		s.rebalance = &rebalanceRecommendation{
+			NoticeTime: at.Format("2006-01-02T15:04:05Z"),
+		}
+	default:
+		return fmt.Errorf("unknown event type: %s", req.Type)
+	}
+	return nil
+}
+
+func (s *imdsEventState) clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.spotAction = nil
+	s.scheduledEvents = nil
+	s.rebalance = nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Log.Errorf("failed to write response: %v", err)
+	}
+}
+
+func SpotInstanceActionHandler(w http.ResponseWriter, r *http.Request) {
+	imdsEvents.RLock()
+	defer imdsEvents.RUnlock()
+	if imdsEvents.spotAction == nil {
+		NotFoundHandler(w, r)
+		return
+	}
+	writeJSON(w, imdsEvents.spotAction)
+}
+
+func SpotTerminationTimeHandler(w http.ResponseWriter, r *http.Request) {
+	imdsEvents.RLock()
+	defer imdsEvents.RUnlock()
+	if imdsEvents.spotAction == nil || imdsEvents.spotAction.Action != "terminate" {
+		NotFoundHandler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, imdsEvents.spotAction.Time)
+}
+
+func ScheduledEventsHandler(w http.ResponseWriter, r *http.Request) {
+	imdsEvents.RLock()
+	defer imdsEvents.RUnlock()
+	if len(imdsEvents.scheduledEvents) == 0 {
+		NotFoundHandler(w, r)
+		return
+	}
+	writeJSON(w, imdsEvents.scheduledEvents)
+}
+
+func RebalanceRecommendationHandler(w http.ResponseWriter, r *http.Request) {
+	imdsEvents.RLock()
+	defer imdsEvents.RUnlock()
+	if imdsEvents.rebalance == nil {
+		NotFoundHandler(w, r)
+		return
+	}
+	writeJSON(w, imdsEvents.rebalance)
+}
+
+// IMDSEventsAdminHandler injects an event with POST and clears all events with DELETE
+func IMDSEventsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req IMDSEventRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			util.WriteError(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if err := imdsEvents.inject(req); err != nil {
+			util.WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Log.WithFields(logrus.Fields{
+			"type":       req.Type,
+			"in_seconds": req.InSeconds,
+		}).Info("injected IMDS event")
+	case http.MethodDelete:
+		imdsEvents.clear()
+		logging.Log.Info("cleared IMDS events")
+	default:
+		util.WriteError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
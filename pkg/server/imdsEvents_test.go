@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestIMDSEvents injects each type of event through the admin handler and checks that the
+// corresponding route returns 404 before injection and the event afterward.
+func TestIMDSEvents(t *testing.T) {
+	cases := []struct {
+		Description string
+		Request     IMDSEventRequest
+		Handler     http.HandlerFunc
+		ExpectedKey string
+	}{
+		{
+			Description: "spot termination",
+			Request:     IMDSEventRequest{Type: SpotTerminationEvent, InSeconds: 120},
+			Handler:     SpotInstanceActionHandler,
+			ExpectedKey: "action",
+		},
+		{
+			Description: "rebalance recommendation",
+			Request:     IMDSEventRequest{Type: RebalanceRecommendationEvent},
+			Handler:     RebalanceRecommendationHandler,
+			ExpectedKey: "noticeTime",
+		},
+	}
+	defer imdsEvents.clear()
+
+	for i, tc := range cases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		imdsEvents.clear()
+
+		rec := httptest.NewRecorder()
+		tc.Handler(rec, httptest.NewRequest("GET", "http://localhost", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s failed: got status %d before injection, expected %d", tc.Description, rec.Code, http.StatusNotFound)
+		}
+
+		body, _ := json.Marshal(tc.Request)
+		rec = httptest.NewRecorder()
+		IMDSEventsAdminHandler(rec, httptest.NewRequest("POST", "http://localhost/weep/admin/imds/events", bytes.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("%s failed: got status %d from admin handler, expected %d", tc.Description, rec.Code, http.StatusNoContent)
+			continue
+		}
+
+		rec = httptest.NewRecorder()
+		tc.Handler(rec, httptest.NewRequest("GET", "http://localhost", nil))
+		var result map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Errorf("%s failed: could not decode response: %v", tc.Description, err)
+			continue
+		}
+		if result[tc.ExpectedKey] == "" {
+			t.Errorf("%s failed: %s not set in %v", tc.Description, tc.ExpectedKey, result)
+		}
+	}
+}
+
+func TestScheduledEvents(t *testing.T) {
+	defer imdsEvents.clear()
+	imdsEvents.clear()
+	if err := imdsEvents.inject(IMDSEventRequest{Type: ScheduledEvent, Code: "instance-retirement", InSeconds: 3600}); err != nil {
+		t.Fatalf("inject failed: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	ScheduledEventsHandler(rec, httptest.NewRequest("GET", "http://localhost", nil))
+	var events []scheduledEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(events) != 1 || events[0].Code != "instance-retirement" || events[0].State != "active" {
+		t.Errorf("unexpected scheduled events: %+v", events)
+	}
+}
+
+func TestIMDSEventsInvalid(t *testing.T) {
+	for _, req := range []IMDSEventRequest{
+		{Type: "meteor-strike"},
+		{Type: SpotTerminationEvent, Action: "explode"},
+	} {
+		if err := imdsEvents.inject(req); err == nil {
+			t.Errorf("expected error injecting %+v", req)
+		}
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := AdminMiddleware(nextHandler)
+
+	req := httptest.NewRequest("POST", "http://localhost/weep/admin/imds/events", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d without admin header, expected %d", rec.Code, http.StatusForbidden)
+	}
+
+	req.Header.Set(AdminHeader, "1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d with admin header, expected %d", rec.Code, http.StatusNoContent)
+	}
+
+	req.RemoteAddr = "192.0.2.10:12345"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d from non-loopback address, expected %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -23,7 +23,6 @@ import (
 
 	"github.com/netflix/weep/pkg/logging"
 
-	"github.com/netflix/weep/pkg/cache"
 	"github.com/netflix/weep/pkg/metadata"
 	"github.com/netflix/weep/pkg/util"
 )
@@ -33,7 +32,10 @@ var (
 )
 
 func InstanceIdentityDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	rawArn := cache.GlobalCache.DefaultArn()
+	var rawArn string
+	if c, err := instanceRoleResolver(r); err == nil {
+		rawArn = c.RoleArn
+	}
 	awsArn, err := util.ArnParse(rawArn)
 
 	if err != nil {
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/netflix/weep/pkg/httpAuth"
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/util"
+)
+
+// loginInProgress is 1 while a login started through the admin API is running
+var loginInProgress int32
+
+// login is a variable so tests can replace it
+var login = httpAuth.Login
+
+// LoginAdminHandler starts a new login with the configured authentication method, so an expired
+// ConsoleMe session can be renewed without restarting weep. Logins wait for the user, so it runs
+// in the background and the handler returns 202 Accepted.
+func LoginAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !atomic.CompareAndSwapInt32(&loginInProgress, 0, 1) {
+		util.WriteError(w, "login already in progress", http.StatusConflict)
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&loginInProgress, 0)
+		logging.Log.Info("starting login requested through the admin API")
+		if err := login(); err != nil {
+			logging.Log.Errorf("login failed: %v", err)
+			return
+		}
+		logging.Log.Info("login complete")
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoginAdminHandler(t *testing.T) {
+	release := make(chan struct{})
+	logins := make(chan struct{}, 2)
+	oldLogin := login
+	login = func() error {
+		logins <- struct{}{}
+		<-release
+		return nil
+	}
+	defer func() { login = oldLogin }()
+
+	handler := AdminMiddleware(LoginAdminHandler)
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "http://localhost/weep/admin/login", nil)
+		req.RemoteAddr = "127.0.0.1:40000"
+		req.Header.Set(AdminHeader, "1")
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, newRequest())
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, expected %d", rec.Code, http.StatusAccepted)
+	}
+	<-logins
+
+	rec = httptest.NewRecorder()
+	handler(rec, newRequest())
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d while a login is running, expected %d", rec.Code, http.StatusConflict)
+	}
+
+	req := newRequest()
+	req.Header.Del(AdminHeader)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d without the admin header, expected %d", rec.Code, http.StatusForbidden)
+	}
+	close(release)
+}
@@ -17,14 +17,18 @@
 package server
 
 import (
-	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/netflix/weep/pkg/logging"
 
+	"github.com/netflix/weep/pkg/audit"
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/peer"
+	"github.com/netflix/weep/pkg/policy"
 	"github.com/netflix/weep/pkg/session"
 	"github.com/netflix/weep/pkg/util"
 
@@ -33,8 +37,15 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// InstanceMetadataMiddleware is a convenience wrapper that chains TokenMiddleware, BrowserFilterMiddleware, and AWSHeaderMiddleware
+// InstanceMetadataMiddleware is a convenience wrapper that chains TokenMiddleware, BrowserFilterMiddleware,
+// ProcessPolicyMiddleware, and AWSHeaderMiddleware
 func InstanceMetadataMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return BrowserFilterMiddleware(TokenMiddleware(ProcessPolicyMiddleware("imds", instanceRoleNames, instanceRoleResolver, AWSHeaderMiddleware(next))))
+}
+
+// InstanceEventsMiddleware is InstanceMetadataMiddleware without the process policy, for the spot
+// interruption and maintenance event routes, which don't depend on a role
+func InstanceEventsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return BrowserFilterMiddleware(TokenMiddleware(AWSHeaderMiddleware(next)))
 }
 
@@ -43,6 +54,102 @@ func TaskMetadataMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return BrowserFilterMiddleware(AWSHeaderMiddleware(next))
 }
 
+// processPolicy restricts which local processes may obtain credentials. It's nil when the policy is disabled.
+var processPolicy *policy.Policy
+
+// RoleResolver returns the credential provider that a request is asking for
+type RoleResolver func(r *http.Request) (*creds.RefreshableProvider, error)
+
+// RoleNames returns the role a request is asking for, followed by its assume chain, as named by
+// the request path, source role mapping, or association. Unlike a RoleResolver, it doesn't fetch
+// credentials.
+type RoleNames func(r *http.Request) ([]string, error)
+
+// providerRoleNames returns RoleNames for requests that always get rp
+func providerRoleNames(rp *creds.RefreshableProvider) RoleNames {
+	return func(r *http.Request) ([]string, error) {
+		return append([]string{rp.RoleArn}, rp.AssumeChain...), nil
+	}
+}
+
+// ProcessPolicyMiddleware rejects requests from local processes that the process policy doesn't
+// allow to use the requested role. Every role in an assume chain must be allowed. The roles named
+// by the request are checked before resolve fetches credentials for them, and checked again by ARN
+// once they're resolved, since a role requested by name is only known by its ARN after that.
+func ProcessPolicyMiddleware(source string, names RoleNames, resolve RoleResolver, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if processPolicy == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		process, err := peer.FromRequest(r)
+		if err != nil {
+			logging.Log.WithError(err).Debug("could not identify requesting process")
+		} else {
+			r = peer.WithProcess(r, process)
+		}
+
+		roles, err := names(r)
+		if err != nil {
+			util.WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !processAllowed(w, r, source, process, roles) {
+			return
+		}
+		rp, err := resolve(r)
+		if err != nil {
+			util.WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !processAllowed(w, r, source, process, append([]string{rp.RoleArn}, rp.AssumeChain...)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// processAllowed checks that the process policy allows process to use every role in roles, and
+// writes a forbidden response if it doesn't
+func processAllowed(w http.ResponseWriter, r *http.Request, source string, process *peer.Process, roles []string) bool {
+	for _, role := range roles {
+		if allowed, reason := processPolicy.Allowed(process, role); !allowed {
+			logging.Log.WithFields(logrus.Fields{
+				"role":    role,
+				"process": process,
+				"reason":  reason,
+			}).Warn("request denied by process policy")
+			audit.RequestDenied(r, source, roles, reason)
+			util.WriteError(w, "forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// AdminHeader must be present on requests to the admin API. Browsers can't add custom headers to
+// cross-origin requests without a CORS preflight, which BrowserFilterMiddleware rejects.
+const AdminHeader = "X-Weep-Admin"
+
+// AdminMiddleware only allows requests to the admin API from loopback clients that send AdminHeader
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return BrowserFilterMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			logging.Log.Warnf("admin request from non-loopback address %s", r.RemoteAddr)
+			util.WriteError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get(AdminHeader) == "" {
+			logging.Log.Warnf("admin request without %s header", AdminHeader)
+			util.WriteError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func TokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var remainingTtl int
@@ -69,11 +176,12 @@ func TokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// AWSHeaderMiddleware adds the headers IMDS sends with every response. The ETag is derived from the
+// response body and Last-Modified is the time the credentials were last refreshed, unless the handler
+// set it already. Conditional GET requests get a 304 when nothing has changed.
 func AWSHeaderMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		w.Header().Set("ETag", strconv.FormatInt(rand.Int63n(10000000000), 10))
-		w.Header().Set("Last-Modified", time.Now().UTC().Format("2006-01-02T15:04:05Z")) // TODO: set this to cred refresh time
 		w.Header().Set("Server", "EC2ws")
 
 		ua := r.Header.Get("User-Agent")
@@ -92,23 +200,97 @@ func AWSHeaderMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			"path":             r.URL.Path,
 			"metadata_version": metadataVersion,
 		}).Info("Running AWS Header Middleware")
-		next.ServeHTTP(w, r)
+
+		buf := newBufferedResponseWriter(w)
+		next.ServeHTTP(buf, r)
+		buf.finish(r)
 	}
 }
 
-// allowedHosts is a map used to look up Host headers for the purpose of rejecting requests
+// defaultAllowedHosts are the hosts accepted by BrowserFilterMiddleware unless server.allowed_hosts is set
+var defaultAllowedHosts = []string{
+	"localhost",       // localhost
+	"127.0.0.1",       // localhost
+	"::1",             // localhost
+	"169.254.169.254", // IMDS IP
+	"fd00:ec2::254",   // IMDS IPv6
+	"169.254.170.23",  // EKS Pod Identity agent IP
+	"fd00:ec2::23",    // EKS Pod Identity agent IPv6
+}
+
+// allowedHosts is used to look up the request Host for the purpose of rejecting requests
 // for hosts that are not allowed
-var allowedHosts = map[string]bool{
-	"localhost":       true, // localhost
-	"127.0.0.1":       true, // localhost
-	"169.254.169.254": true, // IMDS IP
+var allowedHosts = newHostAllowlist(defaultAllowedHosts)
+
+// hostAllowlist holds hosts that are allowed on any port and host:port pairs that are only
+// allowed on that port
+type hostAllowlist struct {
+	sync.RWMutex
+	hosts     map[string]bool
+	hostPorts map[string]bool
+}
+
+func newHostAllowlist(entries []string) *hostAllowlist {
+	a := &hostAllowlist{
+		hosts:     make(map[string]bool),
+		hostPorts: make(map[string]bool),
+	}
+	for _, entry := range entries {
+		a.Add(entry)
+	}
+	return a
+}
+
+// Add allows a host on any port, e.g. localhost or ::1, or a single host and port,
+// e.g. 127.0.0.1:9091 or [::1]:9091
+func (a *hostAllowlist) Add(entry string) {
+	a.Lock()
+	defer a.Unlock()
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if host, port, err := net.SplitHostPort(entry); err == nil {
+		a.hostPorts[net.JoinHostPort(normalizeHost(host), port)] = true
+		return
+	}
+	a.hosts[normalizeHost(entry)] = true
+}
+
+// Allowed returns true if the value of a Host header is in the allowlist
+func (a *hostAllowlist) Allowed(hostHeader string) bool {
+	a.RLock()
+	defer a.RUnlock()
+	hostHeader = strings.ToLower(hostHeader)
+	host, port, err := net.SplitHostPort(hostHeader)
+	if err != nil {
+		// No port in the header
+		return a.hosts[normalizeHost(hostHeader)]
+	}
+	host = normalizeHost(host)
+	return a.hosts[host] || a.hostPorts[net.JoinHostPort(host, port)]
+}
+
+// normalizeHost strips IPv6 brackets and a trailing dot, and canonicalizes IP addresses
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	host = strings.TrimSuffix(host, ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
 }
 
 // deniedHeaders is a list of headers that will cause a 403 if present at all
 var deniedHeaders = map[string]bool{
-	"referrer":        true,
-	"origin":          true,
-	"x-forwarded-for": true,
+	"referer":                        true,
+	"referrer":                       true,
+	"origin":                         true,
+	"x-forwarded-for":                true,
+	"access-control-request-method":  true, // CORS preflight
+	"access-control-request-headers": true, // CORS preflight
+}
+
+// deniedHeaderPrefixes is a list of header prefixes that will cause a 403 if present at all
+var deniedHeaderPrefixes = []string{
+	"sec-fetch-", // Fetch metadata, only sent by browsers
 }
 
 // BrowserFilterMiddleware is a middleware designed mitigate risks related to DNS rebinding,
@@ -125,23 +307,40 @@ func BrowserFilterMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// Browsers send a preflight OPTIONS request before cross-origin requests with custom headers
+		if r.Method == http.MethodOptions {
+			logging.Log.Warn("OPTIONS request detected")
+			util.WriteError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
 		// Check for presence of deniedHeaders
 		// These also indicate a likely browser request
-		for h, _ := range r.Header {
-			if deniedHeaders[strings.ToLower(h)] {
+		for h := range r.Header {
+			lower := strings.ToLower(h)
+			if deniedHeaders[lower] || hasDeniedPrefix(lower) {
 				logging.Log.Warnf("%s header detected", h)
 				util.WriteError(w, "forbidden", http.StatusForbidden)
 				return
 			}
 		}
 
-		// Check host header
-		// This should only be 127.0.0.1 or 169.254.169.254
-		if host := r.Header.Get("Host"); host != "" && !allowedHosts[strings.ToLower(host)] {
-			logging.Log.Warn("bad host detected")
+		// Check host
+		// Go removes the Host header from r.Header and stores it in r.Host
+		if host := r.Host; host != "" && !allowedHosts.Allowed(host) {
+			logging.Log.Warnf("bad host detected: %s", host)
 			util.WriteError(w, "forbidden", http.StatusForbidden)
 			return
 		}
 		next.ServeHTTP(w, r)
 	}
 }
+
+func hasDeniedPrefix(header string) bool {
+	for _, prefix := range deniedHeaderPrefixes {
+		if strings.HasPrefix(header, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,18 @@
 package server
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/peer"
+	"github.com/netflix/weep/pkg/policy"
+	"github.com/netflix/weep/pkg/types"
 )
 
 var browserHeaderTestCases = []struct {
@@ -42,6 +51,30 @@ var browserHeaderTestCases = []struct {
 		HeaderValue:    "",
 		ExpectedStatus: http.StatusForbidden,
 	},
+	{
+		Description:    "referer header set",
+		HeaderName:     "Referer",
+		HeaderValue:    "http://evil.example.com/",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "sec-fetch-mode header set",
+		HeaderName:     "Sec-Fetch-Mode",
+		HeaderValue:    "no-cors",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "sec-fetch-site header set",
+		HeaderName:     "Sec-Fetch-Site",
+		HeaderValue:    "cross-site",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "cors preflight header set",
+		HeaderName:     "Access-Control-Request-Method",
+		HeaderValue:    "PUT",
+		ExpectedStatus: http.StatusForbidden,
+	},
 	{
 		Description:    "origin header set",
 		HeaderName:     "Origin",
@@ -90,6 +123,200 @@ var browserHeaderTestCases = []struct {
 		HeaderValue:    "169.254.169.254",
 		ExpectedStatus: http.StatusOK,
 	},
+	{
+		Description:    "host header in allowlist with port (127.0.0.1:9091)",
+		HeaderName:     "Host",
+		HeaderValue:    "127.0.0.1:9091",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "host header in allowlist ([::1]:9091)",
+		HeaderName:     "Host",
+		HeaderValue:    "[::1]:9091",
+		ExpectedStatus: http.StatusOK,
+	},
+}
+
+var dnsRebindingTestCases = []struct {
+	Description    string
+	AllowedHosts   []string
+	Host           string
+	ExpectedStatus int
+}{
+	{
+		Description:    "attacker domain",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "evil.example.com",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "attacker domain with port",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "evil.example.com:9091",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "attacker subdomain containing allowed host",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "localhost.evil.example.com",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "wildcard dns for loopback",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "127.0.0.1.nip.io:9091",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "rebinding service hostname",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "7f000001.a9fea9fe.rbndr.us",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "uppercase localhost",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "LOCALHOST:9091",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "fully qualified localhost",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "localhost.",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "bare ipv6 loopback",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "[::1]",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "ipv6 imds address",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "[fd00:ec2::254]",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "imds address with port",
+		AllowedHosts:   defaultAllowedHosts,
+		Host:           "169.254.169.254:80",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "port-specific entry, matching port",
+		AllowedHosts:   []string{"127.0.0.1:9091"},
+		Host:           "127.0.0.1:9091",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "port-specific entry, different port",
+		AllowedHosts:   []string{"127.0.0.1:9091"},
+		Host:           "127.0.0.1:8080",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "port-specific entry, no port",
+		AllowedHosts:   []string{"127.0.0.1:9091"},
+		Host:           "127.0.0.1",
+		ExpectedStatus: http.StatusForbidden,
+	},
+	{
+		Description:    "port-specific ipv6 entry",
+		AllowedHosts:   []string{"[::1]:9091"},
+		Host:           "[0:0:0:0:0:0:0:1]:9091",
+		ExpectedStatus: http.StatusOK,
+	},
+	{
+		Description:    "custom allowlist without default hosts",
+		AllowedHosts:   []string{"weep.internal"},
+		Host:           "localhost",
+		ExpectedStatus: http.StatusForbidden,
+	},
+}
+
+// TestBrowserFilterMiddlewareDNSRebinding checks the request Host against allowlists the way a
+// DNS rebinding attack would present it.
+func TestBrowserFilterMiddlewareDNSRebinding(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer func() { allowedHosts = newHostAllowlist(defaultAllowedHosts) }()
+	for i, tc := range dnsRebindingTestCases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		allowedHosts = newHostAllowlist(tc.AllowedHosts)
+		bfmHandler := BrowserFilterMiddleware(nextHandler)
+		req := newBrowserFilterTestRequest("Host", tc.Host)
+		rec := httptest.NewRecorder()
+		bfmHandler.ServeHTTP(rec, req)
+		if rec.Code != tc.ExpectedStatus {
+			t.Errorf("%s failed: got status %d, expected %d", tc.Description, rec.Code, tc.ExpectedStatus)
+		}
+	}
+}
+
+// TestBrowserFilterMiddlewarePreflight ensures CORS preflight requests are rejected
+func TestBrowserFilterMiddlewarePreflight(t *testing.T) {
+	description := "cors preflight"
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	t.Logf("test case: %s", description)
+	bfmHandler := BrowserFilterMiddleware(nextHandler)
+	req := httptest.NewRequest("OPTIONS", "http://localhost/latest/api/token", nil)
+	rec := httptest.NewRecorder()
+	bfmHandler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("%s failed: got status %d, expected %d", description, rec.Code, http.StatusForbidden)
+	}
+}
+
+// TestBrowserFilterMiddlewareServer sends real requests through a listener, so the Host header
+// goes through Go's request parsing rather than being set directly on the request.
+func TestBrowserFilterMiddlewareServer(t *testing.T) {
+	description := "browser filter server"
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	t.Logf("test case: %s", description)
+	srv := httptest.NewServer(BrowserFilterMiddleware(nextHandler))
+	defer srv.Close()
+
+	for host, expected := range map[string]int{
+		"":                  http.StatusOK,
+		"evil.example.com":  http.StatusForbidden,
+		"localhost:9091":    http.StatusOK,
+		"169.254.169.254":   http.StatusOK,
+		"evil.example.com.": http.StatusForbidden,
+	} {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatalf("%s failed: %v", description, err)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s failed: %v", description, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%s failed: got status %d for host %q, expected %d", description, resp.StatusCode, host, expected)
+		}
+	}
+}
+
+// newBrowserFilterTestRequest builds a request with the given header. Go's server moves the Host header
+// into r.Host, so the test request does the same.
+func newBrowserFilterTestRequest(name, value string) *http.Request {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	if name == "Host" {
+		req.Host = value
+	} else {
+		req.Header.Add(name, value)
+	}
+	return req
 }
 
 // TestBrowserFilterMiddleware ensures 403 Forbidden is returned for all requests that look like
@@ -101,8 +328,7 @@ func TestBrowserFilterMiddleware(t *testing.T) {
 	for i, tc := range browserHeaderTestCases {
 		t.Logf("test case %d: %s", i, tc.Description)
 		bfmHandler := BrowserFilterMiddleware(nextHandler)
-		req := httptest.NewRequest("GET", "http://localhost", nil)
-		req.Header.Add(tc.HeaderName, tc.HeaderValue)
+		req := newBrowserFilterTestRequest(tc.HeaderName, tc.HeaderValue)
 		rec := httptest.NewRecorder()
 		bfmHandler.ServeHTTP(rec, req)
 		if rec.Code != tc.ExpectedStatus {
@@ -146,8 +372,7 @@ func TestCredentialServiceMiddleware(t *testing.T) {
 	for i, tc := range browserHeaderTestCases {
 		t.Logf("test case %d: %s", i, tc.Description)
 		bfmHandler := InstanceMetadataMiddleware(nextHandler)
-		req := httptest.NewRequest("GET", "http://localhost", nil)
-		req.Header.Add(tc.HeaderName, tc.HeaderValue)
+		req := newBrowserFilterTestRequest(tc.HeaderName, tc.HeaderValue)
 		rec := httptest.NewRecorder()
 		bfmHandler.ServeHTTP(rec, req)
 		if rec.Code != tc.ExpectedStatus {
@@ -182,3 +407,316 @@ func TestTokenMiddleware(t *testing.T) {
 		t.Errorf("%s failed: got status %d, expected %d", description, rec.Code, http.StatusOK)
 	}
 }
+
+// TestProcessPolicyMiddleware makes sure requests are denied when the policy is enabled and the
+// requesting process can't be identified, and allowed when the policy is disabled.
+func TestProcessPolicyMiddleware(t *testing.T) {
+	description := "process policy middleware"
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	resolver := func(r *http.Request) (*creds.RefreshableProvider, error) {
+		return &creds.RefreshableProvider{RoleArn: "arn:aws:iam::123456789012:role/test"}, nil
+	}
+	names := func(r *http.Request) ([]string, error) {
+		return []string{"test"}, nil
+	}
+	t.Logf("test case: %s", description)
+	handler := ProcessPolicyMiddleware("test", names, resolver, nextHandler)
+
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("%s failed: got status %d with policy disabled, expected %d", description, rec.Code, http.StatusOK)
+	}
+
+	p, err := policy.New([]policy.Rule{{UIDs: []int{os.Getuid()}}})
+	if err != nil {
+		t.Fatalf("%s failed: could not create policy: %v", description, err)
+	}
+	processPolicy = p
+	defer func() { processPolicy = nil }()
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("%s failed: got status %d for unidentified process, expected %d", description, rec.Code, http.StatusForbidden)
+	}
+}
+
+// TestProcessPolicyMiddlewareChecksNames makes sure credentials aren't fetched for roles the
+// process policy denies, and that resolved roles are checked again by ARN
+func TestProcessPolicyMiddlewareChecksNames(t *testing.T) {
+	p, err := policy.New([]policy.Rule{
+		{Roles: []string{"allowed"}, UIDs: []int{os.Getuid()}},
+		{Roles: []string{"denied"}, UIDs: []int{os.Getuid() + 1}},
+	})
+	if err != nil {
+		t.Fatalf("could not create policy: %v", err)
+	}
+	processPolicy = p
+	defer func() { processPolicy = nil }()
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	cases := []struct {
+		Description      string
+		Names            []string
+		ResolvedArn      string
+		ExpectedStatus   int
+		ExpectedResolves int
+	}{
+		{
+			Description:      "allowed role",
+			Names:            []string{"allowed"},
+			ResolvedArn:      "arn:aws:iam::123456789012:role/allowed",
+			ExpectedStatus:   http.StatusOK,
+			ExpectedResolves: 1,
+		},
+		{
+			Description:    "denied role",
+			Names:          []string{"denied"},
+			ResolvedArn:    "arn:aws:iam::123456789012:role/denied",
+			ExpectedStatus: http.StatusForbidden,
+		},
+		{
+			Description:    "denied role in assume chain",
+			Names:          []string{"allowed", "arn:aws:iam::123456789012:role/denied"},
+			ResolvedArn:    "arn:aws:iam::123456789012:role/allowed",
+			ExpectedStatus: http.StatusForbidden,
+		},
+		{
+			Description:      "name resolves to a denied role",
+			Names:            []string{"allowed"},
+			ResolvedArn:      "arn:aws:iam::123456789012:role/denied",
+			ExpectedStatus:   http.StatusForbidden,
+			ExpectedResolves: 1,
+		},
+	}
+	for _, tc := range cases {
+		resolves := 0
+		names := func(r *http.Request) ([]string, error) {
+			return tc.Names, nil
+		}
+		resolver := func(r *http.Request) (*creds.RefreshableProvider, error) {
+			resolves++
+			return &creds.RefreshableProvider{RoleArn: tc.ResolvedArn}, nil
+		}
+		handler := ProcessPolicyMiddleware("test", names, resolver, nextHandler)
+		req := peer.WithProcess(httptest.NewRequest("GET", "http://localhost", nil), &peer.Process{UID: os.Getuid()})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.ExpectedStatus {
+			t.Errorf("%s: got status %d, expected %d", tc.Description, rec.Code, tc.ExpectedStatus)
+		}
+		if resolves != tc.ExpectedResolves {
+			t.Errorf("%s: got %d resolves, expected %d", tc.Description, resolves, tc.ExpectedResolves)
+		}
+	}
+}
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := AuthorizationMiddleware("secret", nextHandler)
+	cases := []struct {
+		Description    string
+		Authorization  string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "valid token",
+			Authorization:  "secret",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "invalid token",
+			Authorization:  "secret2",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "missing token",
+			Authorization:  "",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+	}
+	for i, tc := range cases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		req := httptest.NewRequest("GET", "http://127.0.0.1/ecs/credentials", nil)
+		if tc.Authorization != "" {
+			req.Header.Set("Authorization", tc.Authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.ExpectedStatus {
+			t.Errorf("%s failed: got status %d, expected %d", tc.Description, rec.Code, tc.ExpectedStatus)
+		}
+	}
+}
+
+func TestPodIdentityAuthMiddleware(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	podIdentityAssociations = []PodIdentityAssociation{
+		{Token: "inline-token", Role: "inline_role"},
+		{TokenFile: tokenFile, Role: "file_role"},
+	}
+	defer func() { podIdentityAssociations = nil }()
+	setTestPodIdentityProvider(t)
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rp, err := podIdentityRoleResolver(r); err != nil || rp.RoleName == "" {
+			t.Errorf("got %v, %v, expected the middleware to resolve the role", rp, err)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := PodIdentityAuthMiddleware("us-west-2", nextHandler)
+	cases := []struct {
+		Description    string
+		Authorization  string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "inline token",
+			Authorization:  "inline-token",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "token from file",
+			Authorization:  "file-token",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "unknown token",
+			Authorization:  "other-token",
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Description:    "missing token",
+			Authorization:  "",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+	for i, tc := range cases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		req := httptest.NewRequest("GET", "http://169.254.170.23/v1/credentials", nil)
+		if tc.Authorization != "" {
+			req.Header.Set("Authorization", tc.Authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.ExpectedStatus {
+			t.Errorf("%s failed: got status %d, expected %d", tc.Description, rec.Code, tc.ExpectedStatus)
+		}
+	}
+
+	// Rotated tokens are picked up without a restart
+	if err := ioutil.WriteFile(tokenFile, []byte("rotated-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	association, err := findPodIdentityAssociation("rotated-token")
+	if err != nil || association.Role != "file_role" {
+		t.Errorf("got %v, %v for rotated token, expected file_role", association, err)
+	}
+	if _, err := findPodIdentityAssociation("file-token"); err != errUnknownPodIdentityToken {
+		t.Errorf("got %v for previous token, expected %v", err, errUnknownPodIdentityToken)
+	}
+}
+
+// TestAWSHeaderMiddlewareConditional checks that ETag and Last-Modified are stable and that
+// conditional requests get a 304 when the content hasn't changed
+func TestAWSHeaderMiddlewareConditional(t *testing.T) {
+	lastModified := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	body := "credentials"
+	sent := 0
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setLastModified(w, types.Time(lastModified))
+		_, _ = w.Write([]byte(body))
+		afterSent(w, func() { sent++ })
+	})
+	handler := AWSHeaderMiddleware(nextHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("got status %d and body %q, expected %d and %q", rec.Code, rec.Body.String(), http.StatusOK, body)
+	}
+	if got := rec.Header().Get("Last-Modified"); got != lastModified.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %s, expected %s", got, lastModified.Format(http.TimeFormat))
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost", nil))
+	if rec.Header().Get("ETag") != etag {
+		t.Errorf("ETag changed for identical content: %s != %s", rec.Header().Get("ETag"), etag)
+	}
+
+	cases := []struct {
+		Description    string
+		HeaderName     string
+		HeaderValue    string
+		Body           string
+		ExpectedStatus int
+	}{
+		{
+			Description:    "matching etag",
+			HeaderName:     "If-None-Match",
+			HeaderValue:    etag,
+			Body:           body,
+			ExpectedStatus: http.StatusNotModified,
+		},
+		{
+			Description:    "matching weak etag in list",
+			HeaderName:     "If-None-Match",
+			HeaderValue:    `"abc", W/` + etag,
+			Body:           body,
+			ExpectedStatus: http.StatusNotModified,
+		},
+		{
+			Description:    "content changed",
+			HeaderName:     "If-None-Match",
+			HeaderValue:    etag,
+			Body:           "new credentials",
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Description:    "not modified since",
+			HeaderName:     "If-Modified-Since",
+			HeaderValue:    lastModified.Format(http.TimeFormat),
+			Body:           body,
+			ExpectedStatus: http.StatusNotModified,
+		},
+		{
+			Description:    "modified since",
+			HeaderName:     "If-Modified-Since",
+			HeaderValue:    lastModified.Add(-time.Hour).Format(http.TimeFormat),
+			Body:           body,
+			ExpectedStatus: http.StatusOK,
+		},
+	}
+	for i, tc := range cases {
+		t.Logf("test case %d: %s", i, tc.Description)
+		body = tc.Body
+		req := httptest.NewRequest("GET", "http://localhost", nil)
+		req.Header.Set(tc.HeaderName, tc.HeaderValue)
+		rec := httptest.NewRecorder()
+		sent = 0
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.ExpectedStatus {
+			t.Errorf("%s failed: got status %d, expected %d", tc.Description, rec.Code, tc.ExpectedStatus)
+		}
+		if rec.Code == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("%s failed: 304 response has a body", tc.Description)
+		}
+		// Credentials are only audited as issued when they're actually sent
+		if expected := map[bool]int{true: 1, false: 0}[rec.Code == http.StatusOK]; sent != expected {
+			t.Errorf("%s failed: sent callbacks ran %d times, expected %d", tc.Description, sent, expected)
+		}
+	}
+}
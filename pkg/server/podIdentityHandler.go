@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/netflix/weep/pkg/cache"
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/spf13/viper"
+)
+
+// PodIdentityAssociation maps a pod's service account token to a role, like an EKS Pod Identity
+// association maps a service account to a role
+type PodIdentityAssociation struct {
+	// Token is the service account token sent by the pod
+	Token string `mapstructure:"token"`
+	// TokenFile is read on every request, so rotated tokens keep working
+	TokenFile string   `mapstructure:"token_file"`
+	Role      string   `mapstructure:"role"`
+	Assume    []string `mapstructure:"assume"`
+}
+
+var (
+	podIdentityAssociations []PodIdentityAssociation
+
+	errMissingPodIdentityToken = fmt.Errorf("service account token cannot be empty")
+	errUnknownPodIdentityToken = fmt.Errorf("service account token is not associated with a role")
+)
+
+// loadPodIdentityAssociations reads server.pod_identity.associations from the config
+func loadPodIdentityAssociations() error {
+	var associations []PodIdentityAssociation
+	if err := viper.UnmarshalKey("server.pod_identity.associations", &associations); err != nil {
+		return err
+	}
+	for _, a := range associations {
+		if a.Role == "" {
+			return fmt.Errorf("pod identity association is missing a role")
+		}
+		if a.Token == "" && a.TokenFile == "" {
+			return fmt.Errorf("pod identity association for %s needs a token or token_file", a.Role)
+		}
+	}
+	podIdentityAssociations = associations
+	return nil
+}
+
+// token returns the service account token for the association
+func (a PodIdentityAssociation) token() (string, error) {
+	if a.TokenFile == "" {
+		return a.Token, nil
+	}
+	b, err := ioutil.ReadFile(a.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// findPodIdentityAssociation returns the association whose token matches the one presented by the pod
+func findPodIdentityAssociation(presented string) (*PodIdentityAssociation, error) {
+	if presented == "" {
+		return nil, errMissingPodIdentityToken
+	}
+	for i, a := range podIdentityAssociations {
+		token, err := a.token()
+		if err != nil {
+			logging.Log.WithError(err).Warnf("could not read service account token for %s", a.Role)
+			continue
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return &podIdentityAssociations[i], nil
+		}
+	}
+	return nil, errUnknownPodIdentityToken
+}
+
+// podIdentityContextKey holds the podIdentityRequest for a request in its context
+type podIdentityContextKey struct{}
+
+// podIdentityRequest is the association PodIdentityAuthMiddleware found for a request. Its
+// credentials are fetched when they're first needed, once the process policy allows the role.
+type podIdentityRequest struct {
+	association *PodIdentityAssociation
+	region      string
+	once        sync.Once
+	rp          *creds.RefreshableProvider
+	err         error
+}
+
+// getPodIdentityProvider returns the credentials for an association. It's a variable so tests can
+// replace it.
+var getPodIdentityProvider = func(a *PodIdentityAssociation, region string) (*creds.RefreshableProvider, error) {
+	client, err := creds.GetClient()
+	if err != nil {
+		logging.LogError(err, "error getting credentials")
+		return nil, err
+	}
+	return cache.GlobalCache.GetOrSet(client, a.Role, region, a.Assume)
+}
+
+// PodIdentityAuthMiddleware rejects requests that don't carry a service account token from
+// the association table, with the status codes the EKS Pod Identity agent uses. The association
+// is kept in the request context for podIdentityRoleNames and podIdentityRoleResolver.
+func PodIdentityAuthMiddleware(region string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		association, err := findPodIdentityAssociation(r.Header.Get("Authorization"))
+		if err != nil {
+			status := http.StatusUnauthorized
+			if err == errMissingPodIdentityToken {
+				status = http.StatusBadRequest
+			}
+			logging.Log.Warnf("pod identity request rejected: %v", err)
+			util.WriteError(w, err.Error(), status)
+			return
+		}
+		request := &podIdentityRequest{association: association, region: region}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), podIdentityContextKey{}, request)))
+	}
+}
+
+// podIdentityRoleNames is RoleNames for the association PodIdentityAuthMiddleware found for the
+// request's service account token
+func podIdentityRoleNames(r *http.Request) ([]string, error) {
+	request, ok := r.Context().Value(podIdentityContextKey{}).(*podIdentityRequest)
+	if !ok {
+		return nil, errUnknownPodIdentityToken
+	}
+	return append([]string{request.association.Role}, request.association.Assume...), nil
+}
+
+// podIdentityRoleResolver is a RoleResolver for the association PodIdentityAuthMiddleware found
+// for the request's service account token. The credentials are fetched once per request.
+func podIdentityRoleResolver(r *http.Request) (*creds.RefreshableProvider, error) {
+	request, ok := r.Context().Value(podIdentityContextKey{}).(*podIdentityRequest)
+	if !ok {
+		return nil, errUnknownPodIdentityToken
+	}
+	request.once.Do(func() {
+		request.rp, request.err = getPodIdentityProvider(request.association, request.region)
+		if request.err != nil {
+			logging.Log.Errorf("failed to get credentials: %s", request.err)
+		}
+	})
+	return request.rp, request.err
+}
+
+// podIdentityCredentialResponse is the format used by the EKS Pod Identity agent
+func podIdentityCredentialResponse(rp *creds.RefreshableProvider, value credentials.Value) interface{} {
+	var accountID string
+	if awsArn, err := util.ArnParse(rp.RoleArn); err == nil {
+		accountID = awsArn.AccountId
+	}
+	return PodIdentityCredentialResponse{
+		AccessKeyId:     value.AccessKeyID,
+		SecretAccessKey: value.SecretAccessKey,
+		Token:           value.SessionToken,
+		AccountId:       accountID,
+		Expiration:      rp.Expiration.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+}
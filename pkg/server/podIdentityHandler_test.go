@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/peer"
+	"github.com/netflix/weep/pkg/policy"
+	"github.com/netflix/weep/pkg/types"
+)
+
+// setTestPodIdentityProvider replaces the ConsoleMe lookup for associations, and returns a
+// pointer to the number of lookups
+func setTestPodIdentityProvider(t *testing.T) *int {
+	lookups := 0
+	original := getPodIdentityProvider
+	getPodIdentityProvider = func(a *PodIdentityAssociation, region string) (*creds.RefreshableProvider, error) {
+		lookups++
+		return &creds.RefreshableProvider{
+			RoleName:   a.Role,
+			RoleArn:    "arn:aws:iam::123456789012:role/" + a.Role,
+			Region:     region,
+			Expiration: types.Time(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)),
+		}, nil
+	}
+	t.Cleanup(func() { getPodIdentityProvider = original })
+	return &lookups
+}
+
+func TestPodIdentityCredentialHandler(t *testing.T) {
+	podIdentityAssociations = []PodIdentityAssociation{{Token: "pod-token", Role: "pod_role"}}
+	defer func() { podIdentityAssociations = nil }()
+	lookups := setTestPodIdentityProvider(t)
+
+	handler := PodIdentityAuthMiddleware("us-west-2", ProcessPolicyMiddleware("pod-identity", podIdentityRoleNames, podIdentityRoleResolver,
+		ecsCredentialHandler("pod-identity", podIdentityRoleResolver, podIdentityCredentialResponse)))
+	req := httptest.NewRequest("GET", "http://169.254.170.23/v1/credentials", nil)
+	req.Header.Set("Authorization", "pod-token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if *lookups != 1 {
+		t.Errorf("got %d role lookups, expected the role to be resolved once per request", *lookups)
+	}
+
+	// The EKS Pod Identity agent's format has AccountId instead of the ECS format's RoleArn
+	var response map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["AccountId"] != "123456789012" || response["Expiration"] != "2030-01-02T03:04:05Z" {
+		t.Errorf("got %v", response)
+	}
+	for _, field := range []string{"AccessKeyId", "SecretAccessKey", "Token"} {
+		if _, ok := response[field]; !ok {
+			t.Errorf("response is missing %s: %v", field, response)
+		}
+	}
+	if _, ok := response["RoleArn"]; ok {
+		t.Errorf("response has RoleArn: %v", response)
+	}
+}
+
+func TestPodIdentityProcessPolicy(t *testing.T) {
+	podIdentityAssociations = []PodIdentityAssociation{{Token: "pod-token", Role: "pod_role"}}
+	defer func() { podIdentityAssociations = nil }()
+	lookups := setTestPodIdentityProvider(t)
+	p, err := policy.New([]policy.Rule{{Roles: []string{"pod_role"}, UIDs: []int{os.Getuid() + 1}}})
+	if err != nil {
+		t.Fatalf("could not create policy: %v", err)
+	}
+	processPolicy = p
+	defer func() { processPolicy = nil }()
+
+	handler := PodIdentityAuthMiddleware("us-west-2", ProcessPolicyMiddleware("pod-identity", podIdentityRoleNames, podIdentityRoleResolver,
+		ecsCredentialHandler("pod-identity", podIdentityRoleResolver, podIdentityCredentialResponse)))
+	req := httptest.NewRequest("GET", "http://169.254.170.23/v1/credentials", nil)
+	req.Header.Set("Authorization", "pod-token")
+	req = peer.WithProcess(req, &peer.Process{UID: os.Getuid()})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, expected %d", rec.Code, http.StatusForbidden)
+	}
+	if *lookups != 0 {
+		t.Errorf("got %d role lookups, expected none for a role the policy denies", *lookups)
+	}
+}
@@ -5,38 +5,76 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/netflix/weep/pkg/audit"
 	"github.com/netflix/weep/pkg/cache"
 	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/httpAuth"
 	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/policy"
 	"github.com/netflix/weep/pkg/reachability"
 
 	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
 )
 
-func Run(host string, port int, role, region string, assumeChain []string, shutdown chan os.Signal) error {
-	ipaddress := net.ParseIP(host)
+// Run starts the metadata service on each of hosts, which can be a mix of IPv4 and IPv6 addresses.
+// IMDS is served for role and for any roles mapped to source addresses in server.source_roles.
+func Run(hosts []string, port int, role, region string, assumeChain []string, shutdown chan os.Signal) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("no listen address provided")
+	}
+	var listenAddrs []string
+	servingIPv6 := false
+	for _, host := range hosts {
+		ipaddress := net.ParseIP(host)
+		if ipaddress == nil {
+			return fmt.Errorf("invalid IP: %s", host)
+		}
+		if ipaddress.To4() == nil {
+			servingIPv6 = true
+		}
+		listenAddrs = append(listenAddrs, net.JoinHostPort(ipaddress.String(), strconv.Itoa(port)))
+	}
 
-	if ipaddress == nil {
-		return fmt.Errorf("invalid IP: %s", host)
+	if err := configure(); err != nil {
+		return err
+	}
+	if err := loadSourceRoles(); err != nil {
+		return err
+	}
+	if err := loadTaskMetadataTemplates(); err != nil {
+		return err
 	}
 
-	listenAddr := fmt.Sprintf("%s:%d", ipaddress, port)
+	// Requests addressed to one of weep's own listen addresses, like a bridge interface, aren't
+	// DNS rebinding attempts
+	for i, host := range hosts {
+		if ip := net.ParseIP(host); !ip.IsUnspecified() {
+			allowedHosts.Add(listenAddrs[i])
+		}
+	}
 
 	router := mux.NewRouter()
 	router.HandleFunc("/healthcheck", HealthcheckHandler)
 
-	isServingIMDS := role != ""
+	isServingIMDS := role != "" || len(sourceRoles) > 0
 
 	if isServingIMDS {
-		logging.Log.Infof("Configuring weep IMDS service for role %s", role)
 		client, err := creds.GetClient()
 		if err != nil {
 			return err
 		}
-		err = cache.GlobalCache.SetDefault(client, role, region, assumeChain)
-		if err != nil {
+		if role != "" {
+			logging.Log.Infof("Configuring weep IMDS service for role %s", role)
+			err = cache.GlobalCache.SetDefault(client, role, region, assumeChain)
+			if err != nil {
+				return err
+			}
+		}
+		if err := resolveSourceRoles(client, region); err != nil {
 			return err
 		}
 
@@ -55,11 +93,23 @@ func Run(host string, port int, role, region string, assumeChain []string, shutd
 		router.HandleFunc("/{version}/dynamic/instance-identity/document", InstanceMetadataMiddleware(InstanceIdentityDocumentHandler))
 	}
 
-	router.HandleFunc("/ecs/{role:.*}", TaskMetadataMiddleware(getCredentialHandler(region)))
+	// Injected events are served without a role too, for applications that only use the ECS
+	// credential provider but still poll for spot interruptions
+	router.HandleFunc("/{version}/meta-data/spot/instance-action", InstanceEventsMiddleware(SpotInstanceActionHandler))
+	router.HandleFunc("/{version}/meta-data/spot/termination-time", InstanceEventsMiddleware(SpotTerminationTimeHandler))
+	router.HandleFunc("/{version}/meta-data/events/maintenance/scheduled", InstanceEventsMiddleware(ScheduledEventsHandler))
+	router.HandleFunc("/{version}/meta-data/events/recommendations/rebalance", InstanceEventsMiddleware(RebalanceRecommendationHandler))
+	router.HandleFunc("/weep/admin/imds/events", AdminMiddleware(IMDSEventsAdminHandler)).Methods("POST", "DELETE")
+
+	router.HandleFunc("/ecs/{role:.*}", TaskMetadataMiddleware(ProcessPolicyMiddleware("ecs", ecsRoleNames, ecsRoleResolver(region), getCredentialHandler(region))))
+	router.HandleFunc("/v1/credentials", TaskMetadataMiddleware(PodIdentityAuthMiddleware(region, ProcessPolicyMiddleware("pod-identity", podIdentityRoleNames, podIdentityRoleResolver, ecsCredentialHandler("pod-identity", podIdentityRoleResolver, podIdentityCredentialResponse))))).Methods("GET")
+	router.HandleFunc(TaskMetadataPathPrefix+"{container}", TaskMetadataMiddleware(taskMetadataHandler(containerMetadataTemplate, region))).Methods("GET")
+	router.HandleFunc(TaskMetadataPathPrefix+"{container}/task", TaskMetadataMiddleware(taskMetadataHandler(taskMetadataTemplate, region))).Methods("GET")
+	router.HandleFunc(TaskMetadataPathPrefix+"{container}/stats", TaskMetadataMiddleware(taskMetadataHandler(containerStatsTemplate, region))).Methods("GET")
+	router.HandleFunc(TaskMetadataPathPrefix+"{container}/task/stats", TaskMetadataMiddleware(taskMetadataHandler(taskStatsTemplate, region))).Methods("GET")
+	router.HandleFunc("/weep/admin/login", AdminMiddleware(LoginAdminHandler)).Methods("POST")
 	router.HandleFunc("/{path:.*}", TaskMetadataMiddleware(NotFoundHandler))
 
-	logging.Log.Info("starting weep on ", listenAddr)
-	fmt.Printf("starting weep on %s\n", listenAddr)
 	srv := &http.Server{
 		ReadTimeout:       1 * time.Second,
 		WriteTimeout:      10 * time.Second,
@@ -68,27 +118,104 @@ func Run(host string, port int, role, region string, assumeChain []string, shutd
 		Handler:           router,
 	}
 
-	ln, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		logging.LogError(err, "listen failed")
-		return err
+	listeners := make([]net.Listener, 0, len(listenAddrs))
+	for _, listenAddr := range listenAddrs {
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			logging.LogError(err, "listen failed")
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
 	}
 
-	go func() {
-		if err := srv.Serve(ln); err != nil {
-			logging.LogError(err, "server failed")
+	for _, ln := range listeners {
+		logging.Log.Info("starting weep on ", ln.Addr())
+		fmt.Printf("starting weep on %s\n", ln.Addr())
+		go func(ln net.Listener) {
+			if err := srv.Serve(ln); err != nil {
+				logging.LogError(err, "server failed")
+			}
+		}(ln)
+	}
+
+	signingProxy, err := startSigningProxy(role, region, assumeChain)
+	if err != nil {
+		for _, l := range listeners {
+			_ = l.Close()
 		}
-	}()
+		return err
+	}
+	if signingProxy != nil {
+		defer signingProxy.Close()
+	}
 
 	if isServingIMDS {
 		go func() {
 			logging.Log.Debug("Testing IMDS reachability")
-			reachability.TestReachability()
+			endpoints := []string{reachability.IPv4Endpoint}
+			if servingIPv6 {
+				endpoints = append(endpoints, reachability.IPv6Endpoint)
+			}
+			reachability.TestReachability(endpoints...)
 		}()
 	}
 
+	stopMonitor := make(chan struct{})
+	defer close(stopMonitor)
+	go httpAuth.MonitorExpiration(stopMonitor)
+
 	// Check for interrupt signal and exit cleanly
 	<-shutdown
 	fmt.Println("shutdown signal received, stopping server..")
 	return nil
 }
+
+// InterfaceAddresses returns the IP addresses of a network interface, like a docker bridge, that
+// weep can listen on. IPv6 link-local addresses are skipped since they can't be used without a zone.
+func InterfaceAddresses(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		result = append(result, ipnet.IP.String())
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", name)
+	}
+	return result, nil
+}
+
+// configure applies the audit log, process policy, and allowed hosts settings shared by every
+// endpoint weep serves
+func configure() error {
+	if viper.GetBool("audit.enabled") {
+		if err := audit.Configure(viper.GetString("audit.log_file")); err != nil {
+			return err
+		}
+	}
+
+	p, err := policy.Load()
+	if err != nil {
+		return err
+	}
+	processPolicy = p
+
+	if hosts := viper.GetStringSlice("server.allowed_hosts"); len(hosts) > 0 {
+		allowedHosts = newHostAllowlist(hosts)
+	}
+
+	return loadPodIdentityAssociations()
+}
@@ -0,0 +1,379 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/weep/pkg/cache"
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SigningProxyConfig is read from server.signing_proxy
+type SigningProxyConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Address string   `mapstructure:"address"`
+	Port    int      `mapstructure:"port"`
+	Role    string   `mapstructure:"role"`
+	Assume  []string `mapstructure:"assume"`
+	// Service and Region are inferred from the target host when they're empty
+	Service string `mapstructure:"service"`
+	Region  string `mapstructure:"region"`
+	// AllowedHosts are the hosts requests may be forwarded to. An entry starting with "*." matches
+	// any subdomain, and an entry with a port only matches that port.
+	AllowedHosts []string `mapstructure:"allowed_hosts"`
+	// UpstreamScheme is used to connect to the target host. Clients send plain HTTP to the proxy so
+	// the request can be signed, and the proxy connects to the target with https by default.
+	UpstreamScheme string `mapstructure:"upstream_scheme"`
+	// MaxBufferedBody is the largest request body that's held in memory for signing. Larger bodies
+	// and bodies of unknown length are spooled to a temporary file, except for S3, which accepts
+	// streamed bodies with an unsigned payload.
+	MaxBufferedBody int64 `mapstructure:"max_buffered_body"`
+}
+
+// strippedSigningHeaders are removed from requests before they're signed, so a client's own
+// signature or forwarding headers don't leak upstream
+var strippedSigningHeaders = []string{
+	"Authorization",
+	"X-Amz-Date",
+	"X-Amz-Security-Token",
+	"X-Amz-Content-Sha256",
+	"X-Forwarded-For",
+}
+
+// signingServiceNames maps endpoint prefixes to SigV4 service names where they differ
+var signingServiceNames = map[string]string{
+	"aps-workspaces": "aps",
+	"email":          "ses",
+}
+
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-\d+$`)
+
+type signingTargetKey struct{}
+
+// signingTarget is the service and region a proxied request is signed for
+type signingTarget struct {
+	service string
+	region  string
+}
+
+// SigningProxy is an HTTP forward proxy that signs requests with SigV4 before forwarding them
+type SigningProxy struct {
+	config SigningProxyConfig
+	proxy  *httputil.ReverseProxy
+}
+
+// NewSigningProxy returns a signing proxy that signs requests with credentials from provider.
+// They're retrieved for every request, so provider must cache them itself and keep them fresh,
+// like a RefreshableProvider does.
+func NewSigningProxy(config SigningProxyConfig, provider credentials.Provider) *SigningProxy {
+	if config.UpstreamScheme == "" {
+		config.UpstreamScheme = "https"
+	}
+	p := &SigningProxy{config: config}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = config.UpstreamScheme
+			r.Host = r.URL.Host
+		},
+		Transport: &signingTransport{
+			base:            http.DefaultTransport,
+			provider:        provider,
+			maxBufferedBody: config.MaxBufferedBody,
+		},
+		// Flush immediately so streamed responses reach the client as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logging.Log.WithError(err).Errorf("signing proxy request to %s failed", r.URL.Host)
+			util.WriteError(w, "upstream request failed", http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+func (p *SigningProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		util.WriteError(w, "the signing proxy can't sign tunneled requests, send plain http:// requests and the proxy will use https upstream", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.URL.IsAbs() {
+		util.WriteError(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	if !p.hostAllowed(r.URL.Host) {
+		logging.Log.Warnf("signing proxy request to %s rejected: host not allowed", r.URL.Host)
+		util.WriteError(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+	target, err := p.target(r.URL.Hostname())
+	if err != nil {
+		util.WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Log.WithFields(logrus.Fields{
+		"host":    r.URL.Host,
+		"method":  r.Method,
+		"service": target.service,
+		"region":  target.region,
+	}).Debug("signing proxy request")
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signingTargetKey{}, target)))
+}
+
+// hostAllowed returns true if host, which may include a port, matches the allowlist
+func (p *SigningProxy) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, pattern := range p.config.AllowedHosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		candidate := hostname
+		if _, _, err := net.SplitHostPort(pattern); err == nil {
+			candidate = host
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(candidate, pattern[1:]) {
+				return true
+			}
+		} else if candidate == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the service and region to sign for, preferring the configured values over
+// those inferred from hostname
+func (p *SigningProxy) target(hostname string) (signingTarget, error) {
+	service, region := inferSigningTarget(hostname)
+	if p.config.Service != "" {
+		service = p.config.Service
+	}
+	if p.config.Region != "" {
+		region = p.config.Region
+	}
+	if service == "" || region == "" {
+		return signingTarget{}, fmt.Errorf("could not infer the service and region for %s, set them in server.signing_proxy", hostname)
+	}
+	return signingTarget{service: service, region: region}, nil
+}
+
+// inferSigningTarget infers the service and region from an AWS endpoint hostname, such as
+// sts.us-west-2.amazonaws.com, bucket.s3.us-east-1.amazonaws.com, or
+// search-domain.us-east-1.es.amazonaws.com. Global endpoints are signed for us-east-1.
+func inferSigningTarget(hostname string) (service, region string) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	var prefix string
+	for _, suffix := range []string{".amazonaws.com", ".amazonaws.com.cn"} {
+		if strings.HasSuffix(hostname, suffix) {
+			prefix = strings.TrimSuffix(hostname, suffix)
+			break
+		}
+	}
+	if prefix == "" {
+		return "", ""
+	}
+	labels := strings.Split(prefix, ".")
+	for i, label := range labels {
+		if !awsRegionPattern.MatchString(label) {
+			continue
+		}
+		region = label
+		switch {
+		case i+1 < len(labels):
+			service = labels[i+1]
+		case i > 0:
+			service = labels[i-1]
+		}
+		break
+	}
+	if region == "" {
+		region = "us-east-1"
+		service = labels[len(labels)-1]
+	}
+	if name, ok := signingServiceNames[service]; ok {
+		service = name
+	}
+	return service, region
+}
+
+// signingTransport signs requests before passing them to base
+type signingTransport struct {
+	base            http.RoundTripper
+	provider        credentials.Provider
+	maxBufferedBody int64
+}
+
+func (t *signingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	target, ok := r.Context().Value(signingTargetKey{}).(signingTarget)
+	if !ok {
+		return nil, fmt.Errorf("no signing target for request")
+	}
+	r = r.Clone(r.Context())
+	for _, h := range strippedSigningHeaders {
+		r.Header.Del(h)
+	}
+
+	// A credentials.Credentials would keep the first value forever, since a RefreshableProvider
+	// never reports itself expired
+	value, err := t.provider.Retrieve()
+	if err != nil {
+		if r.Body != nil {
+			_ = r.Body.Close()
+		}
+		return nil, err
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentialsFromCreds(value), func(s *v4.Signer) {
+		s.DisableRequestBodyOverwrite = true
+	})
+	body, err := t.prepareBody(r, target.service)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil && r.Body != nil {
+		// The body is streamed without being read first, which only S3 accepts
+		signer.UnsignedPayload = true
+	}
+	if _, err := signer.Sign(r, body, target.service, target.region, time.Now()); err != nil {
+		if r.Body != nil {
+			_ = r.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
+
+// prepareBody replaces the body of r with one that can be read once for signing and again when
+// the request is sent, and returns it. It returns nil if there's no body or if the body should
+// be streamed with an unsigned payload.
+func (t *signingTransport) prepareBody(r *http.Request, service string) (io.ReadSeeker, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		r.Body = nil
+		return nil, nil
+	}
+	if r.ContentLength >= 0 && r.ContentLength <= t.maxBufferedBody {
+		b, err := ioutil.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		return bytes.NewReader(b), nil
+	}
+	if service == "s3" {
+		return nil, nil
+	}
+
+	f, err := ioutil.TempFile("", "weep-signing-proxy-")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &tempFileBody{f}
+	size, err := io.Copy(f, r.Body)
+	_ = r.Body.Close()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = spooled.Close()
+		return nil, err
+	}
+	r.Body = spooled
+	r.ContentLength = size
+	r.Header.Del("Transfer-Encoding")
+	r.TransferEncoding = nil
+	return f, nil
+}
+
+// tempFileBody is a request body backed by a temporary file that's removed when the body is closed
+type tempFileBody struct {
+	*os.File
+}
+
+func (b *tempFileBody) Close() error {
+	err := b.File.Close()
+	_ = os.Remove(b.Name())
+	return err
+}
+
+// startSigningProxy starts the signing proxy if it's enabled in the config, signing requests
+// with credentials for its configured role or, if it doesn't have one, the default role
+func startSigningProxy(role, region string, assumeChain []string) (*http.Server, error) {
+	var config SigningProxyConfig
+	if err := viper.UnmarshalKey("server.signing_proxy", &config); err != nil {
+		return nil, err
+	}
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.Role == "" {
+		config.Role, config.Assume = role, assumeChain
+	}
+	if config.Role == "" {
+		return nil, fmt.Errorf("the signing proxy needs a role, set server.signing_proxy.role or pass a role to weep serve")
+	}
+	client, err := creds.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	rp, err := cache.GlobalCache.GetOrSet(client, config.Role, region, config.Assume)
+	if err != nil {
+		return nil, err
+	}
+
+	resolve := func(r *http.Request) (*creds.RefreshableProvider, error) {
+		return rp, nil
+	}
+	srv := &http.Server{
+		ReadHeaderTimeout: 2 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		Handler:           ProcessPolicyMiddleware("signing-proxy", providerRoleNames(rp), resolve, NewSigningProxy(config, rp).ServeHTTP),
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(config.Address, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, err
+	}
+	logging.Log.Infof("starting signing proxy for %s on %s", rp.RoleArn, ln.Addr())
+	fmt.Printf("starting signing proxy for %s on %s\n", rp.RoleArn, ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.LogError(err, "signing proxy failed")
+		}
+	}()
+	return srv, nil
+}
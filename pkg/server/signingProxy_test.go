@@ -0,0 +1,230 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/netflix/weep/pkg/httpAuth/sigv4/sigv4test"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// testCredentialProvider is a credentials.Provider that never expires, like a RefreshableProvider,
+// whose credentials can be rotated
+type testCredentialProvider struct {
+	sync.Mutex
+	value credentials.Value
+}
+
+func newTestCredentialProvider() *testCredentialProvider {
+	return &testCredentialProvider{value: credentials.Value{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "session-token",
+	}}
+}
+
+func (p *testCredentialProvider) Retrieve() (credentials.Value, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.value, nil
+}
+
+func (p *testCredentialProvider) IsExpired() bool {
+	return false
+}
+
+func (p *testCredentialProvider) rotate(accessKeyID string) {
+	p.Lock()
+	defer p.Unlock()
+	p.value.AccessKeyID = accessKeyID
+	p.value.SessionToken = "session-token-" + accessKeyID
+}
+
+func newTestSigningProxy(t *testing.T, service string, verifier *sigv4test.Verifier) (*http.Client, string) {
+	upstream := httptest.NewServer(verifier)
+	t.Cleanup(upstream.Close)
+	upstreamURL, _ := url.Parse(upstream.URL)
+	if verifier.Provider == nil {
+		verifier.Provider = newTestCredentialProvider()
+	}
+	verifier.Service = service
+	verifier.Region = "us-west-2"
+
+	proxy := httptest.NewServer(NewSigningProxy(SigningProxyConfig{
+		Service:         service,
+		Region:          "us-west-2",
+		AllowedHosts:    []string{upstreamURL.Host},
+		UpstreamScheme:  "http",
+		MaxBufferedBody: 16,
+	}, verifier.Provider))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	return client, upstream.URL
+}
+
+// chunkedReader hides the length of a body so it's sent with chunked encoding
+type chunkedReader struct {
+	io.Reader
+}
+
+func TestSigningProxy(t *testing.T) {
+	large := strings.Repeat("streamed body ", 100)
+	cases := []struct {
+		Description     string
+		Service         string
+		Method          string
+		Path            string
+		Body            io.Reader
+		ExpectedBody    string
+		ExpectedPayload string
+	}{
+		{
+			Description: "GET with a query string",
+			Service:     "execute-api",
+			Method:      "GET",
+			Path:        "/prod/items?b=2&a=1",
+		},
+		{
+			Description:  "buffered body",
+			Service:      "execute-api",
+			Method:       "POST",
+			Path:         "/prod/items",
+			Body:         strings.NewReader("small"),
+			ExpectedBody: "small",
+		},
+		{
+			Description:  "spooled body of unknown length",
+			Service:      "execute-api",
+			Method:       "POST",
+			Path:         "/prod/items",
+			Body:         chunkedReader{strings.NewReader(large)},
+			ExpectedBody: large,
+		},
+		{
+			Description:     "streamed body to S3",
+			Service:         "s3",
+			Method:          "PUT",
+			Path:            "/bucket/key",
+			Body:            chunkedReader{strings.NewReader(large)},
+			ExpectedBody:    large,
+			ExpectedPayload: "UNSIGNED-PAYLOAD",
+		},
+	}
+	for _, tc := range cases {
+		verifier := &sigv4test.Verifier{}
+		client, upstreamURL := newTestSigningProxy(t, tc.Service, verifier)
+		req, err := http.NewRequest(tc.Method, upstreamURL+tc.Path, tc.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A client's own signature must not be forwarded
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=bogus")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Description, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !verifier.Verified {
+			t.Errorf("%s: got status %d, signature error: %v", tc.Description, resp.StatusCode, verifier.Err)
+		}
+		if string(verifier.Body) != tc.ExpectedBody {
+			t.Errorf("%s: upstream got body of length %d, expected %d", tc.Description, len(verifier.Body), len(tc.ExpectedBody))
+		}
+		if tc.ExpectedPayload != "" && verifier.Payload != tc.ExpectedPayload {
+			t.Errorf("%s: got payload hash %s, expected %s", tc.Description, verifier.Payload, tc.ExpectedPayload)
+		}
+	}
+}
+
+func TestSigningProxyRejectsRequests(t *testing.T) {
+	verifier := &sigv4test.Verifier{}
+	client, _ := newTestSigningProxy(t, "execute-api", verifier)
+
+	resp, err := client.Get("http://not-allowed.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d for a host that isn't allowed, expected %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// HTTPS requests are tunneled with CONNECT, which can't be signed
+	_, err = client.Get("https://not-allowed.example.com/")
+	if err == nil {
+		t.Errorf("expected CONNECT to be rejected")
+	}
+	if verifier.Verified || verifier.Err != nil {
+		t.Errorf("rejected requests should not reach the upstream")
+	}
+}
+
+func TestSigningProxyRotatedCredentials(t *testing.T) {
+	provider := newTestCredentialProvider()
+	verifier := &sigv4test.Verifier{Provider: provider}
+	client, upstreamURL := newTestSigningProxy(t, "execute-api", verifier)
+	for _, accessKeyID := range []string{"AKIDEXAMPLE", "AKIDROTATED"} {
+		provider.rotate(accessKeyID)
+		resp, err := client.Get(upstreamURL + "/prod/items")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !verifier.Verified {
+			t.Errorf("%s: got status %d, signature error: %v", accessKeyID, resp.StatusCode, verifier.Err)
+		}
+		if !strings.Contains(verifier.Authorization, "Credential="+accessKeyID+"/") {
+			t.Errorf("got Authorization %s, expected it to use %s", verifier.Authorization, accessKeyID)
+		}
+	}
+}
+
+func TestSigningProxyHostAllowed(t *testing.T) {
+	p := NewSigningProxy(SigningProxyConfig{AllowedHosts: []string{"*.amazonaws.com", "localhost:8080"}}, newTestCredentialProvider())
+	cases := map[string]bool{
+		"sts.amazonaws.com":           true,
+		"sts.us-west-2.amazonaws.com": true,
+		"sts.amazonaws.com:443":       true,
+		"evilamazonaws.com":           false,
+		"amazonaws.com.evil.com":      false,
+		"localhost:8080":              true,
+		"localhost:8081":              false,
+		"localhost":                   false,
+	}
+	for host, expected := range cases {
+		if got := p.hostAllowed(host); got != expected {
+			t.Errorf("%s: got %v, expected %v", host, got, expected)
+		}
+	}
+}
+
+func TestInferSigningTarget(t *testing.T) {
+	cases := []struct {
+		Host    string
+		Service string
+		Region  string
+	}{
+		{"sts.amazonaws.com", "sts", "us-east-1"},
+		{"sts.us-west-2.amazonaws.com", "sts", "us-west-2"},
+		{"bucket.s3.eu-west-1.amazonaws.com", "s3", "eu-west-1"},
+		{"bucket.s3.amazonaws.com", "s3", "us-east-1"},
+		{"search-logs-abc123.us-east-1.es.amazonaws.com", "es", "us-east-1"},
+		{"abc123.execute-api.ap-southeast-2.amazonaws.com", "execute-api", "ap-southeast-2"},
+		{"aps-workspaces.us-east-1.amazonaws.com", "aps", "us-east-1"},
+		{"logs.us-gov-west-1.amazonaws.com", "logs", "us-gov-west-1"},
+		{"example.com", "", ""},
+	}
+	for _, tc := range cases {
+		service, region := inferSigningTarget(tc.Host)
+		if service != tc.Service || region != tc.Region {
+			t.Errorf("%s: got %s/%s, expected %s/%s", tc.Host, service, region, tc.Service, tc.Region)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/netflix/weep/pkg/cache"
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/logging"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SourceRole maps requests from an IP address or CIDR to a role, so containers that reach weep
+// through the same bridge network can each get their own credentials
+type SourceRole struct {
+	// Source is an IP address or a CIDR
+	Source string   `mapstructure:"source"`
+	Role   string   `mapstructure:"role"`
+	Assume []string `mapstructure:"assume"`
+
+	network  *net.IPNet
+	provider *creds.RefreshableProvider
+}
+
+// sourceRoles is populated by loadSourceRoles and resolved by resolveSourceRoles when weep serve starts
+var sourceRoles []*SourceRole
+
+// loadSourceRoles reads and validates server.source_roles from the config
+func loadSourceRoles() error {
+	var configured []*SourceRole
+	if err := viper.UnmarshalKey("server.source_roles", &configured); err != nil {
+		return err
+	}
+	for _, sr := range configured {
+		if sr.Role == "" {
+			return fmt.Errorf("source role mapping for %s is missing a role", sr.Source)
+		}
+		network, err := parseSource(sr.Source)
+		if err != nil {
+			return err
+		}
+		sr.network = network
+	}
+	sourceRoles = configured
+	return nil
+}
+
+// parseSource parses an IP address or CIDR into a network. A single address is treated as a
+// network containing only that address.
+func parseSource(source string) (*net.IPNet, error) {
+	source = strings.TrimSpace(source)
+	if strings.Contains(source, "/") {
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source CIDR %s: %w", source, err)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source IP: %s", source)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// resolveSourceRoles retrieves credentials for every mapped role, so misconfigured roles are
+// reported when weep starts rather than when a container first asks for credentials
+func resolveSourceRoles(client creds.HTTPClient, region string) error {
+	for _, sr := range sourceRoles {
+		rp, err := cache.GlobalCache.GetOrSet(client, sr.Role, region, sr.Assume)
+		if err != nil {
+			return fmt.Errorf("could not get credentials for %s (source %s): %w", sr.Role, sr.Source, err)
+		}
+		sr.provider = rp
+		logging.Log.WithFields(logrus.Fields{
+			"source": sr.Source,
+			"role":   rp.RoleArn,
+		}).Info("serving role for source")
+	}
+	return nil
+}
+
+// sourceRoleFor returns the mapping for the source address of r, or nil if there isn't one.
+// When several mappings contain the address, the most specific one wins.
+func sourceRoleFor(r *http.Request) *SourceRole {
+	if len(sourceRoles) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	var match *SourceRole
+	matchSize := -1
+	for _, sr := range sourceRoles {
+		if sr.provider == nil || !sr.network.Contains(ip) {
+			continue
+		}
+		if size, _ := sr.network.Mask.Size(); size > matchSize {
+			match, matchSize = sr, size
+		}
+	}
+	return match
+}
+
+// instanceRoleNames returns the names of the role instanceRoleResolver returns for r
+func instanceRoleNames(r *http.Request) ([]string, error) {
+	if sr := sourceRoleFor(r); sr != nil {
+		return append([]string{sr.Role}, sr.Assume...), nil
+	}
+	rp, err := cache.GlobalCache.GetDefault()
+	if err != nil {
+		return nil, err
+	}
+	return providerRoleNames(rp)(r)
+}
+
+// instanceRoleResolver returns the role mapped to the request's source address, falling back to
+// the default role that weep serve was started with
+func instanceRoleResolver(r *http.Request) (*creds.RefreshableProvider, error) {
+	if sr := sourceRoleFor(r); sr != nil {
+		return sr.provider, nil
+	}
+	return cache.GlobalCache.GetDefault()
+}
+
+// matches returns true if a request for role and assumeChain is satisfied by the
+// mapping. An empty role means the caller will take whatever role it is mapped to.
+func (sr *SourceRole) matches(role string, assumeChain []string) bool {
+	if role != "" && role != sr.Role && role != sr.provider.RoleArn && role != sr.provider.RoleName {
+		return false
+	}
+	if len(assumeChain) > 0 && strings.Join(assumeChain, ",") != strings.Join(sr.Assume, ",") {
+		return false
+	}
+	return true
+}
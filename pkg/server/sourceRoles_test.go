@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/netflix/weep/pkg/creds"
+	"github.com/netflix/weep/pkg/peer"
+	"github.com/netflix/weep/pkg/policy"
+
+	"github.com/gorilla/mux"
+)
+
+func setTestSourceRoles(t *testing.T, mappings ...*SourceRole) {
+	for _, sr := range mappings {
+		network, err := parseSource(sr.Source)
+		if err != nil {
+			t.Fatalf("could not parse %s: %v", sr.Source, err)
+		}
+		sr.network = network
+		sr.provider = &creds.RefreshableProvider{
+			RoleName: sr.Role,
+			RoleArn:  "arn:aws:iam::123456789012:role/" + sr.Role,
+		}
+	}
+	sourceRoles = mappings
+	t.Cleanup(func() { sourceRoles = nil })
+}
+
+func TestParseSource(t *testing.T) {
+	cases := []struct {
+		Source      string
+		Contains    string
+		NotContains string
+		ExpectError bool
+	}{
+		{Source: "172.18.0.5", Contains: "172.18.0.5", NotContains: "172.18.0.6"},
+		{Source: "172.18.0.0/16", Contains: "172.18.3.4", NotContains: "172.19.0.1"},
+		{Source: "fd00::5", Contains: "fd00::5", NotContains: "fd00::6"},
+		{Source: "fd00::/64", Contains: "fd00::1234", NotContains: "fd01::1"},
+		{Source: "not-an-ip", ExpectError: true},
+		{Source: "172.18.0.0/33", ExpectError: true},
+	}
+	for _, tc := range cases {
+		network, err := parseSource(tc.Source)
+		if tc.ExpectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tc.Source, network)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Source, err)
+			continue
+		}
+		if !network.Contains(parseTestIP(t, tc.Contains)) {
+			t.Errorf("%s: expected %s to match", tc.Source, tc.Contains)
+		}
+		if network.Contains(parseTestIP(t, tc.NotContains)) {
+			t.Errorf("%s: expected %s not to match", tc.Source, tc.NotContains)
+		}
+	}
+}
+
+func TestSourceRoleFor(t *testing.T) {
+	setTestSourceRoles(t,
+		&SourceRole{Source: "172.18.0.0/16", Role: "network_role"},
+		&SourceRole{Source: "172.18.0.5", Role: "container_role"},
+	)
+	cases := []struct {
+		RemoteAddr   string
+		ExpectedRole string
+	}{
+		{RemoteAddr: "172.18.0.5:40000", ExpectedRole: "container_role"},
+		{RemoteAddr: "172.18.0.6:40000", ExpectedRole: "network_role"},
+		{RemoteAddr: "[::ffff:172.18.0.5]:40000", ExpectedRole: "container_role"},
+		{RemoteAddr: "10.0.0.1:40000", ExpectedRole: ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "http://172.18.0.1/ecs/", nil)
+		req.RemoteAddr = tc.RemoteAddr
+		var role string
+		if sr := sourceRoleFor(req); sr != nil {
+			role = sr.Role
+		}
+		if role != tc.ExpectedRole {
+			t.Errorf("%s: got role %q, expected %q", tc.RemoteAddr, role, tc.ExpectedRole)
+		}
+	}
+}
+
+func TestECSRoleResolverSourceRole(t *testing.T) {
+	setTestSourceRoles(t, &SourceRole{Source: "172.18.0.5", Role: "container_role"})
+	resolve := ecsRoleResolver("us-east-1")
+	cases := []struct {
+		Description   string
+		Path          string
+		Role          string
+		ExpectAllowed bool
+	}{
+		{Description: "no role in path", Path: "/ecs/", Role: "", ExpectAllowed: true},
+		{Description: "mapped role", Path: "/ecs/container_role", Role: "container_role", ExpectAllowed: true},
+		{Description: "mapped role ARN", Path: "/ecs/arn:aws:iam::123456789012:role/container_role", Role: "arn:aws:iam::123456789012:role/container_role", ExpectAllowed: true},
+		{Description: "other role", Path: "/ecs/other_role", Role: "other_role", ExpectAllowed: false},
+		{Description: "assume chain", Path: "/ecs/?assume=arn:aws:iam::123456789012:role/other", Role: "", ExpectAllowed: false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "http://172.18.0.1"+tc.Path, nil)
+		req.RemoteAddr = "172.18.0.5:40000"
+		req = mux.SetURLVars(req, map[string]string{"role": tc.Role})
+		rp, err := resolve(req)
+		if tc.ExpectAllowed && (err != nil || rp.RoleName != "container_role") {
+			t.Errorf("%s: got %v, %v, expected container_role", tc.Description, rp, err)
+		}
+		if !tc.ExpectAllowed && err == nil {
+			t.Errorf("%s: expected an error, got %v", tc.Description, rp.RoleArn)
+		}
+	}
+}
+
+func TestECSProcessPolicy(t *testing.T) {
+	setTestSourceRoles(t, &SourceRole{Source: "172.18.0.5", Role: "container_role"})
+	p, err := policy.New([]policy.Rule{{Roles: []string{"allowed"}, UIDs: []int{os.Getuid()}}})
+	if err != nil {
+		t.Fatalf("could not create policy: %v", err)
+	}
+	processPolicy = p
+	defer func() { processPolicy = nil }()
+
+	resolves := 0
+	resolve := func(r *http.Request) (*creds.RefreshableProvider, error) {
+		resolves++
+		return ecsRoleResolver("us-east-1")(r)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/ecs/{role:.*}", ProcessPolicyMiddleware("ecs", ecsRoleNames, resolve, getCredentialHandler("us-east-1")))
+	cases := []struct {
+		Description string
+		Path        string
+		RemoteAddr  string
+	}{
+		{Description: "role in path", Path: "/ecs/denied", RemoteAddr: "10.0.0.1:40000"},
+		{Description: "assume chain", Path: "/ecs/allowed?assume=arn:aws:iam::123456789012:role/denied", RemoteAddr: "10.0.0.1:40000"},
+		{Description: "source role", Path: "/ecs/", RemoteAddr: "172.18.0.5:40000"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "http://localhost"+tc.Path, nil)
+		req.RemoteAddr = tc.RemoteAddr
+		req = peer.WithProcess(req, &peer.Process{UID: os.Getuid()})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, expected %d", tc.Description, rec.Code, http.StatusForbidden)
+		}
+	}
+	if resolves != 0 {
+		t.Errorf("got %d resolves, expected credentials not to be fetched for denied roles", resolves)
+	}
+}
+
+func TestInstanceRoleResolverSourceRole(t *testing.T) {
+	setTestSourceRoles(t, &SourceRole{Source: "172.18.0.0/16", Role: "network_role"})
+	req := httptest.NewRequest("GET", "http://169.254.169.254/latest/meta-data/iam/security-credentials/", nil)
+	req.RemoteAddr = "172.18.0.9:40000"
+	rec := httptest.NewRecorder()
+	RoleHandler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "network_role\n" {
+		t.Errorf("got status %d and body %q, expected %d and %q", rec.Code, rec.Body.String(), http.StatusOK, "network_role\n")
+	}
+}
+
+func parseTestIP(t *testing.T, s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("invalid test IP: %s", s)
+	}
+	return ip
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2020 Netflix, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/netflix/weep/pkg/logging"
+	"github.com/netflix/weep/pkg/metadata"
+	"github.com/netflix/weep/pkg/util"
+
+	"github.com/spf13/viper"
+)
+
+// TaskMetadataPathPrefix is the prefix of the ECS task metadata v4 routes. The full path, including
+// the container ID, is what ECS_CONTAINER_METADATA_URI_V4 points to.
+const TaskMetadataPathPrefix = "/v4/"
+
+// Names of the task metadata templates. Each can be replaced with a file containing a JSON template.
+const (
+	containerMetadataTemplate = "container"
+	taskMetadataTemplate      = "task"
+	containerStatsTemplate    = "stats"
+	taskStatsTemplate         = "task_stats"
+)
+
+var defaultTaskMetadataTemplates = map[string]string{
+	containerMetadataTemplate: `{
+  "DockerId": "{{.DockerId}}",
+  "Name": "{{.ContainerName}}",
+  "DockerName": "ecs-{{.Family}}-{{.Revision}}-{{.ContainerName}}",
+  "Image": "{{.ContainerName}}:latest",
+  "ImageID": "sha256:{{.DockerId}}",
+  "Labels": {
+    "com.amazonaws.ecs.cluster": "{{.Cluster}}",
+    "com.amazonaws.ecs.container-name": "{{.ContainerName}}",
+    "com.amazonaws.ecs.task-arn": "{{.TaskARN}}",
+    "com.amazonaws.ecs.task-definition-family": "{{.Family}}",
+    "com.amazonaws.ecs.task-definition-version": "{{.Revision}}"
+  },
+  "DesiredStatus": "RUNNING",
+  "KnownStatus": "RUNNING",
+  "Limits": {
+    "CPU": {{.CPU}},
+    "Memory": {{.Memory}}
+  },
+  "CreatedAt": "{{.StartedAt}}",
+  "StartedAt": "{{.StartedAt}}",
+  "Type": "NORMAL",
+  "ContainerARN": "arn:aws:ecs:{{.Region}}:{{.AccountId}}:container/{{.Cluster}}/{{.TaskId}}/{{.DockerId}}",
+  "Networks": [
+    {
+      "NetworkMode": "awsvpc",
+      "IPv4Addresses": ["127.0.0.1"]
+    }
+  ]
+}`,
+	taskMetadataTemplate: `{
+  "Cluster": "{{.Cluster}}",
+  "TaskARN": "{{.TaskARN}}",
+  "Family": "{{.Family}}",
+  "Revision": "{{.Revision}}",
+  "DesiredStatus": "RUNNING",
+  "KnownStatus": "RUNNING",
+  "Limits": {
+    "CPU": {{.TaskCPU}},
+    "Memory": {{.Memory}}
+  },
+  "PullStartedAt": "{{.StartedAt}}",
+  "PullStoppedAt": "{{.StartedAt}}",
+  "AvailabilityZone": "{{.Region}}a",
+  "LaunchType": "FARGATE",
+  "Containers": [
+    {{template "container" .}}
+  ]
+}`,
+	containerStatsTemplate: `{
+  "read": "{{.Now}}",
+  "name": "/ecs-{{.Family}}-{{.Revision}}-{{.ContainerName}}",
+  "id": "{{.DockerId}}",
+  "num_procs": 0,
+  "cpu_stats": {},
+  "precpu_stats": {},
+  "memory_stats": {
+    "limit": {{.MemoryBytes}}
+  },
+  "networks": {}
+}`,
+	taskStatsTemplate: `{
+  "{{.DockerId}}": {{template "stats" .}}
+}`,
+}
+
+// TaskMetadata is the data available to task metadata templates
+type TaskMetadata struct {
+	AccountId     string
+	Region        string
+	RoleArn       string
+	RoleName      string
+	Cluster       string
+	Family        string
+	Revision      string
+	ContainerName string
+	DockerId      string
+	TaskId        string
+	TaskARN       string
+	CPU           int
+	TaskCPU       float64
+	Memory        int
+	MemoryBytes   int64
+	StartedAt     string
+	Now           string
+}
+
+// taskMetadataTemplates holds the parsed templates, populated by loadTaskMetadataTemplates
+var taskMetadataTemplates *template.Template
+
+// TaskMetadataContainerID returns the ID of the emulated container, which is derived from the
+// configured cluster, family, and container name so it stays the same across restarts
+func TaskMetadataContainerID() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s",
+		viper.GetString("server.task_metadata.cluster"),
+		viper.GetString("server.task_metadata.family"),
+		viper.GetString("server.task_metadata.container_name"))))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTaskMetadataTemplates parses the built-in templates, replacing each one that has a file
+// configured in server.task_metadata.templates, and makes sure they render valid JSON
+func loadTaskMetadataTemplates() error {
+	t := template.New("task_metadata").Option("missingkey=error")
+	for name, text := range defaultTaskMetadataTemplates {
+		if filename := viper.GetString("server.task_metadata.templates." + name); filename != "" {
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("could not read task metadata template %s: %w", name, err)
+			}
+			text = string(b)
+		}
+		if _, err := t.New(name).Parse(text); err != nil {
+			return fmt.Errorf("could not parse task metadata template %s: %w", name, err)
+		}
+	}
+	example := newTaskMetadata("us-east-1", "arn:aws:iam::123456789012:role/example", "example")
+	for name := range defaultTaskMetadataTemplates {
+		if _, err := renderTaskMetadata(t, name, example); err != nil {
+			return err
+		}
+	}
+	taskMetadataTemplates = t
+	return nil
+}
+
+// newTaskMetadata returns the template data for the given role
+func newTaskMetadata(region, roleArn, roleName string) TaskMetadata {
+	accountID := "123456789012"
+	if awsArn, err := util.ArnParse(roleArn); err == nil {
+		accountID = awsArn.AccountId
+	}
+	cluster := viper.GetString("server.task_metadata.cluster")
+	dockerID := TaskMetadataContainerID()
+	taskID := dockerID[:32]
+	cpu := viper.GetInt("server.task_metadata.cpu")
+	memory := viper.GetInt("server.task_metadata.memory")
+	return TaskMetadata{
+		AccountId:     accountID,
+		Region:        region,
+		RoleArn:       roleArn,
+		RoleName:      roleName,
+		Cluster:       cluster,
+		Family:        viper.GetString("server.task_metadata.family"),
+		Revision:      viper.GetString("server.task_metadata.revision"),
+		ContainerName: viper.GetString("server.task_metadata.container_name"),
+		DockerId:      dockerID,
+		TaskId:        taskID,
+		TaskARN:       fmt.Sprintf("arn:aws:ecs:%s:%s:task/%s/%s", region, accountID, cluster, taskID),
+		CPU:           cpu,
+		TaskCPU:       float64(cpu) / 1024,
+		Memory:        memory,
+		MemoryBytes:   int64(memory) * 1024 * 1024,
+		StartedAt:     metadata.StartupTimestamp().UTC().Format(time.RFC3339Nano),
+		Now:           time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// renderTaskMetadata executes the named template and checks that the result is valid JSON
+func renderTaskMetadata(t *template.Template, name string, data TaskMetadata) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, fmt.Errorf("could not render task metadata template %s: %w", name, err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("task metadata template %s did not render valid JSON", name)
+	}
+	return buf.Bytes(), nil
+}
+
+// taskMetadataHandler serves the named template for the role of the request, falling back to
+// placeholder values when weep isn't serving a default role
+func taskMetadataHandler(name, region string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var roleArn, roleName string
+		if rp, err := instanceRoleResolver(r); err == nil {
+			roleArn, roleName = rp.RoleArn, rp.RoleName
+		}
+		body, err := renderTaskMetadata(taskMetadataTemplates, name, newTaskMetadata(region, roleArn, roleName))
+		if err != nil {
+			logging.Log.Error(err)
+			util.WriteError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(body); err != nil {
+			logging.Log.Errorf("failed to write response: %v", err)
+		}
+	}
+}
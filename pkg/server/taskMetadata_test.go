@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func setTestTaskMetadataConfig(t *testing.T) {
+	viper.Set("server.task_metadata.cluster", "test-cluster")
+	viper.Set("server.task_metadata.family", "test-family")
+	viper.Set("server.task_metadata.revision", "3")
+	viper.Set("server.task_metadata.container_name", "api")
+	viper.Set("server.task_metadata.cpu", 512)
+	viper.Set("server.task_metadata.memory", 1024)
+	t.Cleanup(func() {
+		viper.Set("server.task_metadata", nil)
+		taskMetadataTemplates = nil
+	})
+}
+
+func TestTaskMetadataHandler(t *testing.T) {
+	setTestTaskMetadataConfig(t)
+	setTestSourceRoles(t, &SourceRole{Source: "172.18.0.5", Role: "container_role"})
+	if err := loadTaskMetadataTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://172.18.0.1/v4/id/task", nil)
+	req.RemoteAddr = "172.18.0.5:40000"
+	rec := httptest.NewRecorder()
+	taskMetadataHandler(taskMetadataTemplate, "us-west-2")(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var task struct {
+		Cluster    string
+		TaskARN    string
+		Revision   string
+		Limits     map[string]float64
+		Containers []struct {
+			Name     string
+			DockerId string
+			Limits   map[string]float64
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &task); err != nil {
+		t.Fatalf("invalid task metadata: %v", err)
+	}
+	expectedARN := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/" + TaskMetadataContainerID()[:32]
+	if task.Cluster != "test-cluster" || task.TaskARN != expectedARN || task.Revision != "3" {
+		t.Errorf("got cluster %s, task ARN %s, revision %s", task.Cluster, task.TaskARN, task.Revision)
+	}
+	if task.Limits["CPU"] != 0.5 || task.Limits["Memory"] != 1024 {
+		t.Errorf("got task limits %v", task.Limits)
+	}
+	if len(task.Containers) != 1 || task.Containers[0].Name != "api" || task.Containers[0].DockerId != TaskMetadataContainerID() {
+		t.Errorf("got containers %+v", task.Containers)
+	}
+
+	for _, name := range []string{containerMetadataTemplate, containerStatsTemplate, taskStatsTemplate} {
+		rec := httptest.NewRecorder()
+		taskMetadataHandler(name, "us-west-2")(rec, req)
+		if rec.Code != http.StatusOK || !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("%s: got status %d and body %s", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestLoadTaskMetadataTemplatesFromFile(t *testing.T) {
+	setTestTaskMetadataConfig(t)
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "container.json")
+	if err := ioutil.WriteFile(valid, []byte(`{"Name": "{{.ContainerName}}", "Account": "{{.AccountId}}"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte(`{"Name": {{.ContainerName}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("server.task_metadata.templates.container", invalid)
+	if err := loadTaskMetadataTemplates(); err == nil {
+		t.Errorf("expected an error for a template that renders invalid JSON")
+	}
+
+	viper.Set("server.task_metadata.templates.container", valid)
+	if err := loadTaskMetadataTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := renderTaskMetadata(taskMetadataTemplates, containerMetadataTemplate, newTaskMetadata("us-east-1", "arn:aws:iam::111111111111:role/test", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"Name": "api", "Account": "111111111111"}`; string(body) != expected {
+		t.Errorf("got %s, expected %s", body, expected)
+	}
+}
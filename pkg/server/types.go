@@ -18,6 +18,14 @@ type ECSMetaDataCredentialResponse struct {
 	RoleArn         string
 }
 
+type PodIdentityCredentialResponse struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	AccountId       string
+	Expiration      string
+}
+
 type MetaDataIamInfoResponse struct {
 	Code               string `json:"Code"`
 	LastUpdated        string `json:"LastUpdated"`
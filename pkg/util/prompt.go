@@ -75,6 +75,18 @@ func FirstRunPrompt() error {
 			return err
 		}
 		viper.Set("challenge_settings.user", challengeUser)
+	} else if authMethod == "device_code" || authMethod == "pkce" {
+		issuer, err := PromptString("OAuth issuer URL")
+		if err != nil {
+			return err
+		}
+		viper.Set("oauth_settings.issuer", issuer)
+
+		clientID, err := PromptString("OAuth client ID")
+		if err != nil {
+			return err
+		}
+		viper.Set("oauth_settings.client_id", clientID)
 	}
 
 	home, err := homedir.Dir()
@@ -119,7 +131,7 @@ func promptConsoleMeURL() (string, error) {
 func promptAuthMethod() (string, error) {
 	prompt := promptui.Select{
 		Label: "Authentication method",
-		Items: []string{"challenge", "mtls"},
+		Items: []string{"challenge", "mtls", "device_code", "pkce", "sigv4", "token"},
 	}
 
 	_, result, err := prompt.Run()
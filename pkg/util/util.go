@@ -136,6 +136,16 @@ func WriteError(w http.ResponseWriter, message string, status int) {
 
 // OpenLink attempts to open a link in browser, if supported
 func OpenLink(link string) error {
+	if err := OpenLinkQuietly(link); err != nil {
+		return err
+	}
+	fmt.Println("Link opened in a new browser window.")
+	return nil
+}
+
+// OpenLinkQuietly is OpenLink without the message on stdout, for commands whose output is read by
+// another program
+func OpenLinkQuietly(link string) error {
 	var openUrlCommand []string = nil
 	switch runtime.GOOS {
 	case "darwin":
@@ -167,8 +177,6 @@ func OpenLink(link string) error {
 		}
 		if err != nil {
 			return err
-		} else {
-			fmt.Println("Link opened in a new browser window.")
 		}
 	} else {
 		return errors.BrowserOpenError